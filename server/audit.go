@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEvent records one file operation. Actions:
+//
+//	upload      file stored (form, chunked, direct or via a file request share)
+//	download    file or version content served (directly or via a share)
+//	delete      file or folder moved to trash
+//	purge       file, folder or trash item permanently deleted
+//	restore     trash item or version made current again
+//	share       share link created
+//	unshare     share link revoked
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	User      string    `json:"user"`
+	IP        string    `json:"ip"`
+	Path      string    `json:"path"`
+	Target    string    `json:"target,omitempty"` // where a restore put the file
+	Size      int64     `json:"size,omitempty"`
+	ShareID   string    `json:"share_id,omitempty"`
+	VersionID string    `json:"version_id,omitempty"`
+	Status    int       `json:"status"`
+	Success   bool      `json:"success"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// AuditSink receives every audit event. Write must be safe for concurrent use.
+type AuditSink interface {
+	Write(event AuditEvent) error
+	Close() error
+}
+
+// AuditFilter selects events for GET /api/audit; zero fields match everything
+type AuditFilter struct {
+	User       string
+	Action     string
+	PathPrefix string
+	IP         string
+	Success    *bool
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+}
+
+// auditQuerier is implemented by sinks that can read their events back
+type auditQuerier interface {
+	Query(filter AuditFilter) ([]AuditEvent, error)
+}
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+var (
+	auditSinks []AuditSink
+	auditQuery auditQuerier
+)
+
+// initAudit configures the sinks listed in audit.sinks (default "file")
+func initAudit() error {
+	settings := currentConfig().Audit
+	for _, name := range settings.Sinks {
+		switch name {
+		case "off":
+		case "file":
+			sink, err := newFileAuditSink(settings.LogFile, settings.LogMaxSize, settings.LogMaxFiles)
+			if err != nil {
+				return err
+			}
+			auditSinks = append(auditSinks, sink)
+			auditQuery = sink
+		case "webhook":
+			auditSinks = append(auditSinks, newWebhookAuditSink(settings.WebhookURL, settings.WebhookToken))
+		default:
+			return fmt.Errorf("unknown audit sink %q", name)
+		}
+	}
+
+	slog.Info("audit log initialized", "sinks", strings.Join(settings.Sinks, ","), "admins", len(currentConfig().Server.AdminUsers))
+	return nil
+}
+
+// closeAudit flushes and closes all sinks
+func closeAudit() {
+	for _, sink := range auditSinks {
+		if err := sink.Close(); err != nil {
+			slog.Warn("failed to close audit sink", "error", err)
+		}
+	}
+}
+
+// isAdmin reports whether the caller is listed in server.admin_users
+func isAdmin(r *http.Request) bool {
+	return slices.Contains(currentConfig().Server.AdminUsers, requestUser(r))
+}
+
+type auditKey struct{}
+
+// auditRecord collects the events of one request until its status is known
+type auditRecord struct {
+	mu     sync.Mutex
+	events []*AuditEvent
+}
+
+// withAudit writes the events handlers register with audit once the response
+// status is known, so failed operations are recorded as well
+func withAudit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		record := &auditRecord{}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r.WithContext(context.WithValue(r.Context(), auditKey{}, record)))
+
+		record.mu.Lock()
+		defer record.mu.Unlock()
+		for _, event := range record.events {
+			if event.Status == 0 {
+				event.Status = recorder.status
+			}
+			event.Success = event.Status < 400
+			event.RequestID = w.Header().Get(requestIDHeader)
+			writeAudit(r.Context(), *event)
+		}
+	}
+}
+
+// audit registers a file operation on path for the current request. The
+// returned event can be filled in further (size, final path) until the handler
+// returns; its status defaults to the response status.
+func audit(r *http.Request, action, path string) *AuditEvent {
+	event := &AuditEvent{
+		Time:   time.Now().UTC(),
+		Action: action,
+		User:   requestUser(r),
+		IP:     clientIP(r),
+		Path:   path,
+	}
+	if record, ok := r.Context().Value(auditKey{}).(*auditRecord); ok {
+		record.mu.Lock()
+		record.events = append(record.events, event)
+		record.mu.Unlock()
+	} else {
+		logFor(r.Context()).Error("audit event outside an audited route", "action", action)
+	}
+	return event
+}
+
+func writeAudit(ctx context.Context, event AuditEvent) {
+	for _, sink := range auditSinks {
+		if err := sink.Write(event); err != nil {
+			logFor(ctx).Error("failed to write audit event", "action", event.Action, "error", err)
+		}
+	}
+}
+
+// auditHandler serves GET /api/audit?user=&action=&path=&ip=&success=&since=&until=&limit=
+// to admins, newest events first
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdmin(r) {
+		http.Error(w, "Admin access required", http.StatusForbidden)
+		return
+	}
+	if auditQuery == nil {
+		http.Error(w, "Audit log queries need the file sink", http.StatusNotImplemented)
+		return
+	}
+
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events, err := auditQuery.Query(filter)
+	if err != nil {
+		logFor(r.Context()).Error("failed to query audit log", "error", err)
+		http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"events": events,
+		"count":  len(events),
+	})
+}
+
+func parseAuditFilter(r *http.Request) (AuditFilter, error) {
+	query := r.URL.Query()
+	filter := AuditFilter{
+		User:       query.Get("user"),
+		Action:     query.Get("action"),
+		PathPrefix: query.Get("path"),
+		IP:         query.Get("ip"),
+		Limit:      defaultAuditLimit,
+	}
+
+	if filter.PathPrefix != "" && !strings.HasPrefix(filter.PathPrefix, "/") {
+		filter.PathPrefix = "/" + filter.PathPrefix
+	}
+	if value := query.Get("success"); value != "" {
+		success, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid success value")
+		}
+		filter.Success = &success
+	}
+	for name, target := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s value, expected RFC 3339", name)
+			}
+			*target = parsed
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return filter, fmt.Errorf("invalid limit value")
+		}
+		filter.Limit = min(limit, maxAuditLimit)
+	}
+	return filter, nil
+}
+
+func (f AuditFilter) matches(event AuditEvent) bool {
+	switch {
+	case f.User != "" && event.User != f.User,
+		f.Action != "" && event.Action != f.Action,
+		f.PathPrefix != "" && !strings.HasPrefix(event.Path, f.PathPrefix),
+		f.IP != "" && event.IP != f.IP,
+		f.Success != nil && event.Success != *f.Success,
+		!f.Since.IsZero() && event.Time.Before(f.Since),
+		!f.Until.IsZero() && event.Time.After(f.Until):
+		return false
+	}
+	return true
+}
+
+// fileAuditSink appends events as JSON lines, rotating to path.1 … path.N when
+// the current file would exceed maxSize. Files are only ever appended to.
+type fileAuditSink struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newFileAuditSink(path string, maxSize int64, maxFiles int) (*fileAuditSink, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create audit log dir: %w", err)
+	}
+	s := &fileAuditSink{path: path, maxSize: maxSize, maxFiles: max(maxFiles, 1)}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileAuditSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat audit log: %w", err)
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+func (s *fileAuditSink) Write(event AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return fmt.Errorf("audit log is closed")
+	}
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// rotate shifts path.N-1 → path.N … path → path.1 (dropping the oldest) and
+// starts a new file. Callers hold s.mu.
+func (s *fileAuditSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+
+	os.Remove(s.rotatedName(s.maxFiles))
+	for i := s.maxFiles - 1; i >= 1; i-- {
+		os.Rename(s.rotatedName(i), s.rotatedName(i+1))
+	}
+	if err := os.Rename(s.path, s.rotatedName(1)); err != nil {
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+	return s.open()
+}
+
+func (s *fileAuditSink) rotatedName(n int) string {
+	return s.path + "." + strconv.Itoa(n)
+}
+
+func (s *fileAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// Query scans the rotated files oldest first and returns the newest matches
+func (s *fileAuditSink) Query(filter AuditFilter) ([]AuditEvent, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = defaultAuditLimit
+	}
+
+	// Hold the lock so a rotation can't move files out from under the scan
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var matches []AuditEvent
+	for i := s.maxFiles; i >= 0; i-- {
+		name := s.path
+		if i > 0 {
+			name = s.rotatedName(i)
+		}
+		file, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1<<20)
+		for scanner.Scan() {
+			var event AuditEvent
+			if json.Unmarshal(scanner.Bytes(), &event) != nil || !filter.matches(event) {
+				continue
+			}
+			matches = append(matches, event)
+			if len(matches) > 2*filter.Limit {
+				matches = append(matches[:0], matches[len(matches)-filter.Limit:]...)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(matches) > filter.Limit {
+		matches = matches[len(matches)-filter.Limit:]
+	}
+	for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+		matches[i], matches[j] = matches[j], matches[i]
+	}
+	return matches, nil
+}
+
+// webhookAuditSink POSTs each event as JSON from a background queue, retrying
+// with backoff. Events are dropped (and logged) if the receiver can't keep up.
+type webhookAuditSink struct {
+	url    string
+	token  string
+	client *http.Client
+	queue  chan AuditEvent
+	done   chan struct{}
+}
+
+const (
+	auditWebhookQueueSize = 1024
+	auditWebhookAttempts  = 5
+)
+
+func newWebhookAuditSink(endpoint, token string) *webhookAuditSink {
+	s := &webhookAuditSink{
+		url:    endpoint,
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan AuditEvent, auditWebhookQueueSize),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *webhookAuditSink) Write(event AuditEvent) error {
+	select {
+	case s.queue <- event:
+		return nil
+	default:
+		return fmt.Errorf("audit webhook queue full, event dropped")
+	}
+}
+
+// Close stops accepting events and waits for the queue to drain
+func (s *webhookAuditSink) Close() error {
+	close(s.queue)
+	<-s.done
+	return nil
+}
+
+func (s *webhookAuditSink) run() {
+	defer close(s.done)
+	for event := range s.queue {
+		body, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		backoff := time.Second
+		for attempt := 1; ; attempt++ {
+			err = s.post(body)
+			if err == nil || attempt == auditWebhookAttempts {
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err != nil {
+			slog.Error("audit webhook delivery failed", "action", event.Action, "request_id", event.RequestID, "error", err)
+		}
+	}
+}
+
+func (s *webhookAuditSink) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// The URL may embed credentials; keep it out of the logs
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
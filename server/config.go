@@ -0,0 +1,779 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting of the server. It is loaded at startup from, in
+// increasing priority: built-in defaults, a YAML file (-config or CONFIG_FILE),
+// environment variables and command-line flags (-<section>.<key>, e.g.
+// -server.port=9090). Each field names its YAML key and environment variable;
+// fields tagged secret are redacted whenever the config is printed or served.
+// Settings tagged reload:"restart" (on the field or its section) are fixed at
+// startup; everything else follows config reloads (see watchConfig).
+type Config struct {
+	Server     ServerConfig     `yaml:"server"`
+	TLS        TLSConfig        `yaml:"tls" reload:"restart"`
+	CORS       CORSConfig       `yaml:"cors"`
+	MinIO      MinIOConfig      `yaml:"minio" reload:"restart"`
+	Storage    StorageConfig    `yaml:"storage"`
+	Uploads    UploadsConfig    `yaml:"uploads"`
+	RateLimit  RateLimitConfig  `yaml:"rate_limit"`
+	Log        LogConfig        `yaml:"log"`
+	Tracing    TracingConfig    `yaml:"tracing" reload:"restart"`
+	Audit      AuditConfig      `yaml:"audit" reload:"restart"`
+	Health     HealthConfig     `yaml:"health"`
+	Trash      TrashConfig      `yaml:"trash"`
+	Versioning VersioningConfig `yaml:"versioning"`
+	Shares     SharesConfig     `yaml:"shares"`
+	Thumbnails ThumbnailsConfig `yaml:"thumbnails"`
+	Webhooks   WebhooksConfig   `yaml:"webhooks"`
+}
+
+type ServerConfig struct {
+	Port              int           `yaml:"port" env:"SERVER_PORT" reload:"restart"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"SERVER_READ_HEADER_TIMEOUT" reload:"restart"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" env:"SERVER_IDLE_TIMEOUT" reload:"restart"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" env:"SERVER_WRITE_TIMEOUT" reload:"restart"` // 0 leaves long downloads uncapped
+	MaxHeaderBytes    int64         `yaml:"max_header_bytes" env:"SERVER_MAX_HEADER_BYTES" reload:"restart"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+	AdminUsers        []string      `yaml:"admin_users" env:"ADMIN_USERS"`
+	// Proxies (CIDRs or addresses) whose X-Forwarded-For/-User/-Proto headers are believed
+	TrustedProxies []string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+	// How often the config file is checked for changes; 0 reloads on SIGHUP only
+	ConfigWatchInterval time.Duration `yaml:"config_watch_interval" env:"CONFIG_WATCH_INTERVAL" reload:"restart"`
+}
+
+// TLSConfig enables HTTPS; the files themselves are reloaded when they change
+type TLSConfig struct {
+	CertFile       string        `yaml:"cert_file" env:"TLS_CERT_FILE"` // serves HTTPS (and HTTP/2) when set
+	KeyFile        string        `yaml:"key_file" env:"TLS_KEY_FILE"`
+	MinVersion     string        `yaml:"min_version" env:"TLS_MIN_VERSION"`           // 1.2 or 1.3
+	ClientCAFile   string        `yaml:"client_ca_file" env:"TLS_CLIENT_CA_FILE"`     // CA bundle for client certificates (mTLS)
+	ClientAuth     string        `yaml:"client_auth" env:"TLS_CLIENT_AUTH"`           // off, optional or require; require when a client CA is set
+	ClientUserFrom string        `yaml:"client_user_from" env:"TLS_CLIENT_USER_FROM"` // cn, email, uri or dns
+	ReloadInterval time.Duration `yaml:"reload_interval" env:"TLS_RELOAD_INTERVAL"`   // how often the files are checked for changes
+}
+
+type CORSConfig struct {
+	// "*", origins like https://files.example.com, or one wildcard: https://*.example.com
+	AllowedOrigins   []string      `yaml:"allowed_origins" env:"CORS_ALLOWED_ORIGINS"`
+	AllowCredentials bool          `yaml:"allow_credentials" env:"CORS_ALLOW_CREDENTIALS"` // cookies and HTTP auth; needs explicit origins
+	AllowedMethods   []string      `yaml:"allowed_methods" env:"CORS_ALLOWED_METHODS"`     // further limited to what each route accepts
+	AllowedHeaders   []string      `yaml:"allowed_headers" env:"CORS_ALLOWED_HEADERS"`
+	ExposedHeaders   []string      `yaml:"exposed_headers" env:"CORS_EXPOSED_HEADERS"`
+	MaxAge           time.Duration `yaml:"max_age" env:"CORS_MAX_AGE"` // how long browsers cache a preflight
+}
+
+type MinIOConfig struct {
+	Endpoint  string `yaml:"endpoint" env:"MINIO_ENDPOINT"`
+	AccessKey string `yaml:"access_key" env:"MINIO_ACCESS_KEY"`
+	SecretKey string `yaml:"secret_key" env:"MINIO_SECRET_KEY" secret:"true"`
+	Bucket    string `yaml:"bucket" env:"MINIO_BUCKET"`
+	UseSSL    bool   `yaml:"use_ssl" env:"MINIO_USE_SSL"`
+	Region    string `yaml:"region" env:"MINIO_REGION"`
+	// Browser-reachable address used in presigned URLs for direct uploads
+	PublicEndpoint string `yaml:"public_endpoint" env:"MINIO_PUBLIC_ENDPOINT"`
+	PublicUseSSL   bool   `yaml:"public_use_ssl" env:"MINIO_PUBLIC_USE_SSL"`
+}
+
+type StorageConfig struct {
+	Mount                string        `yaml:"mount" env:"STORAGE_MOUNT" reload:"restart"` // where rclone mounts the bucket
+	Bucket               string        `yaml:"bucket" env:"STORAGE_BUCKET"`                // name reported by /api/stats; defaults to minio.bucket
+	RcloneRCAddr         string        `yaml:"rclone_rc_addr" env:"RCLONE_RC_ADDR"`
+	StatsCacheTTL        time.Duration `yaml:"stats_cache_ttl" env:"STATS_CACHE_TTL"`
+	StatsRefreshInterval time.Duration `yaml:"stats_refresh_interval" env:"STATS_REFRESH_INTERVAL" reload:"restart"`
+	// How often the whole bucket is listed to correct drift in the usage index; 0 never
+	ReconcileInterval time.Duration `yaml:"reconcile_interval" env:"USAGE_RECONCILE_INTERVAL" reload:"restart"`
+	// How often a usage sample is recorded for /api/stats/history; 0 turns history off
+	HistoryInterval  time.Duration `yaml:"history_interval" env:"STATS_HISTORY_INTERVAL" reload:"restart"`
+	HistoryRetention time.Duration `yaml:"history_retention" env:"STATS_HISTORY_RETENTION"` // how long daily samples are kept
+	// Extra named volumes: "name=/path" (already mounted) or "name=s3://bucket"
+	Volumes     []string `yaml:"volumes" env:"STORAGE_VOLUMES" reload:"restart"`
+	VolumesRoot string   `yaml:"volumes_root" env:"STORAGE_VOLUMES_ROOT" reload:"restart"` // where bucket volumes are mounted
+}
+
+type UploadsConfig struct {
+	Path              string        `yaml:"path" env:"UPLOAD_PATH"`                      // folder for uploads that don't name one
+	AllowedFileTypes  []string      `yaml:"allowed_file_types" env:"ALLOWED_FILE_TYPES"` // extensions like ".jpg", or "*"
+	MaxUploadSize     int64         `yaml:"max_upload_size" env:"MAX_UPLOAD_SIZE"`       // single-request uploads
+	MaxChunkSize      int64         `yaml:"max_chunk_size" env:"MAX_CHUNK_SIZE"`         // one chunk of a chunked upload
+	MaxJSONBodySize   int64         `yaml:"max_json_body_size" env:"MAX_JSON_BODY_SIZE"` // every other request body
+	UploadReadTimeout time.Duration `yaml:"upload_read_timeout" env:"UPLOAD_READ_TIMEOUT"`
+	ChunkReadTimeout  time.Duration `yaml:"chunk_read_timeout" env:"CHUNK_READ_TIMEOUT"`
+	JSONReadTimeout   time.Duration `yaml:"json_read_timeout" env:"JSON_READ_TIMEOUT"`
+	SessionTTL        time.Duration `yaml:"session_ttl" env:"UPLOAD_SESSION_TTL"` // unfinished direct uploads are aborted after this
+	DirectURLExpiry   time.Duration `yaml:"direct_url_expiry" env:"DIRECT_UPLOAD_URL_EXPIRY"`
+}
+
+type RateLimitConfig struct {
+	Enabled               bool  `yaml:"enabled" env:"RATE_LIMIT_ENABLED"`
+	APIPerMinute          int64 `yaml:"api_per_minute" env:"RATE_LIMIT_API_PER_MINUTE"`
+	APIBurst              int64 `yaml:"api_burst" env:"RATE_LIMIT_API_BURST"`
+	UploadPerMinute       int64 `yaml:"upload_per_minute" env:"RATE_LIMIT_UPLOAD_PER_MINUTE"`
+	UploadBurst           int64 `yaml:"upload_burst" env:"RATE_LIMIT_UPLOAD_BURST"`
+	StatsRefreshPerMinute int64 `yaml:"stats_refresh_per_minute" env:"RATE_LIMIT_STATS_REFRESH_PER_MINUTE"`
+	StatsRefreshBurst     int64 `yaml:"stats_refresh_burst" env:"RATE_LIMIT_STATS_REFRESH_BURST"`
+	MaxConcurrentUploads  int   `yaml:"max_concurrent_uploads" env:"MAX_CONCURRENT_UPLOADS"`
+	MaxUploadSessions     int   `yaml:"max_upload_sessions" env:"MAX_UPLOAD_SESSIONS"`
+}
+
+type LogConfig struct {
+	Level string `yaml:"level" env:"LOG_LEVEL"` // debug, info, warn or error
+}
+
+type TracingConfig struct {
+	Endpoint       string  `yaml:"endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	TracesEndpoint string  `yaml:"traces_endpoint" env:"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"`
+	ServiceName    string  `yaml:"service_name" env:"OTEL_SERVICE_NAME"`
+	SampleRatio    float64 `yaml:"sample_ratio" env:"OTEL_TRACES_SAMPLER_ARG"`
+	Headers        string  `yaml:"headers" env:"OTEL_EXPORTER_OTLP_HEADERS" secret:"true"` // key=value,...
+}
+
+type AuditConfig struct {
+	Sinks        []string `yaml:"sinks" env:"AUDIT_SINKS"` // file, webhook or off
+	LogFile      string   `yaml:"log_file" env:"AUDIT_LOG_FILE"`
+	LogMaxSize   int64    `yaml:"log_max_size" env:"AUDIT_LOG_MAX_SIZE"`
+	LogMaxFiles  int      `yaml:"log_max_files" env:"AUDIT_LOG_MAX_FILES"`
+	WebhookURL   string   `yaml:"webhook_url" env:"AUDIT_WEBHOOK_URL" secret:"true"` // may carry credentials or a token
+	WebhookToken string   `yaml:"webhook_token" env:"AUDIT_WEBHOOK_TOKEN" secret:"true"`
+}
+
+type HealthConfig struct {
+	CheckTimeout time.Duration `yaml:"check_timeout" env:"HEALTH_CHECK_TIMEOUT"`
+	MinTempFree  int64         `yaml:"min_temp_free" env:"HEALTH_MIN_TEMP_FREE"`
+}
+
+type TrashConfig struct {
+	Enabled       bool          `yaml:"enabled" env:"TRASH_ENABLED" reload:"restart"`
+	Retention     time.Duration `yaml:"retention" env:"TRASH_RETENTION"`
+	PurgeInterval time.Duration `yaml:"purge_interval" env:"TRASH_PURGE_INTERVAL" reload:"restart"`
+}
+
+type VersioningConfig struct {
+	Mode          string        `yaml:"mode" env:"VERSIONING_MODE" reload:"restart"` // off, s3 or mount
+	MaxVersions   int           `yaml:"max_versions" env:"VERSIONING_MAX_VERSIONS"`  // 0 keeps any number of versions
+	MaxAge        time.Duration `yaml:"max_age" env:"VERSIONING_MAX_AGE"`            // 0 keeps versions regardless of age
+	PruneInterval time.Duration `yaml:"prune_interval" env:"VERSIONING_PRUNE_INTERVAL" reload:"restart"`
+}
+
+type SharesConfig struct {
+	Secret        string `yaml:"secret" env:"SHARE_SECRET" secret:"true" reload:"restart"` // generated and stored on the mount when empty
+	PublicBaseURL string `yaml:"public_base_url" env:"PUBLIC_BASE_URL"`
+}
+
+type ThumbnailsConfig struct {
+	CacheDir      string `yaml:"cache_dir" env:"THUMBNAIL_CACHE_DIR" reload:"restart"`
+	CacheMaxBytes int64  `yaml:"cache_max_bytes" env:"THUMBNAIL_CACHE_MAX_BYTES" reload:"restart"`
+	MaxPixels     int64  `yaml:"max_pixels" env:"THUMBNAIL_MAX_PIXELS"`
+	Concurrency   int    `yaml:"concurrency" env:"THUMBNAIL_CONCURRENCY" reload:"restart"`
+}
+
+type WebhooksConfig struct {
+	// "<url> [event=<type>]... [path=<pattern>]..." per webhook; see parseWebhook
+	Endpoints   []string      `yaml:"endpoints" env:"WEBHOOKS" secret:"true"`    // URLs may carry credentials or a token
+	Secret      string        `yaml:"secret" env:"WEBHOOK_SECRET" secret:"true"` // signs every request (X-Webhook-Signature)
+	Timeout     time.Duration `yaml:"timeout" env:"WEBHOOK_TIMEOUT"`
+	MaxAttempts int           `yaml:"max_attempts" env:"WEBHOOK_MAX_ATTEMPTS"` // then the delivery is set aside
+}
+
+var (
+	configMu sync.RWMutex
+	// activeConfig is the configuration the server is running with. It is
+	// replaced as a whole on reload and never modified in place.
+	activeConfig = defaultConfig()
+	// configSources records where each setting came from (default, file, env
+	// or flag), keyed like the flags, for /api/admin/config
+	configSources map[string]string
+	// pendingRestart lists restart-only settings whose configured value
+	// differs from the running one
+	pendingRestart []string
+)
+
+// currentConfig returns the running configuration. Callers that read several
+// settings which belong together should keep the returned pointer rather than
+// calling it again, so a reload in between can't mix old and new values.
+func currentConfig() *Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return activeConfig
+}
+
+// setConfig swaps in a new running configuration
+func setConfig(cfg *Config, sources map[string]string, pending []string) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	activeConfig, configSources, pendingRestart = cfg, sources, pending
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:                8080,
+			ReadHeaderTimeout:   10 * time.Second,
+			IdleTimeout:         2 * time.Minute,
+			MaxHeaderBytes:      64 << 10,
+			ShutdownTimeout:     25 * time.Second,
+			ConfigWatchInterval: 10 * time.Second,
+		},
+		TLS: TLSConfig{
+			MinVersion:     "1.2",
+			ClientUserFrom: "cn",
+			ReloadInterval: time.Minute,
+		},
+		CORS: CORSConfig{
+			AllowedOrigins: []string{}, // same-origin only until origins are listed
+			AllowedMethods: []string{"GET", "HEAD", "POST", "DELETE"},
+			AllowedHeaders: []string{"Content-Type", "Authorization", "X-API-Key", "X-Share-Token", "X-Share-Password",
+				"X-Request-ID", "traceparent", "tracestate"},
+			ExposedHeaders: []string{"X-Request-ID", "Retry-After", "X-Cache-Hit", "Content-Range", "Content-Disposition", "ETag"},
+			MaxAge:         time.Hour,
+		},
+		MinIO: MinIOConfig{
+			Endpoint:  "minio:9000",
+			AccessKey: "rclone",
+			SecretKey: "rclone123",
+			Bucket:    "rclone",
+			Region:    "us-east-1",
+		},
+		Storage: StorageConfig{
+			Mount:                "/storage",
+			RcloneRCAddr:         "localhost:5572",
+			StatsCacheTTL:        5 * time.Minute,
+			StatsRefreshInterval: 5 * time.Minute,
+			ReconcileInterval:    6 * time.Hour,
+			HistoryInterval:      5 * time.Minute,
+			HistoryRetention:     2 * 365 * 24 * time.Hour,
+			VolumesRoot:          "/volumes",
+		},
+		Uploads: UploadsConfig{
+			AllowedFileTypes:  []string{"*"},
+			MaxUploadSize:     100 << 20,
+			MaxChunkSize:      128 << 20,
+			MaxJSONBodySize:   2 << 20, // /api/direct/complete with 10,000 parts
+			UploadReadTimeout: 30 * time.Minute,
+			ChunkReadTimeout:  10 * time.Minute,
+			JSONReadTimeout:   30 * time.Second,
+			SessionTTL:        24 * time.Hour,
+			DirectURLExpiry:   24 * time.Hour,
+		},
+		RateLimit: RateLimitConfig{
+			Enabled:               true,
+			APIPerMinute:          1200,
+			APIBurst:              300, // a folder view loading a page of thumbnails at once
+			UploadPerMinute:       600,
+			UploadBurst:           60,
+			StatsRefreshPerMinute: 2,
+			StatsRefreshBurst:     2,
+			MaxConcurrentUploads:  4,
+			MaxUploadSessions:     10,
+		},
+		Log: LogConfig{Level: "info"},
+		Tracing: TracingConfig{
+			ServiceName: "rclone-file-upload-server",
+			SampleRatio: 1,
+		},
+		Audit: AuditConfig{
+			Sinks:       []string{"file"},
+			LogFile:     "/var/log/rclone-file-upload/audit.log",
+			LogMaxSize:  100 << 20,
+			LogMaxFiles: 10,
+		},
+		Health: HealthConfig{
+			CheckTimeout: 2 * time.Second,
+			MinTempFree:  1 << 30,
+		},
+		Trash: TrashConfig{
+			Retention:     30 * 24 * time.Hour,
+			PurgeInterval: time.Hour,
+		},
+		Versioning: VersioningConfig{
+			Mode:          "off",
+			MaxVersions:   10,
+			PruneInterval: time.Hour,
+		},
+		Thumbnails: ThumbnailsConfig{
+			CacheDir:      filepath.Join(os.TempDir(), "rclone-thumbnails"),
+			CacheMaxBytes: defaultThumbnailCacheSize,
+			MaxPixels:     defaultThumbnailMaxPixels,
+			Concurrency:   defaultThumbnailWorkers,
+		},
+		Webhooks: WebhooksConfig{
+			Timeout:     10 * time.Second,
+			MaxAttempts: 12,
+		},
+	}
+}
+
+// configField is one setting: its flag-style key ("server.port"), environment
+// variable and the struct field holding it
+type configField struct {
+	key     string
+	env     string
+	secret  bool
+	restart bool // only takes effect at startup
+	value   reflect.Value
+}
+
+// configFields lists every setting of cfg in declaration order
+func configFields(cfg *Config) []configField {
+	var fields []configField
+	var walk func(v reflect.Value, prefix string, restart bool)
+	walk = func(v reflect.Value, prefix string, restart bool) {
+		for i := 0; i < v.NumField(); i++ {
+			sf := v.Type().Field(i)
+			key := prefix + sf.Tag.Get("yaml")
+			fieldRestart := restart || sf.Tag.Get("reload") == "restart"
+			if sf.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), key+".", fieldRestart)
+				continue
+			}
+			fields = append(fields, configField{
+				key:     key,
+				env:     sf.Tag.Get("env"),
+				secret:  sf.Tag.Get("secret") == "true",
+				restart: fieldRestart,
+				value:   v.Field(i),
+			})
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem(), "", false)
+	return fields
+}
+
+// setConfigValue parses raw into a setting of any of the supported types
+func setConfigValue(field reflect.Value, raw string) error {
+	raw = strings.TrimSpace(raw)
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(raw)
+	case bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		field.SetBool(b)
+	case int, int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		field.SetInt(n)
+	case float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", raw)
+		}
+		field.SetFloat(f)
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q (e.g. 30s, 5m, 720h)", raw)
+		}
+		field.SetInt(int64(d))
+	case []string:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
+
+// configOptions are the command-line options that aren't settings
+type configOptions struct {
+	file      string // -config or CONFIG_FILE
+	printOnly bool   // -print-config
+}
+
+// loadConfig builds the configuration from defaults, the config file, the
+// environment and args, and validates it. If only validation fails, cfg is
+// still returned so callers can report what it would have changed.
+func loadConfig(args []string) (cfg *Config, sources map[string]string, opts configOptions, err error) {
+	cfg = defaultConfig()
+	fields := configFields(cfg)
+	sources = make(map[string]string, len(fields))
+	for _, f := range fields {
+		sources[f.key] = "default"
+	}
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.StringVar(&opts.file, "config", os.Getenv("CONFIG_FILE"), "YAML config file (env CONFIG_FILE)")
+	fs.BoolVar(&opts.printOnly, "print-config", false, "print the effective config with secrets redacted and exit")
+	flagValues := make(map[string]string)
+	for _, f := range fields {
+		key := f.key
+		fs.Func(key, "env "+f.env, func(value string) error {
+			flagValues[key] = value
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, opts, err
+	}
+
+	if opts.file != "" {
+		if err := readConfigFile(opts.file, cfg); err != nil {
+			return nil, nil, opts, err
+		}
+		// Compare against defaults to tell which settings the file provided
+		defaults := configFields(defaultConfig())
+		for i, f := range fields {
+			if !reflect.DeepEqual(f.value.Interface(), defaults[i].value.Interface()) {
+				sources[f.key] = "file"
+			}
+		}
+	}
+
+	var errs []error
+	for _, f := range fields {
+		if raw := os.Getenv(f.env); raw != "" {
+			if err := setConfigValue(f.value, raw); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", f.env, err))
+			}
+			sources[f.key] = "env"
+		}
+	}
+	for _, f := range fields {
+		if raw, ok := flagValues[f.key]; ok {
+			if err := setConfigValue(f.value, raw); err != nil {
+				errs = append(errs, fmt.Errorf("-%s: %w", f.key, err))
+			}
+			sources[f.key] = "flag"
+		}
+	}
+	if len(errs) > 0 {
+		return nil, nil, opts, errors.Join(errs...)
+	}
+
+	cfg.normalize()
+	return cfg, sources, opts, cfg.Validate()
+}
+
+// readConfigFile decodes a YAML file over cfg; unknown keys are errors so
+// typos don't go unnoticed
+func readConfigFile(path string, cfg *Config) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && err != io.EOF {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// normalize fills in settings that default to other settings
+func (c *Config) normalize() {
+	if c.Storage.Bucket == "" {
+		c.Storage.Bucket = c.MinIO.Bucket
+	}
+	if c.TLS.ClientAuth == "" {
+		c.TLS.ClientAuth = "off"
+		if c.TLS.ClientCAFile != "" {
+			c.TLS.ClientAuth = "require"
+		}
+	}
+	for i, origin := range c.CORS.AllowedOrigins {
+		c.CORS.AllowedOrigins[i] = strings.TrimSuffix(strings.ToLower(origin), "/")
+	}
+	for i, method := range c.CORS.AllowedMethods {
+		c.CORS.AllowedMethods[i] = strings.ToUpper(method)
+	}
+	c.Storage.Mount = filepath.Clean(c.Storage.Mount)
+	c.Storage.VolumesRoot = filepath.Clean(c.Storage.VolumesRoot)
+	c.Uploads.Path = strings.Trim(filepath.ToSlash(filepath.Clean("/"+c.Uploads.Path)), "/")
+	for i, ext := range c.Uploads.AllowedFileTypes {
+		c.Uploads.AllowedFileTypes[i] = strings.ToLower(ext)
+	}
+	c.Log.Level = strings.ToLower(c.Log.Level)
+}
+
+// Validate reports every invalid setting at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	for _, f := range configFields(c) {
+		if d, ok := f.value.Interface().(time.Duration); ok {
+			check(d >= 0, "%s must not be negative", f.key)
+		}
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port < 65536, "server.port must be between 1 and 65535")
+	check(c.Server.MaxHeaderBytes >= 4<<10, "server.max_header_bytes must be at least 4096")
+	for _, proxy := range c.Server.TrustedProxies {
+		_, _, err := parseProxyCIDR(proxy)
+		check(err == nil, "server.trusted_proxies: %q is not a CIDR or IP address", proxy)
+	}
+
+	t := c.TLS
+	check((t.CertFile == "") == (t.KeyFile == ""), "tls.cert_file and tls.key_file must be set together")
+	check(t.MinVersion == "1.2" || t.MinVersion == "1.3", "tls.min_version must be 1.2 or 1.3")
+	switch t.ClientAuth {
+	case "off":
+	case "optional", "require":
+		check(t.ClientCAFile != "", "tls.client_auth=%s needs tls.client_ca_file", t.ClientAuth)
+	default:
+		check(false, "tls.client_auth must be off, optional or require")
+	}
+	check(t.ClientCAFile == "" || t.CertFile != "", "tls.client_ca_file needs tls.cert_file and tls.key_file")
+	switch t.ClientUserFrom {
+	case "cn", "email", "uri", "dns":
+	default:
+		check(false, "tls.client_user_from must be cn, email, uri or dns")
+	}
+
+	for _, origin := range c.CORS.AllowedOrigins {
+		check(origin == "*" || strings.Contains(origin, "://") && strings.Count(origin, "/") == 2 && strings.Count(origin, "*") <= 1,
+			"cors.allowed_origins: %q must be \"*\" or an origin like https://app.example.com, with at most one *", origin)
+	}
+	check(!c.CORS.AllowCredentials || !slices.Contains(c.CORS.AllowedOrigins, "*"),
+		"cors.allow_credentials needs explicit cors.allowed_origins instead of \"*\"")
+	for _, method := range c.CORS.AllowedMethods {
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete:
+		default:
+			check(false, "cors.allowed_methods: unsupported method %q", method)
+		}
+	}
+
+	check(c.MinIO.Endpoint != "", "minio.endpoint is required")
+	check(!strings.Contains(c.MinIO.Endpoint, "://"), "minio.endpoint must be host:port without a scheme")
+	check(c.MinIO.AccessKey != "" && c.MinIO.SecretKey != "", "minio.access_key and minio.secret_key are required")
+	check(c.MinIO.Bucket != "", "minio.bucket is required")
+	if strings.Contains(c.MinIO.PublicEndpoint, "://") {
+		u, err := url.Parse(c.MinIO.PublicEndpoint)
+		check(err == nil && u.Host != "", "minio.public_endpoint is not a valid URL")
+	}
+
+	check(filepath.IsAbs(c.Storage.Mount) && c.Storage.Mount != "/", "storage.mount must be an absolute path other than /")
+	check(c.Storage.StatsCacheTTL > 0, "storage.stats_cache_ttl must be positive")
+	check(c.Storage.StatsRefreshInterval > 0, "storage.stats_refresh_interval must be positive")
+	check(c.Storage.HistoryInterval <= time.Hour, "storage.history_interval must be at most 1h")
+	check(c.Storage.HistoryRetention >= 24*time.Hour, "storage.history_retention must be at least 24h")
+	check(loopbackAddr(c.Storage.RcloneRCAddr), "storage.rclone_rc_addr must be a loopback address such as localhost:5572")
+	check(filepath.IsAbs(c.Storage.VolumesRoot), "storage.volumes_root must be an absolute path")
+	seen := make(map[string]bool)
+	for _, spec := range c.Storage.Volumes {
+		v, err := parseVolume(spec, c.Storage.VolumesRoot)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		check(!seen[v.Name], "storage.volumes: volume %s is listed twice", v.Name)
+		seen[v.Name] = true
+		overlaps := v.Mount == c.Storage.Mount || strings.HasPrefix(v.Mount, c.Storage.Mount+"/") ||
+			strings.HasPrefix(c.Storage.Mount, v.Mount+"/")
+		check(!overlaps, "storage.volumes: volume %s overlaps storage.mount", v.Name)
+	}
+
+	first, _, _ := strings.Cut(c.Uploads.Path, "/")
+	check(!isHiddenRootEntry(first), "uploads.path must not be an internal directory")
+	check(len(c.Uploads.AllowedFileTypes) > 0, "uploads.allowed_file_types must not be empty (use \"*\" to allow everything)")
+	for _, ext := range c.Uploads.AllowedFileTypes {
+		check(ext == "*" || strings.HasPrefix(ext, "."), "uploads.allowed_file_types: %q must be \"*\" or an extension like \".jpg\"", ext)
+	}
+	check(c.Uploads.MaxUploadSize > 0, "uploads.max_upload_size must be positive")
+	check(c.Uploads.MaxChunkSize > 0, "uploads.max_chunk_size must be positive")
+	check(c.Uploads.MaxJSONBodySize > 0, "uploads.max_json_body_size must be positive")
+	check(c.Uploads.SessionTTL > 0, "uploads.session_ttl must be positive")
+	check(c.Uploads.DirectURLExpiry >= time.Second && c.Uploads.DirectURLExpiry <= 7*24*time.Hour,
+		"uploads.direct_url_expiry must be between 1s and 168h (the S3 presign limit)")
+
+	r := c.RateLimit
+	check(r.APIPerMinute > 0 && r.UploadPerMinute > 0 && r.StatsRefreshPerMinute > 0, "rate_limit.*_per_minute must be positive")
+	check(r.APIBurst >= 1 && r.UploadBurst >= 1 && r.StatsRefreshBurst >= 1, "rate_limit.*_burst must be at least 1")
+	check(r.MaxConcurrentUploads >= 1, "rate_limit.max_concurrent_uploads must be at least 1")
+	check(r.MaxUploadSessions >= 1, "rate_limit.max_upload_sessions must be at least 1")
+
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.Log.Level)) == nil, "log.level must be debug, info, warn or error")
+
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
+	for _, pair := range strings.Split(c.Tracing.Headers, ",") {
+		_, _, ok := strings.Cut(pair, "=")
+		check(strings.TrimSpace(pair) == "" || ok, "tracing.headers must be key=value pairs separated by commas")
+	}
+
+	for _, sink := range c.Audit.Sinks {
+		switch sink {
+		case "off":
+		case "file":
+			check(c.Audit.LogFile != "", "audit.log_file is required for the file sink")
+		case "webhook":
+			check(c.Audit.WebhookURL != "", "audit.webhook_url is required for the webhook sink")
+		default:
+			check(false, "audit.sinks: unknown sink %q (expected file, webhook or off)", sink)
+		}
+	}
+	check(c.Audit.LogMaxSize > 0, "audit.log_max_size must be positive")
+	check(c.Audit.LogMaxFiles >= 1, "audit.log_max_files must be at least 1")
+
+	check(c.Health.CheckTimeout > 0, "health.check_timeout must be positive")
+	check(c.Health.MinTempFree >= 0, "health.min_temp_free must not be negative")
+
+	check(c.Trash.Retention > 0, "trash.retention must be positive")
+	check(c.Trash.PurgeInterval > 0, "trash.purge_interval must be positive")
+
+	switch c.Versioning.Mode {
+	case "", "off", "s3", "mount":
+	default:
+		check(false, "versioning.mode must be off, s3 or mount")
+	}
+	check(c.Versioning.MaxVersions >= 0, "versioning.max_versions must not be negative")
+	check(c.Versioning.PruneInterval > 0, "versioning.prune_interval must be positive")
+
+	check(c.Thumbnails.CacheDir != "", "thumbnails.cache_dir is required")
+	check(c.Thumbnails.CacheMaxBytes > 0, "thumbnails.cache_max_bytes must be positive")
+	check(c.Thumbnails.MaxPixels > 0, "thumbnails.max_pixels must be positive")
+	check(c.Thumbnails.Concurrency >= 1, "thumbnails.concurrency must be at least 1")
+
+	for _, spec := range c.Webhooks.Endpoints {
+		if _, err := parseWebhook(spec); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	check(len(c.Webhooks.Endpoints) == 0 || c.Webhooks.Secret != "", "webhooks.secret is required when webhooks.endpoints is set")
+	check(c.Webhooks.Timeout > 0, "webhooks.timeout must be positive")
+	check(c.Webhooks.MaxAttempts >= 1, "webhooks.max_attempts must be at least 1")
+
+	return errors.Join(errs...)
+}
+
+// loopbackAddr reports whether a host:port only listens on this machine;
+// rclone's remote control has no authentication, so it must never be reachable
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// redactedValue is shown in place of a secret that is set
+const redactedValue = "[redacted]"
+
+// Redacted returns a copy of the config with secrets replaced
+func (c *Config) Redacted() *Config {
+	copied := *c
+	for _, f := range configFields(&copied) {
+		if f.secret {
+			redactSecret(f.value)
+		}
+	}
+	return &copied
+}
+
+// redactSecret replaces a secret string that is set, or every entry of a
+// secret list. Lists are replaced rather than edited in place, since the copy
+// shares them with the original.
+func redactSecret(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		if v.String() != "" {
+			v.SetString(redactedValue)
+		}
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return
+		}
+		redacted := make([]string, v.Len())
+		for i := range redacted {
+			redacted[i] = redactedValue
+		}
+		v.Set(reflect.ValueOf(redacted))
+	}
+}
+
+// Map returns the redacted config as nested maps keyed like the YAML file,
+// with durations written the same way they are configured (e.g. "5m0s")
+func (c *Config) Map() map[string]any {
+	out := make(map[string]any)
+	for _, f := range configFields(c.Redacted()) {
+		section, name, _ := strings.Cut(f.key, ".")
+		if out[section] == nil {
+			out[section] = make(map[string]any)
+		}
+		value := f.value.Interface()
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		out[section].(map[string]any)[name] = value
+	}
+	return out
+}
+
+// printConfig writes the redacted config as YAML, usable as a config file
+func printConfig(w io.Writer, cfg *Config) error {
+	data, err := yaml.Marshal(cfg.Map())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// adminConfigHandler serves GET /api/admin/config: the running config with
+// secrets redacted, where each setting came from, and the restart-only
+// settings that were changed since startup. Admins only.
+func adminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdmin(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	configMu.RLock()
+	cfg, sources, pending := activeConfig, configSources, pendingRestart
+	configMu.RUnlock()
+	if pending == nil {
+		pending = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]any{
+		"config":          cfg.Map(),
+		"sources":         sources,
+		"pending_restart": pending,
+	})
+}
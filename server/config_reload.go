@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reloadMu serializes reloads triggered by SIGHUP and the file watcher
+var reloadMu sync.Mutex
+
+// watchConfig reloads the configuration on SIGHUP and whenever the content of
+// the config file changes, checked every server.config_watch_interval. Content
+// is compared rather than mtime so Kubernetes ConfigMap updates, which swap a
+// symlink, are picked up too. It returns when ctx is cancelled.
+func watchConfig(ctx context.Context, args []string, file string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval := currentConfig().Server.ConfigWatchInterval; file != "" && interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	lastSum := fileChecksum(file)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			lastSum = fileChecksum(file)
+			reloadConfig(args, "sighup")
+		case <-tick:
+			// An unreadable file is usually mid-update; try again next tick
+			sum := fileChecksum(file)
+			if sum == "" || sum == lastSum {
+				continue
+			}
+			lastSum = sum
+			reloadConfig(args, "file")
+		}
+	}
+}
+
+// fileChecksum hashes the file's content, or returns "" if it can't be read
+func fileChecksum(path string) string {
+	if path == "" {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		slog.Debug("failed to read config file", "file", path, "error", err)
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// reloadConfig loads the configuration again and swaps in the settings that
+// can change live. An invalid config is rejected as a whole and the running
+// one kept. Changed restart-only settings keep their running values and are
+// reported until the next restart picks them up.
+func reloadConfig(args []string, trigger string) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	configMu.RLock()
+	running, runningSources := activeConfig, configSources
+	configMu.RUnlock()
+
+	next, sources, _, err := loadConfig(args)
+	if err != nil {
+		var changes []string
+		if next != nil {
+			for _, change := range diffConfig(running, next) {
+				changes = append(changes, change.String())
+			}
+		}
+		slog.Error("config reload rejected, keeping the running config", "trigger", trigger,
+			"error", err.Error(), "changes", changes)
+		metrics.ConfigReloaded("rejected")
+		return
+	}
+
+	var applied, pending []string
+	pendingKeys := []string{}
+	for _, change := range diffConfig(running, next) {
+		if change.restart {
+			pending = append(pending, change.String())
+			pendingKeys = append(pendingKeys, change.key)
+		} else {
+			applied = append(applied, change.String())
+		}
+	}
+	keepRestartSettings(next, sources, running, runningSources)
+
+	setConfig(next, sources, pendingKeys)
+	applyConfig(next)
+
+	if len(applied) > 0 {
+		slog.Info("config reloaded", "trigger", trigger, "changes", applied)
+		metrics.ConfigReloaded("applied")
+	} else {
+		slog.Info("config unchanged", "trigger", trigger)
+		metrics.ConfigReloaded("unchanged")
+	}
+	if len(pending) > 0 {
+		slog.Warn("config changes need a restart to take effect", "changes", pending)
+	}
+}
+
+// applyConfig updates the components that keep their own copy of a setting;
+// everything else reads currentConfig when it needs a value
+func applyConfig(cfg *Config) {
+	setLogLevel(cfg.Log.Level)
+	initRateLimits()
+}
+
+// keepRestartSettings copies the restart-only settings, and where they came
+// from, from the running config into next
+func keepRestartSettings(next *Config, sources map[string]string, running *Config, runningSources map[string]string) {
+	runningFields := configFields(running)
+	for i, f := range configFields(next) {
+		if f.restart {
+			f.value.Set(runningFields[i].value)
+			sources[f.key] = runningSources[f.key]
+		}
+	}
+}
+
+// configChange is one setting that differs between two configs
+type configChange struct {
+	key      string
+	from, to string // secrets are redacted
+	restart  bool
+}
+
+func (c configChange) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.key, c.from, c.to)
+}
+
+// diffConfig lists the settings that differ from one config to the other
+func diffConfig(from, to *Config) []configChange {
+	var changes []configChange
+	toFields := configFields(to)
+	for i, f := range configFields(from) {
+		before, after := f.value.Interface(), toFields[i].value.Interface()
+		if sameSetting(before, after) {
+			continue
+		}
+		changes = append(changes, configChange{
+			key:     f.key,
+			from:    formatSetting(before, f.secret),
+			to:      formatSetting(after, f.secret),
+			restart: f.restart,
+		})
+	}
+	return changes
+}
+
+// sameSetting compares two values of a setting; an empty list equals no list
+func sameSetting(a, b any) bool {
+	if list, ok := a.([]string); ok {
+		return slices.Equal(list, b.([]string))
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// formatSetting renders a value the way it would be configured
+func formatSetting(value any, secret bool) string {
+	switch v := value.(type) {
+	case string:
+		if secret && v != "" {
+			return redactedValue
+		}
+		return strconv.Quote(v)
+	case time.Duration:
+		return v.String()
+	case []string:
+		if secret && len(v) > 0 {
+			return redactedValue
+		}
+		return "[" + strings.Join(v, ",") + "]"
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// corsMiddleware applies the CORS policy in cors.*; by default no origin is
+// allowed. An allowed origin is echoed back (or "*" when every origin is
+// allowed without credentials).
+// Other origins get no CORS headers, and their preflights and state-changing
+// requests are refused with 403, so other sites can't drive the API from a
+// user's browser. Requests without an Origin or from the API's own origin are
+// not cross-origin and pass through.
+func corsMiddleware(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	routeMethods := corsMethods(pattern)
+	return func(w http.ResponseWriter, r *http.Request) {
+		policy := currentConfig().CORS
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		// The answer depends on these request headers, so caches must key on them
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if preflight {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		var methods []string
+		for _, method := range routeMethods {
+			if slices.Contains(policy.AllowedMethods, method) {
+				methods = append(methods, method)
+			}
+		}
+
+		switch {
+		case origin == "" || sameOrigin(origin, r):
+		case originAllowed(policy.AllowedOrigins, origin):
+			if !preflight && r.Method != http.MethodOptions && !slices.Contains(methods, r.Method) {
+				http.Error(w, "Method not allowed for cross-origin requests", http.StatusForbidden)
+				return
+			}
+			if policy.AllowCredentials || !slices.Contains(policy.AllowedOrigins, "*") {
+				h.Set("Access-Control-Allow-Origin", origin)
+			} else {
+				h.Set("Access-Control-Allow-Origin", "*")
+			}
+			if policy.AllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+			if len(policy.ExposedHeaders) > 0 {
+				h.Set("Access-Control-Expose-Headers", strings.Join(policy.ExposedHeaders, ", "))
+			}
+			if preflight {
+				h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+				h.Set("Access-Control-Allow-Headers", strings.Join(policy.AllowedHeaders, ", "))
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(policy.MaxAge.Seconds())))
+			}
+		case preflight || !safeMethod(r.Method):
+			logFor(r.Context()).Debug("cross-origin request refused", "origin", origin)
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// corsMethods lists the methods a route's handler accepts
+func corsMethods(pattern string) []string {
+	switch pattern {
+	case "/api/health", "/api/health/live", "/api/health/ready":
+		return []string{http.MethodGet, http.MethodHead}
+	case "/api/upload", "/api/trash/restore", "/api/copy", "/api/move":
+		return []string{http.MethodPost}
+	case "/api/delete/":
+		return []string{http.MethodDelete}
+	case "/api/trash", "/api/admin/uploads":
+		return []string{http.MethodGet, http.MethodDelete}
+	case "/api/versions/", "/api/share":
+		return []string{http.MethodGet, http.MethodPost, http.MethodDelete}
+	case "/api/s/":
+		return []string{http.MethodGet, http.MethodPost}
+	}
+	if strings.HasPrefix(pattern, "/api/multipart/") || strings.HasPrefix(pattern, "/api/direct/") {
+		return []string{http.MethodPost}
+	}
+	return []string{http.MethodGet}
+}
+
+// originAllowed matches origin against the allow-list. Entries are "*", an
+// exact origin like "https://files.example.com", or an origin with a single
+// wildcard such as "https://*.example.com" or "http://localhost:*".
+func originAllowed(allowed []string, origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, pattern := range allowed {
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+		prefix, suffix, ok := strings.Cut(pattern, "*")
+		if !ok || len(origin) <= len(prefix)+len(suffix) {
+			continue
+		}
+		if strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) &&
+			!strings.ContainsAny(origin[len(prefix):len(origin)-len(suffix)], "/@") {
+			return true
+		}
+	}
+	return false
+}
+
+// sameOrigin reports whether origin is the scheme and host the request was
+// sent to; a page on http://host is a different origin from https://host
+func sameOrigin(origin string, r *http.Request) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	scheme := requestScheme(r)
+	return strings.EqualFold(u.Scheme, scheme) && strings.EqualFold(originHost(scheme, u.Host), originHost(scheme, r.Host))
+}
+
+// originHost drops the scheme's default port, which browsers leave out of Origin
+func originHost(scheme, host string) string {
+	if scheme == "https" {
+		return strings.TrimSuffix(host, ":443")
+	}
+	return strings.TrimSuffix(host, ":80")
+}
+
+// safeMethod reports whether a method only reads. The browser withholds the
+// response from a page of a disallowed origin, so these are let through.
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
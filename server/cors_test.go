@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// serveCORS sends r through the CORS middleware of a POST route and reports
+// the status and whether the handler ran
+func serveCORS(r *http.Request) (*httptest.ResponseRecorder, bool) {
+	called := false
+	rec := httptest.NewRecorder()
+	corsMiddleware("/api/upload", func(w http.ResponseWriter, r *http.Request) { called = true })(rec, r)
+	return rec, called
+}
+
+func TestCORSDefaultAllowsSameOriginOnly(t *testing.T) {
+	setTrustedProxies(t) // defaults, with no proxies
+	if origins := currentConfig().CORS.AllowedOrigins; len(origins) != 0 {
+		t.Fatalf("default cors.allowed_origins = %q, want none", origins)
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		origin string
+		tls    bool
+		want   bool
+	}{
+		{"no origin", "http://files.example.com/api/upload", "", false, true},
+		{"same origin", "http://files.example.com/api/upload", "http://files.example.com", false, true},
+		{"same origin, case", "http://files.example.com/api/upload", "http://Files.Example.com", false, true},
+		{"same origin over TLS", "https://files.example.com/api/upload", "https://files.example.com", true, true},
+		{"default port", "https://files.example.com:443/api/upload", "https://files.example.com", true, true},
+		{"other site", "http://files.example.com/api/upload", "http://evil.example.net", false, false},
+		{"other port", "http://files.example.com/api/upload", "http://files.example.com:8443", false, false},
+		{"http page, https API", "https://files.example.com/api/upload", "http://files.example.com", true, false},
+		{"https page, http API", "http://files.example.com/api/upload", "https://files.example.com", false, false},
+		{"null origin", "http://files.example.com/api/upload", "null", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.target, nil)
+			if !tt.tls {
+				r.TLS = nil
+			} else if r.TLS == nil {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			rec, called := serveCORS(r)
+			if called != tt.want {
+				t.Fatalf("handler called = %v, want %v (status %d)", called, tt.want, rec.Code)
+			}
+			if !tt.want && rec.Code != http.StatusForbidden {
+				t.Errorf("status %d, want 403", rec.Code)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+				t.Errorf("Access-Control-Allow-Origin = %q with no origins configured", got)
+			}
+		})
+	}
+}
+
+func TestCORSSchemeFromTrustedProxy(t *testing.T) {
+	setTrustedProxies(t, "10.0.0.0/8")
+
+	tests := []struct {
+		name  string
+		peer  string
+		proto string
+		want  bool
+	}{
+		{"proxy terminated TLS", "10.0.0.5:443", "https", true},
+		{"chain of proxies", "10.0.0.5:443", "https, http", true},
+		{"proxy forwarded plain HTTP", "10.0.0.5:443", "http", false},
+		{"no header from proxy", "10.0.0.5:443", "", false},
+		{"spoofed by the client", "203.0.113.7:5555", "https", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "http://files.example.com/api/upload", nil)
+			r.RemoteAddr = tt.peer
+			r.Header.Set("Origin", "https://files.example.com")
+			if tt.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			if _, called := serveCORS(r); called != tt.want {
+				t.Errorf("https page allowed = %v, want %v", called, tt.want)
+			}
+		})
+	}
+}
+
+func TestCORSAllowedOrigin(t *testing.T) {
+	previous := currentConfig()
+	t.Cleanup(func() { setConfig(previous, nil, nil) })
+	cfg := defaultConfig()
+	cfg.CORS.AllowedOrigins = []string{"https://*.example.com"}
+	setConfig(cfg, nil, nil)
+
+	r := httptest.NewRequest(http.MethodOptions, "http://api.internal/api/upload", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	rec, called := serveCORS(r)
+	if called || rec.Code != http.StatusNoContent {
+		t.Fatalf("preflight: status %d, handler called %v", rec.Code, called)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("Access-Control-Allow-Origin = %q", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Methods"); got != http.MethodPost {
+		t.Errorf("Access-Control-Allow-Methods = %q, want only the route's POST", got)
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3 multipart limits for direct uploads
+const (
+	defaultDirectPartSize = 64 << 20
+	minDirectPartSize     = 5 << 20
+	maxDirectPartSize     = 5 << 30
+	maxDirectParts        = 10000
+)
+
+// presignClient signs URLs that browsers use to reach MinIO, which may be a
+// different address than the one the server uses (MINIO_PUBLIC_ENDPOINT)
+var presignClient *minio.Client
+
+// DirectUploadRequest starts a direct-to-storage multipart upload
+type DirectUploadRequest struct {
+	FileName       string `json:"filename"`
+	Path           string `json:"path,omitempty"`
+	FileSize       int64  `json:"file_size"`
+	PartSize       int64  `json:"part_size,omitempty"`
+	ContentType    string `json:"content_type,omitempty"`
+	ConflictAction string `json:"conflictAction,omitempty"`
+}
+
+// PresignedPart is a URL the client PUTs one part to
+type PresignedPart struct {
+	PartNumber int    `json:"part_number"`
+	URL        string `json:"url"`
+}
+
+// DirectUploadResponse tells the client where to send each part
+type DirectUploadResponse struct {
+	Success    bool            `json:"success"`
+	SessionID  string          `json:"session_id"`
+	UploadID   string          `json:"upload_id"`
+	Path       string          `json:"path"`
+	PartSize   int64           `json:"part_size"`
+	TotalParts int             `json:"total_parts"`
+	Parts      []PresignedPart `json:"parts"`
+	ExpiresAt  time.Time       `json:"expires_at"`
+	RenamedTo  string          `json:"renamed_to,omitempty"`
+}
+
+// CompletedPart is a part the client uploaded, with the ETag MinIO returned for it
+type CompletedPart struct {
+	PartNumber int    `json:"part_number"`
+	ETag       string `json:"etag"`
+}
+
+// DirectCompleteRequest finishes a direct upload
+type DirectCompleteRequest struct {
+	SessionID string          `json:"session_id"`
+	Parts     []CompletedPart `json:"parts"`
+}
+
+// initPresignClient sets up the client used for presigning. Presigning is
+// offline, but a region must be set so the client never looks up the bucket
+// location through an endpoint the server may not be able to reach.
+func initPresignClient(endpoint, accessKeyID, secretAccessKey string, useSSL bool) error {
+	settings := currentConfig().MinIO
+	if public := settings.PublicEndpoint; public != "" {
+		endpoint = public
+		useSSL = settings.PublicUseSSL
+		if strings.Contains(public, "://") {
+			u, err := url.Parse(public)
+			if err != nil {
+				return fmt.Errorf("invalid minio.public_endpoint: %w", err)
+			}
+			endpoint = u.Host
+			useSSL = u.Scheme == "https"
+		}
+	}
+
+	region := settings.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	var err error
+	presignClient, err = minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKeyID, secretAccessKey, ""),
+		Secure: useSSL,
+		Region: region,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create presign client: %w", err)
+	}
+	return nil
+}
+
+// directObjectKey validates the requested destination and returns its object key
+func directObjectKey(uploadPath, fileName string) (string, error) {
+	fileName = path.Base(strings.ReplaceAll(fileName, "\\", "/"))
+	if fileName == "" || fileName == "." || fileName == "/" || fileName == ".." {
+		return "", fmt.Errorf("invalid filename %q", fileName)
+	}
+
+	fullPath, err := resolveStoragePath(path.Join("/", uploadPath, fileName))
+	if err != nil {
+		return "", err
+	}
+	if fullPath == STORAGE_MOUNT || isInternalPath(fullPath) {
+		return "", fmt.Errorf("path %s is not writable", uploadPath)
+	}
+	return strings.TrimPrefix(storageRelativePath(fullPath), "/"), nil
+}
+
+// directPartSize picks a part size that keeps the upload within S3's part count limit
+func directPartSize(fileSize, requested int64) int64 {
+	partSize := requested
+	if partSize <= 0 {
+		partSize = defaultDirectPartSize
+	}
+	if partSize < minDirectPartSize {
+		partSize = minDirectPartSize
+	}
+	for (fileSize+partSize-1)/partSize > maxDirectParts && partSize < maxDirectPartSize {
+		partSize *= 2
+	}
+	if partSize > maxDirectPartSize {
+		partSize = maxDirectPartSize
+	}
+	return partSize
+}
+
+// initiateDirectUploadHandler starts an S3 multipart upload and returns a presigned URL per part.
+// The client PUTs each part straight to MinIO and then calls /api/direct/complete with the ETags.
+func initiateDirectUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req DirectUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid request body")
+		return
+	}
+	if req.FileSize <= 0 {
+		http.Error(w, "file_size is required", http.StatusBadRequest)
+		return
+	}
+	if !allowedFileType(req.FileName) {
+		writeFileTypeNotAllowed(w)
+		return
+	}
+	if tooManyUploadSessions(w, r) {
+		return
+	}
+
+	partSize := directPartSize(req.FileSize, req.PartSize)
+	totalParts := int((req.FileSize + partSize - 1) / partSize)
+	if totalParts > maxDirectParts {
+		http.Error(w, "File too large for a direct upload", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	objectKey, err := directObjectKey(uploadDir(req.Path), req.FileName)
+	if err != nil {
+		logFor(r.Context()).Warn("rejected upload path", "error", err)
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	// Existing files are archived on completion when replacing; otherwise pick a free name now
+	response := DirectUploadResponse{Success: true, PartSize: partSize, TotalParts: totalParts}
+	if req.ConflictAction != "replace" && checkFileExists(objectKey) {
+		objectKey = generateUniqueFilename(objectKey)
+		response.RenamedTo = path.Base(objectKey)
+	}
+
+	contentType := req.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	ctx := r.Context()
+	uploadID, err := coreClient.NewMultipartUpload(ctx, bucketName, objectKey, minio.PutObjectOptions{
+		ContentType: contentType,
+	})
+	if err != nil {
+		logFor(r.Context()).Error("failed to initiate direct upload", "object", objectKey, "error", err)
+		metrics.BackendError("s3_create_multipart")
+		http.Error(w, "Failed to initiate upload", http.StatusInternalServerError)
+		return
+	}
+
+	// Presigned part URLs stay valid for uploads.direct_url_expiry
+	expiry := currentConfig().Uploads.DirectURLExpiry
+	response.Parts = make([]PresignedPart, 0, totalParts)
+	for partNumber := 1; partNumber <= totalParts; partNumber++ {
+		params := url.Values{}
+		params.Set("partNumber", strconv.Itoa(partNumber))
+		params.Set("uploadId", uploadID)
+		partURL, err := presignClient.Presign(ctx, http.MethodPut, bucketName, objectKey, expiry, params)
+		if err != nil {
+			logFor(r.Context()).Error("failed to presign part", "object", objectKey, "part", partNumber, "error", err)
+			coreClient.AbortMultipartUpload(context.Background(), bucketName, objectKey, uploadID)
+			http.Error(w, "Failed to generate upload URLs", http.StatusInternalServerError)
+			return
+		}
+		response.Parts = append(response.Parts, PresignedPart{PartNumber: partNumber, URL: partURL.String()})
+	}
+
+	sessionID := uuid.New().String()
+	session := &ChunkUploadSession{
+		UploadID:       uploadID,
+		FileName:       objectKey,
+		TotalParts:     totalParts,
+		UploadedParts:  make(map[int]minio.CompletePart),
+		StartTime:      time.Now(),
+		FileSize:       req.FileSize,
+		PartSize:       partSize,
+		ConflictAction: req.ConflictAction,
+		Owner:          clientKey(r),
+	}
+
+	sessionsMu.Lock()
+	uploadSessions[sessionID] = session
+	sessionsMu.Unlock()
+
+	logFor(r.Context()).Info("direct upload initiated", "session_id", sessionID, "object", objectKey,
+		"parts", totalParts, "part_size", partSize, "size", req.FileSize)
+
+	response.SessionID = sessionID
+	response.UploadID = uploadID
+	response.Path = "/" + objectKey
+	response.ExpiresAt = session.StartTime.Add(expiry)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// completeDirectUploadHandler checks the client's ETags against what MinIO
+// actually received before assembling the object
+func completeDirectUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req DirectCompleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid request body")
+		return
+	}
+
+	sessionsMu.RLock()
+	session, exists := uploadSessions[req.SessionID]
+	sessionsMu.RUnlock()
+	if !exists || session.PartSize == 0 {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	event := audit(r, "upload", "/"+session.FileName)
+	event.Size = session.FileSize
+
+	ctx := r.Context()
+	parts, err := validateDirectParts(ctx, session, req.Parts)
+	if err != nil {
+		logFor(r.Context()).Warn("rejected direct upload completion", "session_id", req.SessionID, "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	replaced := session.ConflictAction == "replace" && checkFileExists(session.FileName)
+	unarchive := func() {}
+	if replaced {
+		if unarchive, err = ArchiveCurrentVersion(STORAGE_MOUNT + "/" + session.FileName); err != nil {
+			logFor(r.Context()).Error("failed to archive previous version", "object", session.FileName, "error", err)
+			notifyUploadFailed(defaultVolume(), STORAGE_MOUNT+"/"+session.FileName, requestUser(r), "failed to preserve previous version")
+			http.Error(w, "Failed to archive previous version", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if _, err := coreClient.CompleteMultipartUpload(ctx, bucketName, session.FileName,
+		session.UploadID, parts, minio.PutObjectOptions{}); err != nil {
+		logFor(r.Context()).Error("failed to complete direct upload", "session_id", req.SessionID, "error", err)
+		metrics.BackendError("s3_complete_multipart")
+		unarchive()
+		notifyUploadFailed(defaultVolume(), STORAGE_MOUNT+"/"+session.FileName, requestUser(r), "failed to complete upload")
+		http.Error(w, "Failed to complete upload", http.StatusInternalServerError)
+		return
+	}
+
+	sessionsMu.Lock()
+	delete(uploadSessions, req.SessionID)
+	sessionsMu.Unlock()
+
+	metrics.AddBytesUploaded(session.FileSize)
+
+	relativePath := "/" + session.FileName
+	refreshMountDir(path.Dir(relativePath))
+	trackFile(STORAGE_MOUNT+relativePath, session.FileSize, requestUser(r))
+	InvalidateThumbnails(relativePath)
+
+	eventType := eventFileCreated
+	if replaced {
+		eventType = eventFileReplaced
+	}
+	notify(WebhookEvent{Type: eventType, Path: relativePath, Size: session.FileSize, User: requestUser(r)})
+
+	duration := time.Since(session.StartTime)
+	logFor(r.Context()).Info("direct upload completed", "session_id", req.SessionID,
+		"object", session.FileName, "size", session.FileSize, "duration_ms", duration.Milliseconds())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UploadResponse{
+		Success: true,
+		Path:    relativePath,
+		Message: fmt.Sprintf("Upload completed in %v", duration.Round(time.Second)),
+	})
+}
+
+// validateDirectParts requires every part to be reported exactly once, with the
+// ETag and size MinIO has on record for it
+func validateDirectParts(ctx context.Context, session *ChunkUploadSession, reported []CompletedPart) ([]minio.CompletePart, error) {
+	if len(reported) != session.TotalParts {
+		return nil, fmt.Errorf("expected %d parts, got %d", session.TotalParts, len(reported))
+	}
+
+	stored := make(map[int]minio.ObjectPart, session.TotalParts)
+	marker := 0
+	for {
+		result, err := coreClient.ListObjectParts(ctx, bucketName, session.FileName, session.UploadID, marker, 1000)
+		if err != nil {
+			metrics.BackendError("s3_list_parts")
+			return nil, fmt.Errorf("failed to list uploaded parts: %w", err)
+		}
+		for _, part := range result.ObjectParts {
+			stored[part.PartNumber] = part
+		}
+		if !result.IsTruncated {
+			break
+		}
+		marker = result.NextPartNumberMarker
+	}
+
+	parts := make([]minio.CompletePart, 0, len(reported))
+	seen := make(map[int]bool, len(reported))
+	for _, part := range reported {
+		if part.PartNumber < 1 || part.PartNumber > session.TotalParts || seen[part.PartNumber] {
+			return nil, fmt.Errorf("invalid or duplicate part number %d", part.PartNumber)
+		}
+		seen[part.PartNumber] = true
+
+		uploaded, ok := stored[part.PartNumber]
+		if !ok {
+			return nil, fmt.Errorf("part %d has not been uploaded", part.PartNumber)
+		}
+		if strings.Trim(uploaded.ETag, "\"") != strings.Trim(part.ETag, "\"") {
+			return nil, fmt.Errorf("ETag mismatch for part %d", part.PartNumber)
+		}
+
+		expectedSize := session.PartSize
+		if part.PartNumber == session.TotalParts {
+			expectedSize = session.FileSize - int64(session.TotalParts-1)*session.PartSize
+		}
+		if uploaded.Size != expectedSize {
+			return nil, fmt.Errorf("part %d is %d bytes, expected %d", part.PartNumber, uploaded.Size, expectedSize)
+		}
+
+		parts = append(parts, minio.CompletePart{PartNumber: part.PartNumber, ETag: uploaded.ETag})
+	}
+
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	return parts, nil
+}
+
+// refreshMountDir asks rclone to drop its cached listing of dir so objects written
+// straight to the bucket show up on the mount without waiting for --dir-cache-time
+func refreshMountDir(dir string) {
+	rcAddr := currentConfig().Storage.RcloneRCAddr
+
+	// Without a dir parameter rclone forgets the whole tree, which is what the root needs
+	params := url.Values{}
+	if dir = strings.TrimPrefix(dir, "/"); dir != "" {
+		params.Set("dir", dir)
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.PostForm("http://"+rcAddr+"/vfs/forget", params)
+	if err != nil {
+		slog.Warn("could not refresh mount listing", "dir", dir, "error", err)
+		metrics.BackendError("rclone_rc")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		slog.Warn("could not refresh mount listing", "dir", dir, "status", resp.Status)
+	}
+}
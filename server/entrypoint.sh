@@ -66,9 +66,15 @@ else
 fi
 echo ""
 
+# The remote control API has no authentication, so it only ever listens on
+# loopback; RCLONE_RC_ADDR just picks the port
+RCLONE_RC_PORT="${RCLONE_RC_ADDR:-localhost:5572}"
+RCLONE_RC_PORT="${RCLONE_RC_PORT##*:}"
+
 # Mount storage using Rclone (run in background, not daemon mode)
-echo "Mounting storage to /storage via Rclone..."
-rclone mount storage:${STORAGE_BUCKET:-rclone} /storage \
+echo "Mounting storage to ${STORAGE_MOUNT:-/storage} via Rclone..."
+mkdir -p "${STORAGE_MOUNT:-/storage}"
+rclone mount storage:${STORAGE_BUCKET:-rclone} "${STORAGE_MOUNT:-/storage}" \
     --allow-other \
     --vfs-cache-mode writes \
     --vfs-cache-max-age 1h \
@@ -78,7 +84,10 @@ rclone mount storage:${STORAGE_BUCKET:-rclone} /storage \
     --log-level INFO \
     --log-file /tmp/rclone-mount.log \
     --poll-interval 15s \
-    --transfers 4 &
+    --transfers 4 \
+    --rc \
+    --rc-addr "127.0.0.1:${RCLONE_RC_PORT}" \
+    --rc-no-auth &
 
 RCLONE_PID=$!
 echo "RClone process started with PID: $RCLONE_PID"
@@ -87,9 +96,9 @@ echo "RClone process started with PID: $RCLONE_PID"
 echo "Waiting for mount to be ready..."
 MOUNT_SUCCESS=false
 for i in {1..30}; do
-    if mountpoint -q /storage 2>/dev/null; then
+    if mountpoint -q "${STORAGE_MOUNT:-/storage}" 2>/dev/null; then
         echo "Storage mounted successfully via Rclone"
-        if ls -la /storage 2>/dev/null; then
+        if ls -la "${STORAGE_MOUNT:-/storage}" 2>/dev/null; then
             echo "Mount is accessible and working"
         else
             echo "Mount is ready but bucket may be empty or inaccessible"
@@ -130,4 +139,4 @@ echo ""
 
 # Start the Go application
 echo "Starting server on port ${SERVER_PORT:-8080}..."
-exec /root/main
+exec /root/main "$@"
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// defaultFilenamePrefix is applied to file request uploads unless the link sets its own
+const defaultFilenamePrefix = "{date}-{time}_"
+
+// FileRequestOptions are the limits and naming rules of an upload-only share ("file request")
+type FileRequestOptions struct {
+	MaxFileSize    int64   `json:"max_file_size,omitempty"` // bytes per file, 0 = unlimited
+	MaxFiles       int     `json:"max_files,omitempty"`     // files per link, 0 = unlimited
+	FilenamePrefix *string `json:"filename_prefix,omitempty"`
+	NotifyURL      string  `json:"notify_url,omitempty"` // POSTed a JSON event when a file arrives
+}
+
+// FileRequestEvent is sent to a file request's notify URL
+type FileRequestEvent struct {
+	Event      string    `json:"event"`
+	ShareID    string    `json:"share_id"`
+	Folder     string    `json:"folder"`
+	Path       string    `json:"path"`
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+var (
+	errFileRequestTooLarge = fmt.Errorf("file exceeds the size limit of this link")
+	errFileRequestFull     = fmt.Errorf("this link has reached its upload limit")
+)
+
+// shareUploadClient posts arrival notifications. Any link creator picks the
+// URL, so it only connects to public addresses: the check runs on the
+// resolved address of every connection, redirects included, so DNS can't
+// point it at the server's own network. No proxy, which would connect for it.
+var shareUploadClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: dialPublicOnly}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+}
+
+// sharedAddressSpace is carrier-grade NAT (RFC 6598), internal like the private ranges
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// publicIP reports whether ip can be reached on the internet: not loopback,
+// link-local (e.g. cloud metadata at 169.254.169.254), private, multicast
+// or unspecified
+func publicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+// dialPublicOnly is a net.Dialer Control refusing connections to non-public addresses
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return fmt.Errorf("%s is not a public address", host)
+	}
+	return nil
+}
+
+// validNotifyURL checks a file request's notify_url: http(s), and not an
+// address on the server's own network where that can be told without DNS
+func validNotifyURL(notifyURL string) bool {
+	u, err := url.Parse(notifyURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return false
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return publicIP(ip)
+	}
+	return true
+}
+
+func validateFileRequestOptions(opts FileRequestOptions, mode string) error {
+	if mode != ShareModeUpload && (opts.MaxFileSize != 0 || opts.MaxFiles != 0 || opts.FilenamePrefix != nil || opts.NotifyURL != "") {
+		return fmt.Errorf("Upload limits only apply to upload shares")
+	}
+	if opts.MaxFileSize < 0 || opts.MaxFiles < 0 {
+		return fmt.Errorf("Invalid upload limits")
+	}
+	if opts.FilenamePrefix != nil && strings.ContainsAny(*opts.FilenamePrefix, "/\\") {
+		return fmt.Errorf("Invalid filename_prefix")
+	}
+	if opts.NotifyURL != "" && !validNotifyURL(opts.NotifyURL) {
+		return fmt.Errorf("Invalid notify_url (must be http or https to a public address)")
+	}
+	return nil
+}
+
+// reserveShareUpload claims one upload slot on the link, returning the upload's sequence number
+func reserveShareUpload(share *Share, size int64) (int, error) {
+	sharesMu.Lock()
+	defer sharesMu.Unlock()
+
+	if share.MaxFileSize > 0 && size > share.MaxFileSize {
+		return 0, errFileRequestTooLarge
+	}
+	if share.MaxFiles > 0 && share.UploadCount >= share.MaxFiles {
+		return 0, errFileRequestFull
+	}
+	share.UploadCount++
+	if err := saveShare(share); err != nil {
+		slog.Error("failed to persist share upload count", "share_id", share.ID, "error", err)
+	}
+	return share.UploadCount, nil
+}
+
+// releaseShareUpload gives back a slot claimed by an upload that failed or was aborted
+func releaseShareUpload(share *Share) {
+	sharesMu.Lock()
+	defer sharesMu.Unlock()
+
+	if share.UploadCount > 0 {
+		share.UploadCount--
+	}
+	if err := saveShare(share); err != nil {
+		slog.Error("failed to persist share upload count", "share_id", share.ID, "error", err)
+	}
+}
+
+// completeShareUpload records a received file and notifies the link owner
+func completeShareUpload(share *Share, relativePath string, size int64) {
+	sharesMu.Lock()
+	share.UploadedBytes += size
+	if err := saveShare(share); err != nil {
+		slog.Error("failed to persist share upload stats", "share_id", share.ID, "error", err)
+	}
+	sharesMu.Unlock()
+
+	event := FileRequestEvent{
+		Event:      "file_request.received",
+		ShareID:    share.ID,
+		Folder:     share.Path,
+		Path:       relativePath,
+		Name:       relativePath[strings.LastIndex(relativePath, "/")+1:],
+		Size:       size,
+		ReceivedAt: time.Now(),
+	}
+	slog.Info("file request received file", "share_id", share.ID, "file", relativePath, "size", size, "owner", share.CreatedBy)
+
+	if share.NotifyURL != "" {
+		go notifyFileRequest(share.NotifyURL, event)
+	}
+}
+
+func notifyFileRequest(notifyURL string, event FileRequestEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	resp, err := shareUploadClient.Post(notifyURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// The notify URL may embed a secret, so log only the underlying error
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		slog.Warn("file request notification failed", "share_id", event.ShareID, "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("file request notification rejected", "share_id", event.ShareID, "status", resp.Status)
+	}
+}
+
+// fileRequestName prefixes an uploaded file name according to the link's template.
+// Supported placeholders: {date} (20060102), {time} (150405), {n} (upload number).
+func fileRequestName(share *Share, filename string, n int, now time.Time) string {
+	prefix := defaultFilenamePrefix
+	if share.FilenamePrefix != nil {
+		prefix = *share.FilenamePrefix
+	}
+	prefix = strings.NewReplacer(
+		"{date}", now.Format("20060102"),
+		"{time}", now.Format("150405"),
+		"{n}", strconv.Itoa(n),
+	).Replace(prefix)
+	return prefix + filename
+}
+
+// writeFileRequestError maps limit errors to HTTP statuses
+func writeFileRequestError(w http.ResponseWriter, err error) {
+	switch err {
+	case errFileRequestTooLarge:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errFileRequestFull:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, "Failed to upload file", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestValidateNotifyURL(t *testing.T) {
+	for _, tt := range []struct {
+		url  string
+		want bool
+	}{
+		{"https://hooks.example.com/file-arrived", true},
+		{"http://203.0.113.10:8080/notify", true},
+		{"http://[2001:db8::1]/notify", true},
+		{"ftp://hooks.example.com/", false},
+		{"https:///path-only", false},
+		{"not a url", false},
+		{"http://localhost:5572/core/command", false},
+		{"http://LOCALHOST./", false},
+		{"http://api.localhost/", false},
+		{"http://127.0.0.1:5572/", false},
+		{"http://[::1]/", false},
+		{"http://[::ffff:127.0.0.1]/", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://10.0.0.5/", false},
+		{"http://172.16.3.4/", false},
+		{"http://192.168.1.1/", false},
+		{"http://100.64.0.1/", false},
+		{"http://[fd00::1]/", false},
+		{"http://[fe80::1]/", false},
+		{"http://0.0.0.0/", false},
+	} {
+		err := validateFileRequestOptions(FileRequestOptions{NotifyURL: tt.url}, ShareModeUpload)
+		if (err == nil) != tt.want {
+			t.Errorf("notify_url %q: %v, want accepted %v", tt.url, err, tt.want)
+		}
+	}
+}
+
+func TestNotifyFileRequestOnlyReachesPublicAddresses(t *testing.T) {
+	var received atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+	}))
+	defer srv.Close()
+
+	// A name is only resolved when connecting, which is where the check has to hold
+	_, port, _ := strings.Cut(strings.TrimPrefix(srv.URL, "http://"), ":")
+	for _, target := range []string{srv.URL, "http://localhost:" + port} {
+		notifyFileRequest(target, FileRequestEvent{Event: "file_request.received", ShareID: "test"})
+	}
+	if n := received.Load(); n != 0 {
+		t.Errorf("loopback notify URL received %d notifications", n)
+	}
+
+	// The same server is reached by a client without the check
+	if resp, err := http.Get(srv.URL); err == nil {
+		resp.Body.Close()
+	}
+	if n := received.Load(); n != 1 {
+		t.Errorf("test server received %d requests, want 1", n)
+	}
+}
+
+func TestDialPublicOnly(t *testing.T) {
+	for _, tt := range []struct {
+		address string
+		want    bool
+	}{
+		{"203.0.113.10:443", true},
+		{"[2001:db8::1]:443", true},
+		{"127.0.0.1:5572", false},
+		{"[::1]:80", false},
+		{"169.254.169.254:80", false},
+		{"10.1.2.3:80", false},
+		{"[fd12::1]:80", false},
+		{"224.0.0.1:80", false},
+	} {
+		if err := dialPublicOnly("tcp", tt.address, nil); (err == nil) != tt.want {
+			t.Errorf("dial %s: %v, want allowed %v", tt.address, err, tt.want)
+		}
+	}
+}
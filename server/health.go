@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// healthDirName is the hidden scratch dir on the mount used by the write probe
+const healthDirName = ".health"
+
+// CheckResult is the outcome of one health check
+type CheckResult struct {
+	Status     string         `json:"status"` // "ok" or "fail"
+	DurationMs int64          `json:"duration_ms"`
+	Error      string         `json:"error,omitempty"`
+	Details    map[string]any `json:"details,omitempty"`
+}
+
+// healthCheck is a named probe. A probe stuck in FUSE I/O can't be cancelled,
+// so concurrent requests share the run in flight instead of starting their own;
+// a hung probe then costs one goroutine, not one per request.
+type healthCheck struct {
+	name string
+	run  func(ctx context.Context) (map[string]any, error)
+
+	mu       sync.Mutex
+	inflight *probeRun
+}
+
+type probeRun struct {
+	done    chan struct{}
+	details map[string]any
+	err     error
+}
+
+var (
+	mountCheck   = &healthCheck{name: "mount", run: checkMountResponds}
+	scratchCheck = &healthCheck{name: "mount_write", run: checkMountWrite}
+	tempCheck    = &healthCheck{name: "temp_space", run: checkTempSpace}
+	backendCheck = &healthCheck{name: "backend", run: checkBackend}
+	drainCheck   = &healthCheck{name: "accepting_uploads", run: checkNotDraining}
+)
+
+func (c *healthCheck) execute(ctx context.Context) CheckResult {
+	start := time.Now()
+	result := CheckResult{Status: "ok"}
+	timeout := currentConfig().Health.CheckTimeout
+
+	c.mu.Lock()
+	probe := c.inflight
+	if probe == nil {
+		probe = &probeRun{done: make(chan struct{})}
+		c.inflight = probe
+		go func() {
+			// Not tied to the request: the result is shared with other callers
+			probeCtx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			probe.details, probe.err = c.run(probeCtx)
+
+			c.mu.Lock()
+			c.inflight = nil
+			c.mu.Unlock()
+			close(probe.done)
+		}()
+	}
+	c.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-probe.done:
+		result.Details = probe.details
+		if probe.err != nil {
+			result.Status, result.Error = "fail", probe.err.Error()
+		}
+	case <-timer.C:
+		result.Status, result.Error = "fail", fmt.Sprintf("timed out after %s", timeout)
+	case <-ctx.Done():
+		result.Status, result.Error = "fail", ctx.Err().Error()
+	}
+	result.DurationMs = time.Since(start).Milliseconds()
+	return result
+}
+
+// checkMountResponds stats the mount root and makes sure it really is a mount
+// (a different device from its parent) rather than the empty mount point
+func checkMountResponds(ctx context.Context) (map[string]any, error) {
+	mounted, err := isMountPoint(STORAGE_MOUNT)
+	if err != nil {
+		return nil, err
+	}
+	if !mounted {
+		return nil, fmt.Errorf("%s is not mounted", STORAGE_MOUNT)
+	}
+	if _, err := os.ReadDir(STORAGE_MOUNT); err != nil {
+		return nil, err
+	}
+	return map[string]any{"path": STORAGE_MOUNT}, nil
+}
+
+// isMountPoint reports whether dir is on a different device from its parent
+func isMountPoint(dir string) (bool, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return false, err
+	}
+	parent, err := os.Stat(filepath.Dir(dir))
+	if err != nil {
+		return false, err
+	}
+	mountStat, ok1 := info.Sys().(*syscall.Stat_t)
+	parentStat, ok2 := parent.Sys().(*syscall.Stat_t)
+	return !ok1 || !ok2 || mountStat.Dev != parentStat.Dev, nil
+}
+
+// checkMountWrite writes, reads back and deletes a small file in the scratch dir
+func checkMountWrite(ctx context.Context) (map[string]any, error) {
+	dir := filepath.Join(STORAGE_MOUNT, healthDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	payload := make([]byte, 32)
+	rand.Read(payload)
+	name := filepath.Join(dir, fmt.Sprintf("probe-%x", payload[:8]))
+
+	if err := os.WriteFile(name, payload, 0600); err != nil {
+		return nil, fmt.Errorf("write: %w", err)
+	}
+	defer os.Remove(name)
+
+	read, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+	if !bytes.Equal(read, payload) {
+		return nil, fmt.Errorf("read back different content")
+	}
+	if err := os.Remove(name); err != nil {
+		return nil, fmt.Errorf("delete: %w", err)
+	}
+	return nil, nil
+}
+
+// checkTempSpace makes sure chunked uploads have room to be assembled
+func checkTempSpace(ctx context.Context) (map[string]any, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(os.TempDir(), &stat); err != nil {
+		return nil, err
+	}
+	free := int64(stat.Bavail) * int64(stat.Bsize)
+	minFree := currentConfig().Health.MinTempFree
+	details := map[string]any{"path": os.TempDir(), "free_bytes": free, "min_free_bytes": minFree}
+	if free < minFree {
+		return details, fmt.Errorf("only %d bytes free", free)
+	}
+	return details, nil
+}
+
+// checkBackend makes sure MinIO answers and the bucket exists
+func checkBackend(ctx context.Context) (map[string]any, error) {
+	exists, err := minioClient.BucketExists(ctx, bucketName)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("bucket %s does not exist", bucketName)
+	}
+	return map[string]any{"bucket": bucketName}, nil
+}
+
+// liveHandler serves /api/health/live: the process is up and the mount still
+// answers. A hung FUSE mount doesn't recover on its own, so this should fail
+// and get the container restarted.
+func liveHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, r, mountCheck)
+}
+
+// readyHandler serves /api/health/ready: every dependency an upload needs is
+// working, so the instance can take traffic
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, r, mountCheck, scratchCheck, tempCheck, backendCheck, drainCheck)
+}
+
+// writeHealth runs checks concurrently and reports each one; any failure makes it 503
+func writeHealth(w http.ResponseWriter, r *http.Request, checks ...*healthCheck) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	results := make(map[string]CheckResult, len(checks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		wg.Add(1)
+		go func(check *healthCheck) {
+			defer wg.Done()
+			result := check.execute(r.Context())
+			mu.Lock()
+			results[check.name] = result
+			mu.Unlock()
+		}(check)
+	}
+	wg.Wait()
+
+	status, code := "ok", http.StatusOK
+	for name, result := range results {
+		if result.Status != "ok" {
+			status, code = "fail", http.StatusServiceUnavailable
+			logFor(r.Context()).Warn("health check failed", "check", name, "error", result.Error)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"checks": results,
+	})
+}
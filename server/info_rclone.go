@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// FileDetails describes everything known about a single file or directory
+type FileDetails struct {
+	Name              string            `json:"name"`
+	Path              string            `json:"path"`
+	IsDir             bool              `json:"is_dir"`
+	Size              int64             `json:"size"`
+	Modified          time.Time         `json:"modified"`
+	ContentType       string            `json:"content_type,omitempty"`
+	StoredContentType string            `json:"stored_content_type,omitempty"`
+	ETag              string            `json:"etag,omitempty"`
+	VersionID         string            `json:"version_id,omitempty"`
+	StorageClass      string            `json:"storage_class,omitempty"`
+	Checksums         map[string]string `json:"checksums,omitempty"`
+	Metadata          map[string]string `json:"metadata,omitempty"`
+	Media             *MediaInfo        `json:"media,omitempty"`
+}
+
+// MediaInfo holds basic image/video properties parsed from file headers
+type MediaInfo struct {
+	Format   string  `json:"format"`
+	Width    int     `json:"width,omitempty"`
+	Height   int     `json:"height,omitempty"`
+	Duration float64 `json:"duration_seconds,omitempty"`
+}
+
+// sniffLen is the number of bytes http.DetectContentType looks at
+const sniffLen = 512
+
+// infoHandlerRClone returns rich information about a file (e.g. /api/info/docs/a.jpg)
+func infoHandlerRClone(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath := strings.TrimPrefix(r.URL.Path, "/api/info/")
+	if filePath == "" {
+		http.Error(w, "File path required", http.StatusBadRequest)
+		return
+	}
+
+	vol, ok := lookupVolume(w, r.URL.Query().Get("volume"))
+	if !ok {
+		return
+	}
+
+	fullPath, err := vol.resolve(filePath)
+	if err == nil && vol.internal(fullPath) {
+		err = fmt.Errorf("path %s is internal", filePath)
+	}
+	if err != nil {
+		logFor(r.Context()).Warn("rejected info path", "error", err)
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	details, err := collectFileDetails(r.Context(), vol, fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, fmt.Sprintf("File not found: %s", filePath), http.StatusNotFound)
+			return
+		}
+		logFor(r.Context()).Error("failed to collect file info", "file", filePath, "error", err)
+		http.Error(w, fmt.Sprintf("Error reading file info: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if details.ETag != "" {
+		w.Header().Set("ETag", details.ETag)
+	}
+	if err := json.NewEncoder(w).Encode(details); err != nil {
+		logFor(r.Context()).Error("failed to encode response", "error", err)
+	}
+}
+
+// collectFileDetails combines the POSIX view of the mount with the object
+// metadata in MinIO, when the volume is a bucket there
+func collectFileDetails(ctx context.Context, vol *Volume, fullPath string) (*FileDetails, error) {
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	details := &FileDetails{
+		Name:     info.Name(),
+		Path:     vol.relative(fullPath),
+		IsDir:    info.IsDir(),
+		Size:     info.Size(),
+		Modified: info.ModTime(),
+	}
+	if details.IsDir {
+		return details, nil
+	}
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	details.ContentType = sniffContentType(file, details.Name)
+	details.Media = probeMedia(file, info.Size(), details.ContentType)
+
+	// Object metadata is only available through the S3 API; the mount hides it
+	objectKey := strings.TrimPrefix(details.Path, "/")
+	if vol.Bucket == "" {
+		details.ETag = fmt.Sprintf("W/\"%x-%x\"", info.Size(), info.ModTime().UnixNano())
+		return details, nil
+	}
+	stat, err := minioClient.StatObject(ctx, vol.Bucket, objectKey, minio.StatObjectOptions{Checksum: true})
+	if err != nil {
+		logFor(ctx).Debug("object metadata unavailable", "object", objectKey, "error", err)
+		details.ETag = fmt.Sprintf("W/\"%x-%x\"", info.Size(), info.ModTime().UnixNano())
+		return details, nil
+	}
+
+	details.ETag = fmt.Sprintf("\"%s\"", stat.ETag)
+	details.VersionID = stat.VersionID
+	details.StoredContentType = stat.ContentType
+	details.StorageClass = stat.StorageClass
+
+	checksums := map[string]string{
+		"crc32":  stat.ChecksumCRC32,
+		"crc32c": stat.ChecksumCRC32C,
+		"sha1":   stat.ChecksumSHA1,
+		"sha256": stat.ChecksumSHA256,
+	}
+	for name, value := range checksums {
+		if value != "" {
+			if details.Checksums == nil {
+				details.Checksums = make(map[string]string)
+			}
+			details.Checksums[name] = value
+		}
+	}
+
+	if len(stat.UserMetadata) > 0 {
+		details.Metadata = make(map[string]string, len(stat.UserMetadata))
+		for key, value := range stat.UserMetadata {
+			details.Metadata[key] = value
+		}
+	}
+
+	return details, nil
+}
+
+// sniffContentType detects the MIME type from file content, falling back to the extension
+func sniffContentType(file io.ReadSeeker, name string) string {
+	buf := make([]byte, sniffLen)
+	n, _ := io.ReadFull(file, buf)
+	file.Seek(0, io.SeekStart)
+
+	detected := http.DetectContentType(buf[:n])
+
+	// Content sniffing can't tell most binary/text formats apart, so trust the extension then
+	if detected == "application/octet-stream" || strings.HasPrefix(detected, "text/plain") {
+		if byExt := mime.TypeByExtension(strings.ToLower(filepath.Ext(name))); byExt != "" {
+			return byExt
+		}
+	}
+	return detected
+}
+
+// probeMedia reads image dimensions or video dimensions/duration from file headers
+func probeMedia(file io.ReadSeeker, size int64, contentType string) *MediaInfo {
+	defer file.Seek(0, io.SeekStart)
+
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		config, format, err := image.DecodeConfig(file)
+		if err != nil {
+			return nil
+		}
+		return &MediaInfo{Format: format, Width: config.Width, Height: config.Height}
+
+	case contentType == "video/mp4", contentType == "video/quicktime", contentType == "video/x-m4v",
+		contentType == "audio/mp4":
+		readerAt, ok := file.(io.ReaderAt)
+		if !ok {
+			return nil
+		}
+		media, err := parseMP4(readerAt, size)
+		if err != nil {
+			slog.Debug("failed to parse MP4 header", "error", err)
+			return nil
+		}
+		return media
+	}
+
+	return nil
+}
+
+// parseMP4 walks ISO base media boxes (moov/mvhd, trak/tkhd) for duration and dimensions
+func parseMP4(r io.ReaderAt, size int64) (*MediaInfo, error) {
+	moov, err := findMP4Box(r, 0, size, "moov")
+	if err != nil {
+		return nil, err
+	}
+
+	media := &MediaInfo{Format: "mp4"}
+
+	mvhd, err := findMP4Box(r, moov.start, moov.end, "mvhd")
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 32)
+	if _, err := r.ReadAt(header, mvhd.start); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if header[0] == 1 {
+		timescale := binary.BigEndian.Uint32(header[20:24])
+		duration := binary.BigEndian.Uint64(header[24:32])
+		if timescale > 0 {
+			media.Duration = float64(duration) / float64(timescale)
+		}
+	} else {
+		timescale := binary.BigEndian.Uint32(header[12:16])
+		duration := binary.BigEndian.Uint32(header[16:20])
+		if timescale > 0 {
+			media.Duration = float64(duration) / float64(timescale)
+		}
+	}
+
+	// The first track with a non-zero size is the video track
+	offset := moov.start
+	for offset < moov.end {
+		trak, err := findMP4Box(r, offset, moov.end, "trak")
+		if err != nil {
+			break
+		}
+		offset = trak.end
+
+		tkhd, err := findMP4Box(r, trak.start, trak.end, "tkhd")
+		if err != nil {
+			continue
+		}
+		// width/height are 16.16 fixed point at the end of the box
+		dims := make([]byte, 8)
+		if _, err := r.ReadAt(dims, tkhd.end-8); err != nil {
+			continue
+		}
+		width := int(binary.BigEndian.Uint32(dims[0:4]) >> 16)
+		height := int(binary.BigEndian.Uint32(dims[4:8]) >> 16)
+		if width > 0 && height > 0 {
+			media.Width = width
+			media.Height = height
+			break
+		}
+	}
+
+	return media, nil
+}
+
+// mp4Box is the payload range of a box, excluding its header
+type mp4Box struct {
+	start int64
+	end   int64
+}
+
+// findMP4Box scans sibling boxes in [start, end) for the first one of the given type
+func findMP4Box(r io.ReaderAt, start, end int64, boxType string) (mp4Box, error) {
+	header := make([]byte, 16)
+	offset := start
+	for offset+8 <= end {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			return mp4Box{}, err
+		}
+		boxSize := int64(binary.BigEndian.Uint32(header[0:4]))
+		headerSize := int64(8)
+
+		switch boxSize {
+		case 0:
+			// Box extends to the end of the enclosing container
+			boxSize = end - offset
+		case 1:
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				return mp4Box{}, err
+			}
+			boxSize = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+
+		if boxSize < headerSize || offset+boxSize > end {
+			return mp4Box{}, fmt.Errorf("malformed box %q at offset %d", header[4:8], offset)
+		}
+
+		if string(header[4:8]) == boxType {
+			return mp4Box{start: offset + headerSize, end: offset + boxSize}, nil
+		}
+		offset += boxSize
+	}
+	return mp4Box{}, fmt.Errorf("box %q not found", boxType)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// formOverhead is the room left for multipart boundaries and form fields
+// around the file itself
+const formOverhead = 1 << 20
+
+// bodyLimit caps how large a route's request body may be and how long the
+// client gets to send it. Uploads can legitimately take a long time, so the
+// server has no global read or write timeout; each route sets its own.
+type bodyLimit struct {
+	max         int64
+	readTimeout time.Duration
+}
+
+// bodyLimitFor picks the limit for a route from uploads.*; only the upload
+// routes take large bodies. Single-request uploads (/api/upload, file request
+// uploads) and chunks get room for the form around the file, every other
+// route takes a JSON body or none at all.
+func bodyLimitFor(pattern string) bodyLimit {
+	uploads := currentConfig().Uploads
+	switch pattern {
+	case "/api/upload", "/api/s/":
+		return bodyLimit{max: uploads.MaxUploadSize + formOverhead, readTimeout: uploads.UploadReadTimeout}
+	case "/api/multipart/upload-chunk":
+		return bodyLimit{max: uploads.MaxChunkSize + formOverhead, readTimeout: uploads.ChunkReadTimeout}
+	default:
+		return bodyLimit{max: uploads.MaxJSONBodySize, readTimeout: uploads.JSONReadTimeout}
+	}
+}
+
+// newServer returns the HTTP server with timeouts that stop clients from
+// holding connections open by trickling headers or idling between requests.
+// Body read timeouts are per route (see limitBody).
+func newServer(addr string) *http.Server {
+	settings := currentConfig().Server
+	return &http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: settings.ReadHeaderTimeout,
+		IdleTimeout:       settings.IdleTimeout,
+		WriteTimeout:      settings.WriteTimeout,
+		MaxHeaderBytes:    int(settings.MaxHeaderBytes),
+	}
+}
+
+// limitBody rejects bodies larger than the route's limit with 413 and gives the
+// client its read timeout to send the body. The deadline is lifted once the body
+// has been read, so slow work afterwards (e.g. writing to the mount) isn't cut off.
+func limitBody(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+			next(w, r)
+			return
+		}
+		limit := bodyLimitFor(pattern)
+		if r.ContentLength > limit.max {
+			w.Header().Set("Connection", "close")
+			writeBodyTooLarge(w, limit.max)
+			return
+		}
+
+		rc := http.NewResponseController(w)
+		if limit.readTimeout > 0 {
+			rc.SetReadDeadline(time.Now().Add(limit.readTimeout))
+		}
+		r.Body = &deadlineBody{ReadCloser: http.MaxBytesReader(w, r.Body, limit.max), rc: rc}
+		next(w, r)
+	}
+}
+
+// deadlineBody clears the read deadline once the whole body has arrived. On
+// any other error the deadline stays, so the server doesn't wait forever to
+// drain what's left of a trickling body.
+type deadlineBody struct {
+	io.ReadCloser
+	rc   *http.ResponseController
+	done bool
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF && !b.done {
+		b.done = true
+		b.rc.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
+
+// writeBodyError answers a failure to read the request body: 413 if it was
+// too large, 408 if the client was too slow, otherwise 400 with msg
+func writeBodyError(w http.ResponseWriter, err error, msg string) {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeBodyTooLarge(w, tooLarge.Limit)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		w.Header().Set("Connection", "close")
+		http.Error(w, "Request body not received in time", http.StatusRequestTimeout)
+	default:
+		http.Error(w, msg, http.StatusBadRequest)
+	}
+}
+
+func writeBodyTooLarge(w http.ResponseWriter, limit int64) {
+	http.Error(w, fmt.Sprintf("Request body too large (limit %d bytes)", limit), http.StatusRequestEntityTooLarge)
+}
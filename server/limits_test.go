@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setLimits installs a config with small body limits for the test
+func setLimits(t *testing.T, edit func(*Config)) {
+	t.Helper()
+	previous := currentConfig()
+	t.Cleanup(func() { setConfig(previous, nil, nil) })
+
+	cfg := defaultConfig()
+	cfg.Uploads.MaxUploadSize = 4 << 10
+	cfg.Uploads.MaxChunkSize = 2 << 10
+	cfg.Uploads.MaxJSONBodySize = 1 << 10
+	if edit != nil {
+		edit(cfg)
+	}
+	setConfig(cfg, nil, nil)
+}
+
+// readAllHandler reads the whole body the way handlers do and answers 200
+// with its length, or the error writeBodyError picks
+func readAllHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, err, "Invalid request body")
+		return
+	}
+	fmt.Fprint(w, len(body))
+}
+
+// unsizedReader hides its length so requests are sent without Content-Length
+type unsizedReader struct{ io.Reader }
+
+func TestLimitBodyPerRoute(t *testing.T) {
+	setLimits(t, nil)
+
+	tests := []struct {
+		route   string
+		size    int64
+		chunked bool
+		want    int
+	}{
+		{"/api/upload", 4<<10 + formOverhead, false, http.StatusOK},
+		{"/api/upload", 4<<10 + formOverhead + 1, false, http.StatusRequestEntityTooLarge},
+		{"/api/upload", 4<<10 + formOverhead + 1, true, http.StatusRequestEntityTooLarge},
+		{"/api/s/", 4<<10 + formOverhead + 1, false, http.StatusRequestEntityTooLarge},
+		{"/api/multipart/upload-chunk", 2<<10 + formOverhead, false, http.StatusOK},
+		{"/api/multipart/upload-chunk", 2<<10 + formOverhead + 1, true, http.StatusRequestEntityTooLarge},
+		{"/api/copy", 1 << 10, false, http.StatusOK},
+		{"/api/copy", 1<<10 + 1, false, http.StatusRequestEntityTooLarge},
+		{"/api/direct/complete", 1<<10 + 1, true, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		name := fmt.Sprintf("%s/%d", tt.route, tt.size)
+		if tt.chunked {
+			name += "/chunked"
+		}
+		t.Run(name, func(t *testing.T) {
+			called := false
+			handler := limitBody(tt.route, func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				readAllHandler(w, r)
+			})
+
+			var body io.Reader = strings.NewReader(strings.Repeat("x", int(tt.size)))
+			if tt.chunked {
+				body = unsizedReader{body}
+			}
+			r := httptest.NewRequest(http.MethodPost, tt.route, body)
+			if tt.chunked {
+				r.ContentLength = -1
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, r)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if tt.want == http.StatusOK && rec.Body.String() != fmt.Sprint(tt.size) {
+				t.Errorf("handler read %s bytes, want %d", rec.Body, tt.size)
+			}
+			limit := bodyLimitFor(tt.route).max
+			if tt.want == http.StatusRequestEntityTooLarge {
+				if msg := fmt.Sprintf("limit %d bytes", limit); !strings.Contains(rec.Body.String(), msg) {
+					t.Errorf("body %q doesn't mention %q", rec.Body, msg)
+				}
+				// A declared length over the limit is refused before the handler runs
+				if !tt.chunked && (called || rec.Header().Get("Connection") != "close") {
+					t.Errorf("handler called: %v, Connection: %q", called, rec.Header().Get("Connection"))
+				}
+			}
+		})
+	}
+}
+
+func TestLimitBodyFollowsConfig(t *testing.T) {
+	setLimits(t, nil)
+	handler := limitBody("/api/upload", readAllHandler)
+	body := strings.Repeat("x", 8<<10+formOverhead)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/api/upload", strings.NewReader(body)))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("before reload: status %d, want 413", rec.Code)
+	}
+
+	// uploads.max_upload_size is reloadable, so the next request sees the new limit
+	setLimits(t, func(cfg *Config) { cfg.Uploads.MaxUploadSize = 8 << 10 })
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/api/upload", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("after reload: status %d, want 200: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestLimitBodyPassesEmptyBodies(t *testing.T) {
+	setLimits(t, nil)
+	called := false
+	limitBody("/api/files", func(w http.ResponseWriter, r *http.Request) { called = true })(
+		httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/files", nil))
+	if !called {
+		t.Error("request without a body didn't reach the handler")
+	}
+}
+
+func TestWriteBodyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"too large", &http.MaxBytesError{Limit: 10}, http.StatusRequestEntityTooLarge},
+		{"wrapped too large", fmt.Errorf("multipart: %w", &http.MaxBytesError{Limit: 10}), http.StatusRequestEntityTooLarge},
+		{"deadline", fmt.Errorf("read tcp: %w", os.ErrDeadlineExceeded), http.StatusRequestTimeout},
+		{"malformed", io.ErrUnexpectedEOF, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			writeBodyError(rec, tt.err, "Invalid request body")
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusBadRequest && !strings.Contains(rec.Body.String(), "Invalid request body") {
+				t.Errorf("body %q doesn't carry the handler's message", rec.Body)
+			}
+		})
+	}
+}
+
+// sendSlowly opens a raw connection to srv, sends the headers of a request
+// declaring length bytes, then only the first byte of the body
+func sendSlowly(t *testing.T, srv *httptest.Server, route string, length int) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: test\r\nContent-Length: %d\r\n\r\nx", route, length)
+	return conn, bufio.NewReader(conn)
+}
+
+func TestLimitBodyReadDeadline(t *testing.T) {
+	setLimits(t, func(cfg *Config) {
+		cfg.Uploads.JSONReadTimeout = 100 * time.Millisecond
+		cfg.Uploads.UploadReadTimeout = 5 * time.Second
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/copy", limitBody("/api/copy", readAllHandler))
+	mux.HandleFunc("/api/upload", limitBody("/api/upload", readAllHandler))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	conn, reader := sendSlowly(t, srv, "/api/copy", 10)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("no response to a stalled body: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Fatalf("stalled body: status %d, want 408", resp.StatusCode)
+	}
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Errorf("answered after %v, want about the 100ms read timeout", waited)
+	}
+	if !resp.Close {
+		t.Error("connection left open after a stalled body")
+	}
+
+	// The same trickle is still within the upload route's longer timeout
+	conn, reader = sendSlowly(t, srv, "/api/upload", 10)
+	time.Sleep(300 * time.Millisecond)
+	conn.Write([]byte("xxxxxxxxx"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("upload sent within its timeout: status %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestLimitBodyLiftsDeadlineAfterBody(t *testing.T) {
+	setLimits(t, func(cfg *Config) { cfg.Uploads.JSONReadTimeout = 100 * time.Millisecond })
+
+	canceled := make(chan error, 1)
+	srv := httptest.NewServer(limitBody("/api/copy", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			writeBodyError(w, err, "Invalid request body")
+			return
+		}
+		// Work that outlasts the read timeout, like copying on the mount, must
+		// not see its request canceled by the expired deadline
+		time.Sleep(300 * time.Millisecond)
+		canceled <- r.Context().Err()
+	}))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL, "application/json", strings.NewReader(`{"from":"/a","to":"/b"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", resp.StatusCode)
+	}
+	if err := <-canceled; err != nil {
+		t.Errorf("request context after the body was read: %v", err)
+	}
+}
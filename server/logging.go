@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// requestIDHeader carries the request ID in from proxies and back out to clients
+const requestIDHeader = "X-Request-ID"
+
+type loggerKey struct{}
+
+// logLevel is the minimum level logged; config reloads change it in place
+var logLevel = new(slog.LevelVar)
+
+// initLogging switches all output, including the standard log package, to JSON
+// lines on stdout at log.level (debug, info, warn, error)
+func initLogging() {
+	setLogLevel(currentConfig().Log.Level)
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel})
+	slog.SetDefault(slog.New(handler))
+}
+
+func setLogLevel(name string) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		level = slog.LevelInfo
+	}
+	logLevel.Set(level)
+}
+
+// logFor returns the request-scoped logger stored in ctx, or the default logger
+func logFor(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// fatal logs at error level and exits, replacing log.Fatalf
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// withRequestLogging assigns each request an ID, attaches a logger carrying it
+// (plus route, method, path and user) to the request context and logs the outcome
+func withRequestLogging(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = uuid.New().String()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		logger := slog.Default().With(
+			"request_id", requestID,
+			"route", route,
+			"method", r.Method,
+			"path", redactPath(route, r.URL.Path),
+			"user", requestUser(r),
+		)
+		if span := spanFromContext(r.Context()); span != nil {
+			logger = logger.With("trace_id", hex.EncodeToString(span.TraceID[:]))
+		}
+		ctx := context.WithValue(r.Context(), loggerKey{}, logger)
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r.WithContext(ctx))
+
+		// Probes and preflights are frequent and uninteresting unless debugging
+		level := slog.LevelInfo
+		switch {
+		case recorder.status >= 500:
+			level = slog.LevelError
+		case strings.HasPrefix(route, "/api/health") || r.Method == http.MethodOptions:
+			level = slog.LevelDebug
+		}
+		logger.Log(ctx, level, "request completed",
+			"status", recorder.status,
+			"bytes", recorder.bytes,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"remote_addr", r.RemoteAddr,
+		)
+	}
+}
+
+// validRequestID accepts IDs from upstream only if they are short and plain,
+// so a client can't inject arbitrary content into the logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// redactPath hides secrets that are part of the URL. Share tokens grant access
+// on their own, so only the path below the token is kept.
+func redactPath(route, urlPath string) string {
+	if route == "/api/s/" {
+		_, rest, _ := strings.Cut(strings.TrimPrefix(urlPath, route), "/")
+		return route + "[redacted]/" + rest
+	}
+	return urlPath
+}
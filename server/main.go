@@ -5,7 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path"
@@ -43,32 +43,23 @@ var madminClient *madmin.AdminClient
 var bucketName = "rclone"
 
 func initMinIO() error {
-	endpoint := os.Getenv("MINIO_ENDPOINT")
-	if endpoint == "" {
-		endpoint = "minio:9000"
-	}
-
-	accessKeyID := os.Getenv("MINIO_ACCESS_KEY")
-	if accessKeyID == "" {
-		accessKeyID = "rclone"
-	}
-
-	secretAccessKey := os.Getenv("MINIO_SECRET_KEY")
-	if secretAccessKey == "" {
-		secretAccessKey = "rclone123"
-	}
-
-	minioBucketName := os.Getenv("MINIO_BUCKET")
-	if minioBucketName != "" {
-		bucketName = minioBucketName
+	settings := currentConfig().MinIO
+	endpoint := settings.Endpoint
+	accessKeyID := settings.AccessKey
+	secretAccessKey := settings.SecretKey
+	bucketName = settings.Bucket
+	useSSL := settings.UseSSL
+
+	// S3 calls become client spans of whatever request made them
+	transport, err := newTracedTransport(useSSL)
+	if err != nil {
+		return fmt.Errorf("failed to create MinIO transport: %w", err)
 	}
 
-	useSSL := os.Getenv("MINIO_USE_SSL") == "true"
-
-	var err error
 	minioClient, err = minio.New(endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(accessKeyID, secretAccessKey, ""),
-		Secure: useSSL,
+		Creds:     credentials.NewStaticV4(accessKeyID, secretAccessKey, ""),
+		Secure:    useSSL,
+		Transport: transport,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to create MinIO client: %w", err)
@@ -76,20 +67,25 @@ func initMinIO() error {
 
 	// Create Core client for multipart operations
 	coreClient, err = minio.NewCore(endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(accessKeyID, secretAccessKey, ""),
-		Secure: useSSL,
+		Creds:     credentials.NewStaticV4(accessKeyID, secretAccessKey, ""),
+		Secure:    useSSL,
+		Transport: transport,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to create MinIO Core client: %w", err)
 	}
 
+	if err := initPresignClient(endpoint, accessKeyID, secretAccessKey, useSSL); err != nil {
+		return err
+	}
+
 	// Create Admin client for fast stats (DataUsageInfo)
 	madminClient, err = madmin.New(endpoint, accessKeyID, secretAccessKey, useSSL)
 	if err != nil {
-		log.Printf("Warning: Failed to create MinIO Admin client: %v (stats will use ListObjects)", err)
+		slog.Warn("MinIO admin client unavailable, stats will use ListObjects", "error", err)
 		madminClient = nil // Continue without admin client
 	} else {
-		log.Printf("MinIO Admin client initialized successfully")
+		slog.Debug("MinIO admin client initialized")
 	}
 
 	// Check if bucket exists, create if not
@@ -104,13 +100,23 @@ func initMinIO() error {
 		if err != nil {
 			return fmt.Errorf("failed to create bucket: %w", err)
 		}
-		log.Printf("Created bucket: %s", bucketName)
+		slog.Info("created bucket", "bucket", bucketName)
 	}
 
-	log.Printf("MinIO client initialized successfully. Endpoint: %s, Bucket: %s", endpoint, bucketName)
+	slog.Info("MinIO client initialized", "endpoint", endpoint, "bucket", bucketName)
 	return nil
 }
 
+// dataUsageInfo asks the MinIO admin API for bucket usage, traced as a client span
+func dataUsageInfo(ctx context.Context) (madmin.DataUsageInfo, error) {
+	ctx, span := tracer.Start(ctx, "minio admin DataUsageInfo", spanKindClient)
+	defer span.End()
+
+	usage, err := madminClient.DataUsageInfo(ctx)
+	span.RecordError(err)
+	return usage, err
+}
+
 // checkFileExists checks if an object exists in MinIO
 func checkFileExists(objectKey string) bool {
 	ctx := context.Background()
@@ -137,22 +143,50 @@ func generateUniqueFilename(originalPath string) string {
 	return path.Join(dir, newFilename)
 }
 
-func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Allow requests from the UI container
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		w.Header().Set("Access-Control-Max-Age", "3600")
-
-		// Handle preflight requests
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusNoContent)
-			return
+// requestUser identifies the caller. The server has no login of its own: the
+// user comes from a verified client certificate when mTLS is on, otherwise
+// from an authenticating proxy in front of it (e.g. oauth2-proxy) that sets
+// X-Forwarded-User. With mTLS the headers are never read, so a client without
+// a certificate, or whose certificate lacks the identity field, is anonymous;
+// without it they only count from a proxy in server.trusted_proxies.
+func requestUser(r *http.Request) string {
+	if mtlsEnabled() {
+		if user := clientCertUser(r); user != "" {
+			return user
 		}
+		return "anonymous"
+	}
+	if !fromTrustedProxy(r) {
+		return "anonymous"
+	}
+	user := r.Header.Get("X-Forwarded-User")
+	if user == "" {
+		user = r.Header.Get("X-User")
+	}
+	if user == "" {
+		return "anonymous"
+	}
+	return user
+}
 
-		next.ServeHTTP(w, r)
+// safeName makes a user name or id usable as a single path segment
+func safeName(name string) string {
+	cleaned := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '@', r == '.':
+			return r
+		}
+		return '_'
+	}, name)
+	if cleaned == "" || strings.Trim(cleaned, ".") == "" {
+		return "_"
 	}
+	return cleaned
+}
+
+// handle registers an API route with tracing, request logging, auditing, per-route metrics and CORS
+func handle(pattern string, handler http.HandlerFunc) {
+	http.HandleFunc(pattern, trackInflight(withTracing(pattern, withRequestLogging(pattern, withAudit(metrics.Instrument(pattern, corsMiddleware(pattern, rateLimit(pattern, limitBody(pattern, handler)))))))))
 }
 
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
@@ -166,14 +200,14 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	// Files larger than this are stored in temporary files on disk
 	err := r.ParseMultipartForm(100 << 20) // 100 MB memory buffer
 	if err != nil {
-		log.Printf("Failed to parse form: %v", err)
+		logFor(r.Context()).Warn("failed to parse upload form", "error", err)
 		http.Error(w, "Failed to parse form", http.StatusBadRequest)
 		return
 	}
 
 	file, handler, err := r.FormFile("file")
 	if err != nil {
-		log.Printf("Failed to get file from form: %v", err)
+		logFor(r.Context()).Warn("upload form has no file", "error", err)
 		http.Error(w, "Failed to get file", http.StatusBadRequest)
 		return
 	}
@@ -214,31 +248,29 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	if fileExists {
 		if conflictAction == "replace" {
 			// User chose to replace - proceed with upload
-			log.Printf("File exists, replacing: %s", objectKey)
+			logFor(r.Context()).Info("replacing existing object", "object", objectKey)
 			conflictHandled = "replaced"
 		} else {
 			// User chose to rename or default behavior
 			newObjectKey := generateUniqueFilename(objectKey)
-			log.Printf("File exists, renaming from %s to %s", objectKey, newObjectKey)
+			logFor(r.Context()).Info("object exists, renaming upload", "object", objectKey, "renamed_to", newObjectKey)
 			objectKey = newObjectKey
 			conflictHandled = "renamed"
 		}
 	}
 
-	log.Printf("Uploading file to MinIO - Key: %s, Size: %d bytes", objectKey, handler.Size)
-
 	// Upload to MinIO
 	ctx := context.Background()
 	_, err = minioClient.PutObject(ctx, bucketName, objectKey, file, handler.Size, minio.PutObjectOptions{
 		ContentType: handler.Header.Get("Content-Type"),
 	})
 	if err != nil {
-		log.Printf("Failed to upload to MinIO: %v", err)
+		logFor(r.Context()).Error("failed to upload object", "object", objectKey, "error", err)
 		http.Error(w, "Failed to upload file", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Successfully uploaded file to MinIO: %s", objectKey)
+	logFor(r.Context()).Info("object uploaded", "object", objectKey, "size", handler.Size)
 
 	// Return success response with conflict resolution info
 	response := UploadResponse{
@@ -284,7 +316,7 @@ func listHandler(w http.ResponseWriter, r *http.Request) {
 		prefix = prefix + "/"
 	}
 
-	log.Printf("Listing objects in MinIO - Prefix: '%s'", prefix)
+	logFor(r.Context()).Debug("listing objects", "prefix", prefix)
 
 	ctx := context.Background()
 	objectCh := minioClient.ListObjects(ctx, bucketName, minio.ListObjectsOptions{
@@ -298,7 +330,7 @@ func listHandler(w http.ResponseWriter, r *http.Request) {
 
 	for object := range objectCh {
 		if object.Err != nil {
-			log.Printf("Error listing object: %v", object.Err)
+			logFor(r.Context()).Error("failed to list object", "error", object.Err)
 			continue
 		}
 
@@ -373,12 +405,12 @@ func listHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	log.Printf("Found %d items in path: %s", len(files), requestPath)
+	logFor(r.Context()).Debug("listed objects", "dir", requestPath, "items", len(files))
 
 	// Return the file list as JSON
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(files); err != nil {
-		log.Printf("Failed to encode response: %v", err)
+		logFor(r.Context()).Error("failed to encode response", "error", err)
 		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
 	}
 }
@@ -396,15 +428,35 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	vol, ok := lookupVolume(w, r.URL.Query().Get("volume"))
+	if !ok {
+		return
+	}
+
 	// Clean the path and remove leading slash
 	objectKey := strings.TrimPrefix(filepath.Clean(filePath), "/")
 
-	log.Printf("Downloading file from MinIO: %s", objectKey)
+	// Internal bookkeeping (trash, versions, share secrets) is never served directly
+	fullPath, err := vol.resolve(objectKey)
+	if err != nil || vol.internal(fullPath) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	event := audit(r, "download", vol.qualify("/"+objectKey))
 
-	ctx := context.Background()
-	object, err := minioClient.GetObject(ctx, bucketName, objectKey, minio.GetObjectOptions{})
+	// Volumes that aren't one of our buckets are served from their mount
+	if vol.Bucket == "" {
+		serveMountFile(w, r, fullPath)
+		return
+	}
+
+	logger := logFor(r.Context())
+	ctx := r.Context()
+	object, err := minioClient.GetObject(ctx, vol.Bucket, objectKey, minio.GetObjectOptions{})
 	if err != nil {
-		log.Printf("Failed to get object from MinIO: %v", err)
+		logger.Error("failed to get object", "object", objectKey, "error", err)
+		metrics.BackendError("s3_get_object")
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
@@ -413,7 +465,10 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 	// Get object info for headers
 	stat, err := object.Stat()
 	if err != nil {
-		log.Printf("Failed to get object stats: %v", err)
+		logger.Warn("failed to stat object", "object", objectKey, "error", err)
+		if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			metrics.BackendError("s3_stat_object")
+		}
 		http.Error(w, "Failed to get file info", http.StatusInternalServerError)
 		return
 	}
@@ -425,12 +480,14 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Stream the file to the response
 	written, err := io.Copy(w, object)
+	metrics.AddBytesDownloaded(written)
+	event.Size = written
 	if err != nil {
-		log.Printf("Failed to stream file: %v", err)
+		logger.Warn("download interrupted", "object", objectKey, "sent", written, "error", err)
 		return
 	}
 
-	log.Printf("Successfully streamed %d bytes for file: %s", written, objectKey)
+	logger.Debug("download streamed", "object", objectKey, "size", written)
 }
 
 func deleteHandler(w http.ResponseWriter, r *http.Request) {
@@ -449,17 +506,15 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 	// Clean the path and remove leading slash
 	objectKey := strings.TrimPrefix(filepath.Clean(filePath), "/")
 
-	log.Printf("Deleting file from MinIO: %s", objectKey)
-
 	ctx := context.Background()
 	err := minioClient.RemoveObject(ctx, bucketName, objectKey, minio.RemoveObjectOptions{})
 	if err != nil {
-		log.Printf("Failed to delete object from MinIO: %v", err)
+		logFor(r.Context()).Error("failed to delete object", "object", objectKey, "error", err)
 		http.Error(w, "Failed to delete file", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Successfully deleted file from MinIO: %s", objectKey)
+	logFor(r.Context()).Info("object deleted", "object", objectKey)
 
 	// Return success response
 	response := map[string]interface{}{
@@ -507,7 +562,7 @@ func statsHandler(w http.ResponseWriter, r *http.Request) {
 
 	for object := range objectCh {
 		if object.Err != nil {
-			log.Printf("Error listing object for stats: %v", object.Err)
+			logFor(r.Context()).Error("failed to list object for stats", "error", object.Err)
 			continue
 		}
 		totalObjects++
@@ -568,41 +623,128 @@ func statsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	cfg, sources, opts, err := loadConfig(os.Args[1:])
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if opts.printOnly {
+		if err := printConfig(os.Stdout, cfg); err != nil {
+			fatal("failed to print configuration", "error", err)
+		}
+		return
+	}
+	setConfig(cfg, sources, nil)
+	setStorageMount(cfg.Storage.Mount)
+
+	initLogging()
+	initTracing()
+
 	// Initialize MinIO client
 	if err := initMinIO(); err != nil {
-		log.Fatalf("Failed to initialize MinIO: %v", err)
+		fatal("failed to initialize MinIO", "error", err)
+	}
+
+	if err := initVolumes(); err != nil {
+		fatal("failed to initialize volumes", "error", err)
 	}
 
 	// Set up routes with CORS
 	// All operations now use RClone POSIX for consistency
-	http.HandleFunc("/api/upload", corsMiddleware(uploadHandlerRClone))
-	http.HandleFunc("/api/list", corsMiddleware(listHandlerRClone))
-	http.HandleFunc("/api/download/", corsMiddleware(downloadHandler))
-	http.HandleFunc("/api/delete/", corsMiddleware(deleteHandlerRClone))
-	http.HandleFunc("/api/health", corsMiddleware(healthHandler))
-	http.HandleFunc("/api/stats", corsMiddleware(statsHandlerRClone))
+	handle("/api/upload", acceptingUploads(uploadHandlerRClone))
+	handle("/api/list", listHandlerRClone)
+	handle("/api/volumes", volumesHandler)
+	handle("/api/copy", acceptingUploads(copyHandler))
+	handle("/api/move", acceptingUploads(moveHandler))
+	handle("/api/download/", downloadHandler)
+	handle("/api/delete/", deleteHandlerRClone)
+	handle("/api/health", healthHandler)
+	handle("/api/health/live", liveHandler)
+	handle("/api/health/ready", readyHandler)
+	handle("/api/stats", statsHandlerRClone)
+	handle("/api/stats/history", statsHistoryHandler)
+	handle("/api/info/", infoHandlerRClone)
+	handle("/api/thumbnail/", thumbnailHandlerRClone)
+	handle("/api/versions/", versionsHandlerRClone)
+	handle("/api/trash", trashHandlerRClone)
+	handle("/api/trash/restore", trashRestoreHandlerRClone)
+	handle("/api/share", shareHandler)
+	handle("/api/s/", publicShareHandler)
+	handle("/api/audit", auditHandler)
+	handle("/api/admin/config", adminConfigHandler)
+	handle("/api/admin/uploads", adminUploadsHandler)
 
 	// Multipart upload endpoints for large files (using RClone POSIX)
-	http.HandleFunc("/api/multipart/initiate", corsMiddleware(initiateMultipartHandlerRClone))
-	http.HandleFunc("/api/multipart/upload-chunk", corsMiddleware(uploadChunkHandlerRClone))
-	http.HandleFunc("/api/multipart/abort", corsMiddleware(abortMultipartHandlerRClone))
+	handle("/api/multipart/initiate", acceptingUploads(initiateMultipartHandlerRClone))
+	handle("/api/multipart/upload-chunk", uploadChunkHandlerRClone)
+	handle("/api/multipart/abort", abortMultipartHandlerRClone)
+
+	// Direct-to-storage uploads: parts go straight to MinIO via presigned URLs
+	handle("/api/direct/initiate", acceptingUploads(initiateDirectUploadHandler))
+	handle("/api/direct/complete", completeDirectUploadHandler)
+	handle("/api/direct/abort", abortMultipartHandler)
+
+	// Prometheus scrape endpoint
+	registerServerGauges(metrics)
+	http.HandleFunc("/metrics", metrics.Handler())
+
+	if err := initVersioning(); err != nil {
+		fatal("failed to initialize versioning", "error", err)
+	}
+
+	initTrash()
+	initRateLimits()
+
+	if err := initAudit(); err != nil {
+		fatal("failed to initialize audit log", "error", err)
+	}
+
+	if err := initShares(); err != nil {
+		fatal("failed to initialize share links", "error", err)
+	}
+
+	if err := webhooks.start(backgroundCtx); err != nil {
+		fatal("failed to open the webhook outbox", "error", err)
+	}
+
+	// Thumbnails are optional - the rest of the API works without a cache dir
+	if err := initThumbnailCache(); err != nil {
+		slog.Warn("thumbnail cache disabled", "error", err)
+	}
+
+	removeOrphanedTempFiles()
+
+	// Direct uploads interrupted by the last shutdown can still be completed
+	if err := restoreDirectSessions(); err != nil {
+		slog.Warn("failed to restore direct upload sessions", "error", err)
+	}
 
 	// Start cleanup goroutine for expired sessions
 	go cleanupOldSessions()
 
-	// Start background stats refresh
+	// Start background stats refresh, with the usage index following bucket
+	// events and reconciled against a full listing now and then
+	go usage.persistOwners(backgroundCtx)
+	go usage.follow(backgroundCtx)
+	go usage.reconcile(backgroundCtx, cfg.Storage.ReconcileInterval)
+	go history.run(backgroundCtx, cfg.Storage.HistoryInterval)
 	startBackgroundStatsRefresh()
 
-	// Get port from environment or use default
-	port := os.Getenv("SERVER_PORT")
-	if port == "" {
-		port = "8080"
-	}
+	// Settings that are safe to change live follow the config file and SIGHUP
+	go watchConfig(backgroundCtx, os.Args[1:], opts.file)
 
-	log.Printf("Server starting on port %s...", port)
-	log.Printf("MinIO endpoint: %s", os.Getenv("MINIO_ENDPOINT"))
+	server := newServer(fmt.Sprintf(":%d", cfg.Server.Port))
+	if tlsEnabled() {
+		if server.TLSConfig, err = newTLSConfig(); err != nil {
+			fatal("failed to initialize TLS", "error", err)
+		}
+		go serverCerts.watch(backgroundCtx, cfg.TLS.ReloadInterval)
+		metrics.RegisterGauge("tls_certificate_expiry_timestamp_seconds", "When the serving certificate expires.", func() float64 {
+			return float64(serverCerts.expiry().Unix())
+		})
+	}
 
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+	slog.Info("server starting", "port", cfg.Server.Port, "tls", tlsEnabled(), "minio_endpoint", cfg.MinIO.Endpoint)
+	if err := serve(server); err != nil {
+		fatal("server failed", "error", err)
 	}
 }
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricsNamespace prefixes every exported metric name
+const metricsNamespace = "file_upload"
+
+// defaultLatencyBuckets cover quick API calls up to multi-minute uploads (seconds)
+var defaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// metrics is the process-wide registry served on /metrics
+var metrics = NewMetrics(defaultLatencyBuckets)
+
+// Metrics collects counters, histograms and gauges and renders them in the
+// Prometheus text exposition format. It has no dependencies on the rest of the
+// server, so it can be created and inspected on its own.
+type Metrics struct {
+	buckets []float64
+
+	mu                sync.Mutex
+	requests          map[requestKey]uint64
+	latency           map[string]*histogram
+	statsCache        map[string]uint64
+	backendErrors     map[string]uint64
+	rateLimited       map[string]uint64
+	configReloads     map[string]uint64
+	usageDrift        map[string]uint64
+	webhookDeliveries map[string]uint64
+	gauges            []gaugeFunc
+
+	bytesUploaded   atomic.Int64
+	bytesDownloaded atomic.Int64
+}
+
+type requestKey struct {
+	route  string
+	method string
+	status int
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+type gaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+// NewMetrics creates an empty registry using the given latency buckets (seconds)
+func NewMetrics(buckets []float64) *Metrics {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	return &Metrics{
+		buckets:           sorted,
+		requests:          make(map[requestKey]uint64),
+		latency:           make(map[string]*histogram),
+		statsCache:        make(map[string]uint64),
+		backendErrors:     make(map[string]uint64),
+		rateLimited:       make(map[string]uint64),
+		configReloads:     make(map[string]uint64),
+		usageDrift:        make(map[string]uint64),
+		webhookDeliveries: make(map[string]uint64),
+	}
+}
+
+// ObserveRequest records one handled request. route must be the registered
+// pattern, not the raw URL path, to keep label cardinality bounded.
+func (m *Metrics) ObserveRequest(route, method string, status int, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[requestKey{route: route, method: method, status: status}]++
+
+	h, ok := m.latency[route]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		m.latency[route] = h
+	}
+	seconds := duration.Seconds()
+	if i := sort.SearchFloat64s(m.buckets, seconds); i < len(m.buckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// AddBytesUploaded counts file content received from clients
+func (m *Metrics) AddBytesUploaded(n int64) {
+	if n > 0 {
+		m.bytesUploaded.Add(n)
+	}
+}
+
+// AddBytesDownloaded counts file content sent to clients
+func (m *Metrics) AddBytesDownloaded(n int64) {
+	if n > 0 {
+		m.bytesDownloaded.Add(n)
+	}
+}
+
+// StatsCacheResult records how a stats request was served: "hit", "stale" or "miss"
+func (m *Metrics) StatsCacheResult(result string) {
+	m.mu.Lock()
+	m.statsCache[result]++
+	m.mu.Unlock()
+}
+
+// BackendError records a failed storage operation (MinIO API or mount I/O)
+func (m *Metrics) BackendError(op string) {
+	m.mu.Lock()
+	m.backendErrors[op]++
+	m.mu.Unlock()
+}
+
+// RateLimited records a request refused with 429, by limit ("api", "upload", "concurrent_uploads", ...)
+func (m *Metrics) RateLimited(reason string) {
+	m.mu.Lock()
+	m.rateLimited[reason]++
+	m.mu.Unlock()
+}
+
+// ConfigReloaded records a config reload attempt by result (applied, unchanged, rejected)
+func (m *Metrics) ConfigReloaded(result string) {
+	m.mu.Lock()
+	m.configReloads[result]++
+	m.mu.Unlock()
+}
+
+// UsageDrift records objects the usage reconciliation found out of step with
+// the bucket, by kind (missing, stale, resized)
+func (m *Metrics) UsageDrift(kind string, objects int) {
+	m.mu.Lock()
+	m.usageDrift[kind] += uint64(objects)
+	m.mu.Unlock()
+}
+
+// WebhookDelivery counts webhook delivery attempts by result: delivered,
+// retried, failed (out of attempts) or dropped (webhook removed from the config)
+func (m *Metrics) WebhookDelivery(result string) {
+	m.mu.Lock()
+	m.webhookDeliveries[result]++
+	m.mu.Unlock()
+}
+
+// RegisterGauge adds a gauge whose value is read at scrape time
+func (m *Metrics) RegisterGauge(name, help string, fn func() float64) {
+	m.mu.Lock()
+	m.gauges = append(m.gauges, gaugeFunc{name: name, help: help, fn: fn})
+	m.mu.Unlock()
+}
+
+// WriteTo renders all metrics in the Prometheus text format
+func (m *Metrics) WriteTo(out io.Writer) (int64, error) {
+	w := &countingWriter{w: bufio.NewWriter(out)}
+
+	m.mu.Lock()
+	requests := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		requests = append(requests, key)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+
+	writeHeader(w, "http_requests_total", "counter", "HTTP requests by route, method and status code.")
+	for _, key := range requests {
+		fmt.Fprintf(w, "%s_http_requests_total{route=%s,method=%s,code=\"%d\"} %d\n",
+			metricsNamespace, quoteLabel(key.route), quoteLabel(key.method), key.status, m.requests[key])
+	}
+
+	writeHeader(w, "http_request_duration_seconds", "histogram", "HTTP request latency by route.")
+	for _, route := range sortedKeys(m.latency) {
+		h := m.latency[route]
+		var cumulative uint64
+		for i, bound := range m.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_http_request_duration_seconds_bucket{route=%s,le=\"%s\"} %d\n",
+				metricsNamespace, quoteLabel(route), formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(w, "%s_http_request_duration_seconds_bucket{route=%s,le=\"+Inf\"} %d\n",
+			metricsNamespace, quoteLabel(route), h.count)
+		fmt.Fprintf(w, "%s_http_request_duration_seconds_sum{route=%s} %s\n",
+			metricsNamespace, quoteLabel(route), formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_http_request_duration_seconds_count{route=%s} %d\n",
+			metricsNamespace, quoteLabel(route), h.count)
+	}
+
+	writeHeader(w, "stats_cache_requests_total", "counter", "Stats requests by cache result (hit, stale, miss).")
+	for _, result := range sortedKeys(m.statsCache) {
+		fmt.Fprintf(w, "%s_stats_cache_requests_total{result=%s} %d\n",
+			metricsNamespace, quoteLabel(result), m.statsCache[result])
+	}
+
+	writeHeader(w, "backend_errors_total", "counter", "Failed storage backend operations by operation.")
+	for _, op := range sortedKeys(m.backendErrors) {
+		fmt.Fprintf(w, "%s_backend_errors_total{op=%s} %d\n", metricsNamespace, quoteLabel(op), m.backendErrors[op])
+	}
+
+	writeHeader(w, "rate_limited_requests_total", "counter", "Requests refused with 429 by limit.")
+	for _, reason := range sortedKeys(m.rateLimited) {
+		fmt.Fprintf(w, "%s_rate_limited_requests_total{limit=%s} %d\n", metricsNamespace, quoteLabel(reason), m.rateLimited[reason])
+	}
+
+	writeHeader(w, "config_reloads_total", "counter", "Config reloads by result (applied, unchanged, rejected).")
+	for _, result := range sortedKeys(m.configReloads) {
+		fmt.Fprintf(w, "%s_config_reloads_total{result=%s} %d\n", metricsNamespace, quoteLabel(result), m.configReloads[result])
+	}
+
+	writeHeader(w, "usage_drift_objects_total", "counter", "Objects the usage reconciliation corrected, by kind (missing, stale, resized).")
+	for _, kind := range sortedKeys(m.usageDrift) {
+		fmt.Fprintf(w, "%s_usage_drift_objects_total{kind=%s} %d\n", metricsNamespace, quoteLabel(kind), m.usageDrift[kind])
+	}
+	writeHeader(w, "webhook_deliveries_total", "counter", "Webhook delivery attempts by result (delivered, retried, failed, dropped).")
+	for _, result := range sortedKeys(m.webhookDeliveries) {
+		fmt.Fprintf(w, "%s_webhook_deliveries_total{result=%s} %d\n", metricsNamespace, quoteLabel(result), m.webhookDeliveries[result])
+	}
+	gauges := append([]gaugeFunc(nil), m.gauges...)
+	m.mu.Unlock()
+
+	writeHeader(w, "uploaded_bytes_total", "counter", "File bytes received from clients.")
+	fmt.Fprintf(w, "%s_uploaded_bytes_total %d\n", metricsNamespace, m.bytesUploaded.Load())
+	writeHeader(w, "downloaded_bytes_total", "counter", "File bytes sent to clients.")
+	fmt.Fprintf(w, "%s_downloaded_bytes_total %d\n", metricsNamespace, m.bytesDownloaded.Load())
+
+	// Gauge callbacks may take their own locks, so run them outside ours
+	for _, g := range gauges {
+		writeHeader(w, g.name, "gauge", g.help)
+		fmt.Fprintf(w, "%s_%s %s\n", metricsNamespace, g.name, formatFloat(g.fn()))
+	}
+
+	err := w.w.Flush()
+	return w.n, err
+}
+
+// Handler serves the registry for Prometheus to scrape
+func (m *Metrics) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.WriteTo(w)
+	}
+}
+
+// Instrument wraps a handler to record its request count and latency under route
+func (m *Metrics) Instrument(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r)
+		m.ObserveRequest(route, r.Method, recorder.status, time.Since(start))
+	}
+}
+
+// CountDownload wraps w so that every body byte written counts as downloaded
+func (m *Metrics) CountDownload(w http.ResponseWriter) http.ResponseWriter {
+	return &downloadCounter{ResponseWriter: w, metrics: m}
+}
+
+type downloadCounter struct {
+	http.ResponseWriter
+	metrics *Metrics
+}
+
+func (d *downloadCounter) Write(b []byte) (int, error) {
+	n, err := d.ResponseWriter.Write(b)
+	d.metrics.AddBytesDownloaded(int64(n))
+	return n, err
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	bytes       int64
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if !s.wroteHeader {
+		s.status = status
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer (flush, deadlines)
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+type countingWriter struct {
+	w *bufio.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s_%s %s\n# TYPE %s_%s %s\n", metricsNamespace, name, help, metricsNamespace, name, kind)
+}
+
+func quoteLabel(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+	return `"` + value + `"`
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// registerServerGauges exposes server state that is read at scrape time
+func registerServerGauges(m *Metrics) {
+	m.RegisterGauge("multipart_sessions_active", "Chunked uploads in progress.", func() float64 {
+		sessionsRCloneMu.RLock()
+		defer sessionsRCloneMu.RUnlock()
+		return float64(len(uploadSessionsRClone))
+	})
+	m.RegisterGauge("direct_upload_sessions_active", "Direct-to-storage uploads in progress.", func() float64 {
+		sessionsMu.RLock()
+		defer sessionsMu.RUnlock()
+		return float64(len(uploadSessions))
+	})
+	m.RegisterGauge("temp_bytes", "Bytes held in temporary upload files.", func() float64 {
+		return float64(tempUploadBytes())
+	})
+	m.RegisterGauge("usage_indexed_objects", "Objects in the usage index.", func() float64 {
+		files, _ := usage.counts()
+		return float64(files)
+	})
+	m.RegisterGauge("usage_indexed_bytes", "Bytes in the usage index.", func() float64 {
+		_, bytes := usage.counts()
+		return float64(bytes)
+	})
+	m.RegisterGauge("webhook_outbox_pending", "Webhook deliveries waiting to be made.", func() float64 {
+		return float64(webhooks.pending())
+	})
+	m.RegisterGauge("goroutines", "Number of goroutines.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+}
+
+// tempUploadBytes sums the chunk assembly files in the temp dir, including ones
+// orphaned by a crash
+func tempUploadBytes() int64 {
+	matches, _ := filepath.Glob(filepath.Join(os.TempDir(), "rclone-upload-*"))
+	var total int64
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil {
+			total += info.Size()
+		}
+	}
+	return total
+}
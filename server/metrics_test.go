@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrape renders m through its HTTP handler, as Prometheus would read it
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	m.Handler()(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("scrape: status %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("scrape: content type %q", ct)
+	}
+	return rec.Body.String()
+}
+
+// assertLines fails unless every line appears verbatim in the exposition
+func assertLines(t *testing.T, body string, lines ...string) {
+	t.Helper()
+	have := make(map[string]bool)
+	for _, line := range strings.Split(body, "\n") {
+		have[line] = true
+	}
+	for _, line := range lines {
+		if !have[line] {
+			t.Errorf("missing line %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestInstrumentCountsRequestsByStatus(t *testing.T) {
+	m := NewMetrics([]float64{0.05, 10})
+
+	ok := m.Instrument("/api/files", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	})
+	missing := m.Instrument("/api/files", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Not found", http.StatusNotFound)
+	})
+	rewritten := m.Instrument("/api/upload", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.WriteHeader(http.StatusInternalServerError) // ignored by net/http, so by the recorder too
+	})
+
+	for i := 0; i < 2; i++ {
+		ok(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/files?path=/a", nil))
+	}
+	missing(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/files?path=/b", nil))
+	rewritten(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/upload", nil))
+
+	body := scrape(t, m)
+	assertLines(t, body,
+		"# HELP file_upload_http_requests_total HTTP requests by route, method and status code.",
+		"# TYPE file_upload_http_requests_total counter",
+		`file_upload_http_requests_total{route="/api/files",method="GET",code="200"} 2`,
+		`file_upload_http_requests_total{route="/api/files",method="GET",code="404"} 1`,
+		`file_upload_http_requests_total{route="/api/upload",method="POST",code="201"} 1`,
+	)
+	if strings.Contains(body, `code="500"`) {
+		t.Errorf("second WriteHeader was counted:\n%s", body)
+	}
+	if strings.Contains(body, "path=") {
+		t.Errorf("raw URL leaked into labels:\n%s", body)
+	}
+}
+
+func TestInstrumentRecordsLatencyHistogram(t *testing.T) {
+	m := NewMetrics([]float64{10, 0.05}) // sorted by NewMetrics
+
+	fast := m.Instrument("/api/stats", func(w http.ResponseWriter, r *http.Request) {})
+	slow := m.Instrument("/api/stats", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(60 * time.Millisecond)
+	})
+	fast(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/stats", nil))
+	slow(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/stats", nil))
+
+	body := scrape(t, m)
+	assertLines(t, body,
+		"# TYPE file_upload_http_request_duration_seconds histogram",
+		`file_upload_http_request_duration_seconds_bucket{route="/api/stats",le="0.05"} 1`,
+		`file_upload_http_request_duration_seconds_bucket{route="/api/stats",le="10"} 2`,
+		`file_upload_http_request_duration_seconds_bucket{route="/api/stats",le="+Inf"} 2`,
+		`file_upload_http_request_duration_seconds_count{route="/api/stats"} 2`,
+	)
+
+	var sum float64
+	for _, line := range strings.Split(body, "\n") {
+		if rest, ok := strings.CutPrefix(line, `file_upload_http_request_duration_seconds_sum{route="/api/stats"} `); ok {
+			var err error
+			if sum, err = strconv.ParseFloat(rest, 64); err != nil {
+				t.Fatalf("sum %q: %v", rest, err)
+			}
+		}
+	}
+	if sum < 0.06 || sum > 10 {
+		t.Errorf("latency sum = %v, want the slow request's 60ms or a little more", sum)
+	}
+}
+
+func TestHistogramBucketsAreCumulative(t *testing.T) {
+	m := NewMetrics([]float64{0.1, 1, 5})
+	for _, d := range []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 2 * time.Second, time.Minute} {
+		m.ObserveRequest("/api/upload", http.MethodPost, http.StatusOK, d)
+	}
+
+	assertLines(t, scrape(t, m),
+		// A value equal to a bound falls in that bucket (le is "less or equal")
+		`file_upload_http_request_duration_seconds_bucket{route="/api/upload",le="0.1"} 2`,
+		`file_upload_http_request_duration_seconds_bucket{route="/api/upload",le="1"} 2`,
+		`file_upload_http_request_duration_seconds_bucket{route="/api/upload",le="5"} 3`,
+		`file_upload_http_request_duration_seconds_bucket{route="/api/upload",le="+Inf"} 4`,
+		`file_upload_http_request_duration_seconds_sum{route="/api/upload"} 62.15`,
+		`file_upload_http_request_duration_seconds_count{route="/api/upload"} 4`,
+	)
+}
+
+func TestExpositionCountersAndGauges(t *testing.T) {
+	m := NewMetrics(defaultLatencyBuckets)
+	m.StatsCacheResult("hit")
+	m.StatsCacheResult("hit")
+	m.StatsCacheResult("miss")
+	m.BackendError("mount_write")
+	m.RateLimited("upload")
+	m.ConfigReloaded("applied")
+	m.UsageDrift("missing", 3)
+	m.UsageDrift("missing", 2)
+	m.WebhookDelivery("retried")
+	m.AddBytesUploaded(1024)
+	m.AddBytesUploaded(-5) // ignored
+	m.RegisterGauge("queue_depth", "Items waiting.", func() float64 { return 7 })
+
+	download := m.Instrument("/api/download/", func(w http.ResponseWriter, r *http.Request) {
+		m.CountDownload(w).Write([]byte("hello"))
+	})
+	download(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/download/a.txt", nil))
+
+	assertLines(t, scrape(t, m),
+		`file_upload_stats_cache_requests_total{result="hit"} 2`,
+		`file_upload_stats_cache_requests_total{result="miss"} 1`,
+		`file_upload_backend_errors_total{op="mount_write"} 1`,
+		`file_upload_rate_limited_requests_total{limit="upload"} 1`,
+		`file_upload_config_reloads_total{result="applied"} 1`,
+		`file_upload_usage_drift_objects_total{kind="missing"} 5`,
+		`file_upload_webhook_deliveries_total{result="retried"} 1`,
+		"# TYPE file_upload_uploaded_bytes_total counter",
+		"file_upload_uploaded_bytes_total 1024",
+		"file_upload_downloaded_bytes_total 5",
+		"# HELP file_upload_queue_depth Items waiting.",
+		"# TYPE file_upload_queue_depth gauge",
+		"file_upload_queue_depth 7",
+	)
+}
+
+func TestExpositionEscapesLabels(t *testing.T) {
+	m := NewMetrics(defaultLatencyBuckets)
+	m.BackendError("say \"hi\"\\\nbye")
+
+	assertLines(t, scrape(t, m), `file_upload_backend_errors_total{op="say \"hi\"\\\nbye"} 1`)
+}
+
+func TestMetricsHandlerRejectsWrites(t *testing.T) {
+	rec := httptest.NewRecorder()
+	NewMetrics(defaultLatencyBuckets).Handler()(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /metrics: status %d, want 405", rec.Code)
+	}
+}
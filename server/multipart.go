@@ -4,7 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"path"
 	"path/filepath"
@@ -24,6 +24,11 @@ type ChunkUploadSession struct {
 	TotalParts  int
 	UploadedParts map[int]minio.CompletePart
 	StartTime   time.Time
+	// Direct uploads only: the client sends parts straight to MinIO
+	FileSize       int64
+	PartSize       int64
+	ConflictAction string
+	Owner          string // client that started it (see clientKey)
 	mu          sync.Mutex
 }
 
@@ -37,6 +42,7 @@ type InitiateMultipartRequest struct {
 	TotalParts int    `json:"total_parts"`
 	FileSize   int64  `json:"file_size"`
 	Path       string `json:"path,omitempty"`
+	Volume     string `json:"volume,omitempty"` // chunked uploads only
 }
 
 // ChunkUploadRequest for uploading individual chunks
@@ -90,7 +96,7 @@ func initiateMultipartHandler(w http.ResponseWriter, r *http.Request) {
 		ContentType: "application/octet-stream",
 	})
 	if err != nil {
-		log.Printf("Failed to initiate multipart upload: %v", err)
+		logFor(r.Context()).Error("failed to initiate multipart upload", "object", objectKey, "error", err)
 		http.Error(w, "Failed to initiate upload", http.StatusInternalServerError)
 		return
 	}
@@ -109,8 +115,8 @@ func initiateMultipartHandler(w http.ResponseWriter, r *http.Request) {
 	uploadSessions[sessionID] = session
 	sessionsMu.Unlock()
 
-	log.Printf("Initiated multipart upload - Session: %s, UploadID: %s, File: %s, Parts: %d",
-		sessionID, uploadID, objectKey, req.TotalParts)
+	logFor(r.Context()).Info("multipart upload initiated", "session_id", sessionID,
+		"object", objectKey, "parts", req.TotalParts)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(MultipartResponse{
@@ -163,14 +169,14 @@ func uploadChunkHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Get chunk size from the file header
 	chunkSize := header.Size
-	log.Printf("Uploading part %d with size: %d bytes", partNumber, chunkSize)
+	logFor(r.Context()).Debug("uploading part", "session_id", sessionID, "part", partNumber, "size", chunkSize)
 
 	// Upload part to MinIO using Core client
 	ctx := context.Background()
 	objectPart, err := coreClient.PutObjectPart(ctx, bucketName, session.FileName, session.UploadID,
 		partNumber, file, chunkSize, minio.PutObjectPartOptions{})
 	if err != nil {
-		log.Printf("Failed to upload part %d: %v", partNumber, err)
+		logFor(r.Context()).Error("failed to upload part", "session_id", sessionID, "part", partNumber, "error", err)
 		http.Error(w, "Failed to upload chunk", http.StatusInternalServerError)
 		return
 	}
@@ -186,8 +192,8 @@ func uploadChunkHandler(w http.ResponseWriter, r *http.Request) {
 
 	progress := float64(uploadedCount) / float64(session.TotalParts) * 100
 
-	log.Printf("Uploaded chunk - Session: %s, Part: %d/%d, Progress: %.1f%%",
-		sessionID, partNumber, session.TotalParts, progress)
+	logFor(r.Context()).Debug("part uploaded", "session_id", sessionID,
+		"part", partNumber, "parts", session.TotalParts)
 
 	// If all parts uploaded, complete the upload
 	if uploadedCount == session.TotalParts {
@@ -220,7 +226,7 @@ func completeMultipartUpload(sessionID string, session *ChunkUploadSession, w ht
 	_, err := coreClient.CompleteMultipartUpload(ctx, bucketName, session.FileName,
 		session.UploadID, parts, minio.PutObjectOptions{})
 	if err != nil {
-		log.Printf("Failed to complete multipart upload: %v", err)
+		slog.Error("failed to complete multipart upload", "session_id", sessionID, "error", err)
 		http.Error(w, "Failed to complete upload", http.StatusInternalServerError)
 		return
 	}
@@ -231,8 +237,8 @@ func completeMultipartUpload(sessionID string, session *ChunkUploadSession, w ht
 	sessionsMu.Unlock()
 
 	duration := time.Since(session.StartTime)
-	log.Printf("Completed multipart upload - Session: %s, File: %s, Duration: %v",
-		sessionID, session.FileName, duration)
+	slog.Info("multipart upload completed", "session_id", sessionID,
+		"object", session.FileName, "duration_ms", duration.Milliseconds())
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(MultipartResponse{
@@ -272,7 +278,7 @@ func abortMultipartHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 	err := coreClient.AbortMultipartUpload(ctx, bucketName, session.FileName, session.UploadID)
 	if err != nil {
-		log.Printf("Failed to abort multipart upload: %v", err)
+		logFor(r.Context()).Warn("failed to abort multipart upload", "session_id", sessionID, "error", err)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -282,74 +288,27 @@ func abortMultipartHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// getPresignedUploadURL generates a presigned URL for direct upload to S3
-func getPresignedUploadURLHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	var req struct {
-		FileName string `json:"filename"`
-		Path     string `json:"path,omitempty"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
-	}
-
-	// Generate object key
-	uploadPath := req.Path
-	if uploadPath == "" {
-		uploadPath = "/"
-	}
-
-	var objectKey string
-	if uploadPath == "/" || uploadPath == "" {
-		objectKey = req.FileName
-	} else {
-		uploadPath = strings.TrimPrefix(filepath.Clean(uploadPath), "/")
-		objectKey = path.Join(uploadPath, req.FileName)
-	}
-	objectKey = strings.TrimPrefix(objectKey, "/")
-
-	// Generate presigned URL (valid for 24 hours)
-	ctx := context.Background()
-	presignedURL, err := minioClient.PresignedPutObject(ctx, bucketName, objectKey, 24*time.Hour)
-	if err != nil {
-		log.Printf("Failed to generate presigned URL: %v", err)
-		http.Error(w, "Failed to generate upload URL", http.StatusInternalServerError)
-		return
-	}
-
-	log.Printf("Generated presigned URL for: %s", objectKey)
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success":    true,
-		"upload_url": presignedURL.String(),
-		"object_key": objectKey,
-		"expires_in": "24h",
-		"message":    "Use this URL to upload directly to storage",
-	})
-}
-
 // cleanupOldSessions removes expired upload sessions (run periodically)
 func cleanupOldSessions() {
 	ticker := time.NewTicker(1 * time.Hour)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ticker.C:
+		case <-backgroundCtx.Done():
+			return
+		}
+
 		sessionsMu.Lock()
 		for id, session := range uploadSessions {
-			// Remove sessions older than 24 hours
-			if time.Since(session.StartTime) > 24*time.Hour {
+			// Remove sessions older than uploads.session_ttl
+			if time.Since(session.StartTime) > currentConfig().Uploads.SessionTTL {
 				// Abort the multipart upload in MinIO using Core client
 				ctx := context.Background()
 				coreClient.AbortMultipartUpload(ctx, bucketName, session.FileName, session.UploadID)
 				delete(uploadSessions, id)
-				log.Printf("Cleaned up expired session: %s", id)
+				slog.Info("expired upload session cleaned up", "session_id", id)
 			}
 		}
 		sessionsMu.Unlock()
@@ -1,16 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -20,9 +22,17 @@ type ChunkUploadSessionRClone struct {
 	SessionID     string
 	FileName      string
 	FilePath      string   // Path in RClone where file will be written
+	Volume        *Volume  // volume FilePath is on
 	TempFile      *os.File // Temporary file being assembled
 	TotalParts    int
 	ReceivedParts map[int]bool
+	Share         *Share // set for file request uploads, which are limited to the declared size
+	FileSize      int64
+	BytesReceived int64
+	Owner         string // client that started it (see clientKey)
+	User          string // whose usage the file counts toward
+	StartTime     time.Time
+	LastChunk     time.Time // when the last chunk was written
 	mu            sync.Mutex
 }
 
@@ -38,31 +48,78 @@ func initiateMultipartHandlerRClone(w http.ResponseWriter, r *http.Request) {
 
 	var req InitiateMultipartRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeBodyError(w, err, "Invalid request body")
+		return
+	}
+	if !allowedFileType(req.FileName) {
+		writeFileTypeNotAllowed(w)
+		return
+	}
+	if tooManyUploadSessions(w, r) {
 		return
 	}
 
 	// Generate session ID
 	sessionID := uuid.New().String()
 
+	vol, ok := lookupVolume(w, req.Volume)
+	if !ok {
+		return
+	}
+
 	// Determine target path in RClone
-	uploadPath := req.Path
-	if uploadPath == "" {
-		uploadPath = "/"
+	uploadPath := uploadDir(req.Path)
+
+	// File request holders upload into the link's folder only, under a prefixed name
+	var share *Share
+	if token := r.Header.Get("X-Share-Token"); token != "" {
+		var ok bool
+		if share, ok = authorizeShare(w, r, token); !ok {
+			return
+		}
+		if share.Mode != ShareModeUpload {
+			http.Error(w, "Not allowed for this share", http.StatusForbidden)
+			return
+		}
+		n, err := reserveShareUpload(share, req.FileSize)
+		if err != nil {
+			writeFileRequestError(w, err)
+			return
+		}
+		uploadPath, vol = share.Path, defaultVolume()
+		req.FileName = fileRequestName(share, filepath.Base(req.FileName), n, time.Now())
 	}
 
 	var targetPath string
 	if uploadPath == "/" || uploadPath == "" {
-		targetPath = filepath.Join(STORAGE_MOUNT, req.FileName)
+		targetPath = filepath.Join(vol.Mount, req.FileName)
 	} else {
 		uploadPath = strings.TrimPrefix(filepath.Clean(uploadPath), "/")
-		targetPath = filepath.Join(STORAGE_MOUNT, uploadPath, req.FileName)
+		targetPath = filepath.Join(vol.Mount, uploadPath, req.FileName)
+	}
+
+	if share != nil {
+		if _, err := os.Stat(targetPath); err == nil {
+			targetPath = generateUniqueFilename(targetPath)
+		}
+	}
+
+	// Security: Ensure path doesn't escape the volume or touch internal directories
+	if !strings.HasPrefix(targetPath, vol.Mount+"/") || vol.internal(targetPath) {
+		if share != nil {
+			releaseShareUpload(share)
+		}
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
 	}
 
 	// Create directory if needed
 	targetDir := filepath.Dir(targetPath)
 	if err := os.MkdirAll(targetDir, 0755); err != nil {
-		log.Printf("Failed to create directory: %v", err)
+		if share != nil {
+			releaseShareUpload(share)
+		}
+		logFor(r.Context()).Error("failed to create upload directory", "error", err)
 		http.Error(w, "Failed to create directory", http.StatusInternalServerError)
 		return
 	}
@@ -70,27 +127,42 @@ func initiateMultipartHandlerRClone(w http.ResponseWriter, r *http.Request) {
 	// Create temporary file for assembling chunks
 	tempFile, err := os.CreateTemp(os.TempDir(), "rclone-upload-*")
 	if err != nil {
-		log.Printf("Failed to create temp file: %v", err)
+		if share != nil {
+			releaseShareUpload(share)
+		}
+		logFor(r.Context()).Error("failed to create temp file", "error", err)
 		http.Error(w, "Failed to create temp file", http.StatusInternalServerError)
 		return
 	}
 
 	// Create session
+	// File request uploads count toward the user who created the link
+	user := requestUser(r)
+	if share != nil {
+		user = share.CreatedBy
+	}
+
 	session := &ChunkUploadSessionRClone{
 		SessionID:     sessionID,
 		FileName:      req.FileName,
 		FilePath:      targetPath,
+		Volume:        vol,
 		TempFile:      tempFile,
 		TotalParts:    req.TotalParts,
 		ReceivedParts: make(map[int]bool),
+		Share:         share,
+		FileSize:      req.FileSize,
+		Owner:         clientKey(r),
+		User:          user,
+		StartTime:     time.Now(),
 	}
 
 	sessionsRCloneMu.Lock()
 	uploadSessionsRClone[sessionID] = session
 	sessionsRCloneMu.Unlock()
 
-	log.Printf("Initiated RClone chunked upload - Session: %s, File: %s, Parts: %d",
-		sessionID, req.FileName, req.TotalParts)
+	logFor(r.Context()).Info("chunked upload initiated", "session_id", sessionID,
+		"file", vol.qualify(vol.relative(targetPath)), "parts", req.TotalParts, "size", req.FileSize)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(MultipartResponse{
@@ -108,8 +180,8 @@ func uploadChunkHandlerRClone(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Parse multipart form
-	if err := r.ParseMultipartForm(100 << 20); err != nil {
-		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+	if err := parseMultipartForm(r, 100<<20); err != nil {
+		writeBodyError(w, err, "Failed to parse form")
 		return
 	}
 
@@ -141,38 +213,68 @@ func uploadChunkHandlerRClone(w http.ResponseWriter, r *http.Request) {
 	defer file.Close()
 
 	chunkSize := header.Size
-	log.Printf("Receiving chunk %d for session %s, size: %d bytes", partNumber, sessionID, chunkSize)
+	logger := logFor(r.Context()).With("session_id", sessionID)
+	logger.Debug("receiving chunk", "part", partNumber, "size", chunkSize)
 
 	// Write chunk to temp file
 	// For simplicity, we append chunks sequentially
 	// In production, you might want to handle out-of-order chunks
 	session.mu.Lock()
+	// File request uploads may not send more than they declared (and were checked for)
+	if session.Share != nil && session.BytesReceived+chunkSize > session.FileSize {
+		session.mu.Unlock()
+		writeFileRequestError(w, errFileRequestTooLarge)
+		return
+	}
+	_, span := startSpan(r.Context(), "temp.write", "upload.part", partNumber, "file.size", chunkSize)
 	_, err = io.Copy(session.TempFile, file)
+	span.RecordError(err)
+	span.End()
 	session.ReceivedParts[partNumber] = true
+	session.BytesReceived += chunkSize
+	session.LastChunk = time.Now()
 	receivedCount := len(session.ReceivedParts)
 	session.mu.Unlock()
 
 	if err != nil {
-		log.Printf("Failed to write chunk: %v", err)
+		logger.Error("failed to write chunk", "part", partNumber, "error", err)
+		metrics.BackendError("temp_write")
 		http.Error(w, "Failed to write chunk", http.StatusInternalServerError)
 		return
 	}
 
+	metrics.AddBytesUploaded(chunkSize)
+
 	progress := float64(receivedCount) / float64(session.TotalParts) * 100
-	log.Printf("Chunk %d/%d received, Progress: %.1f%%", receivedCount, session.TotalParts, progress)
+	logger.Debug("chunk received", "received", receivedCount, "parts", session.TotalParts)
 
 	// If all parts received, finalize the upload
 	if receivedCount == session.TotalParts {
-		if err := finalizeRCloneUpload(session); err != nil {
-			log.Printf("Failed to finalize upload: %v", err)
+		event := audit(r, "upload", session.displayPath())
+		event.Size = session.BytesReceived
+		if session.Share != nil {
+			event.ShareID = session.Share.ID
+		}
+
+		if err := finalizeRCloneUpload(r.Context(), session); err != nil {
+			logger.Error("failed to finalize upload", "error", err)
+			metrics.BackendError("mount_write")
+			// The temp file is closed, so the session can't take more chunks
+			if removeChunkedSession(sessionID) != nil {
+				recentUploads.add(session, "failed", err.Error(), "")
+			}
 			http.Error(w, "Failed to finalize upload", http.StatusInternalServerError)
 			return
 		}
+		if session.Share != nil {
+			completeShareUpload(session.Share, storageRelativePath(session.FilePath), session.BytesReceived)
+		}
 
 		// Clean up session
 		sessionsRCloneMu.Lock()
 		delete(uploadSessionsRClone, sessionID)
 		sessionsRCloneMu.Unlock()
+		recentUploads.add(session, "completed", "", "")
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(MultipartResponse{
@@ -194,26 +296,73 @@ func uploadChunkHandlerRClone(w http.ResponseWriter, r *http.Request) {
 }
 
 // Finalize RClone upload by moving temp file to final location
-func finalizeRCloneUpload(session *ChunkUploadSessionRClone) error {
+func finalizeRCloneUpload(ctx context.Context, session *ChunkUploadSessionRClone) (err error) {
+	ctx, span := startSpan(ctx, "mount.finalize",
+		"file.path", session.displayPath(), "file.size", session.BytesReceived)
+	defer func() {
+		span.RecordError(err)
+		span.End()
+		if err != nil {
+			notifyUploadFailed(session.Volume, session.FilePath, session.User, "failed to finalize upload")
+		}
+	}()
+
 	// Close temp file
 	if err := session.TempFile.Close(); err != nil {
 		return fmt.Errorf("failed to close temp file: %w", err)
 	}
 
+	_, statErr := os.Stat(session.FilePath)
+	replaced := statErr == nil
+
+	// Keep the content being overwritten as a version (no-op when versioning is
+	// off, and versions are only kept for the default volume)
+	unarchive := func() {}
+	if session.Volume.Default {
+		_, archiveSpan := startSpan(ctx, "version.archive", "file.path", storageRelativePath(session.FilePath))
+		unarchive, err = ArchiveCurrentVersion(session.FilePath)
+		archiveSpan.RecordError(err)
+		archiveSpan.End()
+		if err != nil {
+			return fmt.Errorf("failed to archive previous version: %w", err)
+		}
+	}
+
 	// Move temp file to final location in RClone
-	if err := os.Rename(session.TempFile.Name(), session.FilePath); err != nil {
+	_, renameSpan := startSpan(ctx, "mount.rename")
+	err = os.Rename(session.TempFile.Name(), session.FilePath)
+	renameSpan.End()
+	if err != nil {
 		// If rename fails (cross-device), copy the file
-		return copyFile(session.TempFile.Name(), session.FilePath)
+		_, copySpan := startSpan(ctx, "mount.copy")
+		err = copyFile(session.TempFile.Name(), session.FilePath)
+		copySpan.RecordError(err)
+		copySpan.End()
+		if err != nil {
+			unarchive()
+			return err
+		}
 	}
 
-	log.Printf("Finalized RClone upload: %s", session.FilePath)
+	slog.Info("chunked upload finalized", "session_id", session.SessionID, "file", session.displayPath())
+
+	trackFile(session.FilePath, session.BytesReceived, session.User)
+	InvalidateThumbnails(session.displayPath())
 
-	// Invalidate stats cache after successful multipart upload
-	InvalidateStatsCache()
+	eventType := eventFileCreated
+	if replaced {
+		eventType = eventFileReplaced
+	}
+	notify(WebhookEvent{Type: eventType, Path: session.displayPath(), Size: session.BytesReceived, User: session.User})
 
 	return nil
 }
 
+// displayPath is the upload's API path, qualified by its volume
+func (s *ChunkUploadSessionRClone) displayPath() string {
+	return s.Volume.qualify(s.Volume.relative(s.FilePath))
+}
+
 // Copy file helper (for cross-device moves)
 func copyFile(src, dst string) error {
 	sourceFile, err := os.Open(src)
@@ -229,6 +378,8 @@ func copyFile(src, dst string) error {
 	defer destFile.Close()
 
 	if _, err := io.Copy(destFile, sourceFile); err != nil {
+		destFile.Close()
+		os.Remove(dst)
 		return err
 	}
 
@@ -236,6 +387,17 @@ func copyFile(src, dst string) error {
 	return os.Remove(src)
 }
 
+// removeOrphanedTempFiles deletes chunk assembly files left by a previous run.
+// Sessions only live in memory, so nothing at startup can still own them.
+func removeOrphanedTempFiles() {
+	matches, _ := filepath.Glob(filepath.Join(os.TempDir(), "rclone-upload-*"))
+	for _, match := range matches {
+		if err := os.Remove(match); err == nil {
+			slog.Info("removed orphaned upload temp file", "file", filepath.Base(match))
+		}
+	}
+}
+
 // Abort multipart upload for RClone
 func abortMultipartHandlerRClone(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -249,22 +411,14 @@ func abortMultipartHandlerRClone(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sessionsRCloneMu.Lock()
-	session, exists := uploadSessionsRClone[sessionID]
-	if exists {
-		// Close and remove temp file
-		session.TempFile.Close()
-		os.Remove(session.TempFile.Name())
-		delete(uploadSessionsRClone, sessionID)
-	}
-	sessionsRCloneMu.Unlock()
-
-	if !exists {
+	session := removeChunkedSession(sessionID)
+	if session == nil {
 		http.Error(w, "Session not found", http.StatusNotFound)
 		return
 	}
+	recentUploads.add(session, "aborted", "", requestUser(r))
 
-	log.Printf("Aborted upload session: %s", sessionID)
+	logFor(r.Context()).Info("chunked upload aborted", "session_id", sessionID)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(MultipartResponse{
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// remoteIP is the address of the peer the connection came from
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// trustedProxy reports whether ip is in server.trusted_proxies
+func trustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, entry := range currentConfig().Server.TrustedProxies {
+		if _, network, err := parseProxyCIDR(entry); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseProxyCIDR reads a server.trusted_proxies entry: a CIDR, or a single
+// address standing for itself
+func parseProxyCIDR(entry string) (net.IP, *net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+	if !strings.Contains(entry, "/") {
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+			return ip, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+		}
+	}
+	return net.ParseCIDR(entry)
+}
+
+// fromTrustedProxy reports whether the request was relayed by a proxy whose
+// forwarding headers (X-Forwarded-For, -User, -Proto) can be believed. Anyone
+// else can set those headers to whatever they like.
+func fromTrustedProxy(r *http.Request) bool {
+	return trustedProxy(remoteIP(r))
+}
+
+// requestScheme is "https" or "http", as the client sent the request: from the
+// connection, or from X-Forwarded-Proto when a trusted proxy terminated TLS
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if fromTrustedProxy(r) {
+		// A chain of proxies may each append theirs; the first is the client's
+		proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+		if proto = strings.ToLower(strings.TrimSpace(proto)); proto == "https" || proto == "http" {
+			return proto
+		}
+	}
+	return "http"
+}
+
+// clientIP is the address the request came from. X-Forwarded-For is only read
+// when the peer is a trusted proxy, and then from the right: the first entry
+// not added by a trusted proxy is the client, anything left of it could have
+// been sent by the client itself.
+func clientIP(r *http.Request) string {
+	peer := remoteIP(r)
+	if peer == nil {
+		return r.RemoteAddr
+	}
+	if !trustedProxy(peer) {
+		return peer.String()
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		peer = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+	return peer.String()
+}
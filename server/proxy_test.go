@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// setTrustedProxies installs a config trusting the given proxies for the test
+func setTrustedProxies(t *testing.T, proxies ...string) {
+	t.Helper()
+	previous := currentConfig()
+	t.Cleanup(func() { setConfig(previous, nil, nil) })
+
+	cfg := defaultConfig()
+	cfg.Server.TrustedProxies = proxies
+	setConfig(cfg, nil, nil)
+}
+
+func TestClientKeyIgnoresClientHeaders(t *testing.T) {
+	setTrustedProxies(t, "10.0.0.0/8")
+
+	for _, header := range []struct{ name, value string }{
+		{"X-User", "admin"},
+		{"X-Forwarded-User", "admin"},
+		{"X-Forwarded-For", "1.2.3.4"},
+		{"X-API-Key", "anything"},
+		{"Authorization", "Bearer anything"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/files", nil)
+		r.RemoteAddr = "203.0.113.7:51234"
+		r.Header.Set(header.name, header.value)
+		if got := clientKey(r); got != "ip:203.0.113.7" {
+			t.Errorf("%s: %s picked key %q, want the peer address", header.name, header.value, got)
+		}
+		if got := requestUser(r); got != "anonymous" {
+			t.Errorf("%s: %s made the caller %q", header.name, header.value, got)
+		}
+	}
+}
+
+func TestClientKeyBehindTrustedProxy(t *testing.T) {
+	setTrustedProxies(t, "10.0.0.0/8", "192.0.2.1")
+
+	tests := []struct {
+		name      string
+		peer      string
+		forwarded []string
+		user      string
+		want      string
+	}{
+		{"user from proxy", "10.1.2.3:443", []string{"198.51.100.4"}, "alice", "user:alice"},
+		{"client from proxy", "10.1.2.3:443", []string{"198.51.100.4"}, "", "ip:198.51.100.4"},
+		// The client can prepend whatever it likes; only the hop the proxy saw counts
+		{"spoofed prefix", "10.1.2.3:443", []string{"6.6.6.6, 198.51.100.4"}, "", "ip:198.51.100.4"},
+		{"chain of proxies", "10.1.2.3:443", []string{"6.6.6.6, 198.51.100.4, 192.0.2.1", "10.9.9.9"}, "", "ip:198.51.100.4"},
+		{"single address entry", "192.0.2.1:443", []string{"198.51.100.4"}, "", "ip:198.51.100.4"},
+		{"only proxies", "10.1.2.3:443", []string{"10.2.2.2"}, "", "ip:10.2.2.2"},
+		{"garbage hop", "10.1.2.3:443", []string{"198.51.100.4, not-an-ip"}, "", "ip:10.1.2.3"},
+		{"no header", "10.1.2.3:443", nil, "", "ip:10.1.2.3"},
+		{"untrusted lookalike", "192.0.2.2:443", []string{"198.51.100.4"}, "alice", "ip:192.0.2.2"},
+		{"ipv6 peer", "[2001:db8::1]:443", []string{"198.51.100.4"}, "", "ip:2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/files", nil)
+			r.RemoteAddr = tt.peer
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if tt.user != "" {
+				r.Header.Set("X-Forwarded-User", tt.user)
+			}
+			if got := clientKey(r); got != tt.want {
+				t.Errorf("clientKey = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateTrustedProxies(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Server.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"}
+	if err := cfg.Validate(); err != nil && strings.Contains(err.Error(), "trusted_proxies") {
+		t.Errorf("valid proxies rejected: %v", err)
+	}
+
+	cfg.Server.TrustedProxies = []string{"10.0.0.0/33", "proxy.internal"}
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), `"10.0.0.0/33"`) || !strings.Contains(err.Error(), `"proxy.internal"`) {
+		t.Errorf("invalid proxies accepted: %v", err)
+	}
+}
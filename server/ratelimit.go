@@ -0,0 +1,229 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Each client (see clientKey) gets a token bucket per route class, so one
+// script hammering uploads or stats refreshes can't starve everyone else.
+// Uploads are additionally capped by how many run at once and how many
+// chunked or direct upload sessions a client may keep open.
+var (
+	apiLimiter     = newRateLimiter("api")
+	uploadLimiter  = newRateLimiter("upload")
+	refreshLimiter = newRateLimiter("stats_refresh")
+
+	activeUploads = &concurrencyLimiter{active: make(map[string]int)}
+)
+
+// initRateLimits sizes the token buckets from rate_limit.*. It runs again on
+// every config reload; buckets keep their tokens across a change.
+func initRateLimits() {
+	limits := currentConfig().RateLimit
+	apiLimiter.configure(limits.APIPerMinute, limits.APIBurst)
+	uploadLimiter.configure(limits.UploadPerMinute, limits.UploadBurst)
+	refreshLimiter.configure(limits.StatsRefreshPerMinute, limits.StatsRefreshBurst)
+}
+
+// rateLimit applies the route's token bucket, and the concurrent upload cap on
+// routes that receive file data; rate_limit.enabled=false turns both off
+func rateLimit(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limits := currentConfig().RateLimit
+		limiter := rateLimiterFor(pattern, r)
+		if !limits.Enabled || limiter == nil {
+			next(w, r)
+			return
+		}
+
+		key := clientKey(r)
+		if ok, wait := limiter.allow(key, time.Now()); !ok {
+			tooManyRequests(w, r, limiter.name, wait, "Rate limit exceeded")
+			return
+		}
+		if receivesFileData(pattern, r) {
+			if !activeUploads.acquire(key, limits.MaxConcurrentUploads) {
+				tooManyRequests(w, r, "concurrent_uploads", 5*time.Second, "Too many concurrent uploads")
+				return
+			}
+			defer activeUploads.release(key)
+		}
+		next(w, r)
+	}
+}
+
+// rateLimiterFor picks the bucket a request draws from; health checks are never limited
+func rateLimiterFor(pattern string, r *http.Request) *rateLimiter {
+	switch {
+	case strings.HasPrefix(pattern, "/api/health"):
+		return nil
+	case pattern == "/api/stats" && r.URL.Query().Get("refresh") == "true":
+		// A forced refresh walks the whole bucket
+		return refreshLimiter
+	case pattern == "/api/upload", pattern == "/api/copy", pattern == "/api/move",
+		strings.HasPrefix(pattern, "/api/multipart/"), strings.HasPrefix(pattern, "/api/direct/"),
+		pattern == "/api/s/" && r.Method == http.MethodPost:
+		return uploadLimiter
+	default:
+		return apiLimiter
+	}
+}
+
+// receivesFileData reports whether the request body carries file content
+func receivesFileData(pattern string, r *http.Request) bool {
+	return pattern == "/api/upload" || pattern == "/api/multipart/upload-chunk" ||
+		pattern == "/api/s/" && r.Method == http.MethodPost
+}
+
+// clientKey identifies who a limit applies to: the authenticated user (client
+// certificate, or the auth proxy's X-Forwarded-User), else the client IP.
+// Neither can be picked by the client: forwarding headers only count from
+// server.trusted_proxies. API keys are never used, since nothing checks them
+// and each new value would get a fresh bucket.
+func clientKey(r *http.Request) string {
+	if user := requestUser(r); user != "anonymous" {
+		return "user:" + user
+	}
+	return "ip:" + clientIP(r)
+}
+
+// tooManyUploadSessions answers 429 and returns true if the client already
+// has rate_limit.max_upload_sessions unfinished chunked or direct uploads
+func tooManyUploadSessions(w http.ResponseWriter, r *http.Request) bool {
+	limits := currentConfig().RateLimit
+	if !limits.Enabled || openUploadSessions(clientKey(r)) < limits.MaxUploadSessions {
+		return false
+	}
+	tooManyRequests(w, r, "upload_sessions", time.Minute, "Too many unfinished uploads; complete or abort one first")
+	return true
+}
+
+// openUploadSessions counts the chunked and direct upload sessions owned by key
+func openUploadSessions(key string) int {
+	count := 0
+	sessionsRCloneMu.RLock()
+	for _, session := range uploadSessionsRClone {
+		if session.Owner == key {
+			count++
+		}
+	}
+	sessionsRCloneMu.RUnlock()
+
+	sessionsMu.RLock()
+	for _, session := range uploadSessions {
+		if session.Owner == key {
+			count++
+		}
+	}
+	sessionsMu.RUnlock()
+	return count
+}
+
+func tooManyRequests(w http.ResponseWriter, r *http.Request, reason string, retryAfter time.Duration, msg string) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	metrics.RateLimited(reason)
+	logFor(r.Context()).Debug("request rate limited", "reason", reason, "retry_after", seconds)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, msg, http.StatusTooManyRequests)
+}
+
+// rateLimiter holds one token bucket per client. Each bucket starts full with
+// burst tokens and refills at perMinute tokens a minute; a request takes one.
+type rateLimiter struct {
+	name string
+
+	mu        sync.Mutex
+	perMinute float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(name string) *rateLimiter {
+	return &rateLimiter{name: name, buckets: make(map[string]*tokenBucket)}
+}
+
+func (l *rateLimiter) configure(perMinute, burst int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.perMinute = float64(perMinute)
+	l.burst = float64(burst)
+}
+
+// allow takes a token for key, or reports how long until one is available
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	perSecond := l.perMinute / 60
+	return false, time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+}
+
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	return math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.perMinute/60)
+}
+
+// sweep forgets buckets that have refilled completely, since a new bucket
+// behaves the same; this keeps one-off clients from piling up
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// concurrencyLimiter counts running requests per client
+type concurrencyLimiter struct {
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func (c *concurrencyLimiter) acquire(key string, limit int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.active[key] >= limit {
+		return false
+	}
+	c.active[key]++
+	return true
+}
+
+func (c *concurrencyLimiter) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active[key]--
+	if c.active[key] <= 0 {
+		delete(c.active, key)
+	}
+}
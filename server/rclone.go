@@ -4,31 +4,56 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/minio/minio-go/v7"
 )
 
-// Storage mount path (Rclone mount)
-const STORAGE_MOUNT = "/storage"
+// Storage mount path (Rclone mount), set from storage.mount at startup
+var STORAGE_MOUNT = "/storage"
+
+// setStorageMount points the server, and the internal dirs kept on the mount, at mount
+func setStorageMount(mount string) {
+	STORAGE_MOUNT = mount
+	sharesDir = filepath.Join(mount, sharesDirName)
+	trashRoot = filepath.Join(mount, trashDirName)
+	uploadsDir = filepath.Join(mount, uploadsDirName)
+}
 
 // Stats cache to avoid expensive filesystem walks
 var (
 	statsCacheMu       sync.RWMutex
 	statsCache         map[string]interface{}
 	statsCacheTime     time.Time
-	statsCacheTTL      = 5 * time.Minute // Cache stats for 5 minutes
+	statsCacheRevision uint64            // usage index revision the cache was built from
 	statsCalculating   bool              // Flag to indicate if stats calculation is in progress
 	statsLastDuration  time.Duration     // Last calculation duration
 	statsBackgroundTicker *time.Ticker   // Background refresh ticker
 )
 
+// resolveStoragePath maps an API path (e.g. "/docs/a.txt") to its location
+// under the RClone mount, rejecting paths that escape the mount point
+func resolveStoragePath(requestPath string) (string, error) {
+	fullPath := filepath.Join(STORAGE_MOUNT, strings.TrimPrefix(requestPath, "/"))
+	if fullPath != STORAGE_MOUNT && !strings.HasPrefix(fullPath, STORAGE_MOUNT+"/") {
+		return "", fmt.Errorf("path %s escapes mount point %s", requestPath, STORAGE_MOUNT)
+	}
+	return fullPath, nil
+}
+
+// storageRelativePath converts a full path under the RClone mount back to an API path
+func storageRelativePath(fullPath string) string {
+	relativePath := strings.TrimPrefix(fullPath, STORAGE_MOUNT)
+	if !strings.HasPrefix(relativePath, "/") {
+		relativePath = "/" + relativePath
+	}
+	return relativePath
+}
+
 // Rclone-based list handler using POSIX operations
 func listHandlerRClone(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -36,34 +61,45 @@ func listHandlerRClone(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	vol, ok := lookupVolume(w, r.URL.Query().Get("volume"))
+	if !ok {
+		return
+	}
+
 	requestPath := r.URL.Query().Get("path")
 	if requestPath == "" {
 		requestPath = "/"
 	}
 
-	fullPath := filepath.Join(STORAGE_MOUNT, requestPath)
-
-	// Security: Ensure path doesn't escape mount point
-	if !strings.HasPrefix(fullPath, STORAGE_MOUNT) {
+	// Security: Ensure path doesn't escape the volume
+	fullPath, err := vol.resolve(requestPath)
+	if err != nil || vol.internal(fullPath) {
 		http.Error(w, "Invalid path", http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("Listing files in storage path: %s", fullPath)
+	logger := logFor(r.Context())
+	logger.Debug("listing directory", "volume", vol.Name, "dir", requestPath)
 
 	// Read directory using standard Go filesystem operations
 	entries, err := os.ReadDir(fullPath)
 	if err != nil {
-		log.Printf("Error reading directory: %v", err)
+		logger.Error("failed to read directory", "dir", requestPath, "error", err)
+		metrics.BackendError("mount_readdir")
 		http.Error(w, fmt.Sprintf("Error reading directory: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	var files []FileInfo
 	for _, entry := range entries {
+		// Version history and trash are only reachable through their own endpoints
+		if vol.Default && fullPath == STORAGE_MOUNT && isHiddenRootEntry(entry.Name()) {
+			continue
+		}
+
 		info, err := entry.Info()
 		if err != nil {
-			log.Printf("Error getting file info for %s: %v", entry.Name(), err)
+			logger.Warn("failed to stat directory entry", "name", entry.Name(), "error", err)
 			continue
 		}
 
@@ -81,11 +117,11 @@ func listHandlerRClone(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	log.Printf("Found %d items in path: %s", len(files), requestPath)
+	logger.Debug("listed directory", "dir", requestPath, "items", len(files))
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(files); err != nil {
-		log.Printf("Failed to encode response: %v", err)
+		logger.Error("failed to encode response", "error", err)
 		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
 	}
 }
@@ -100,71 +136,104 @@ func deleteHandlerRClone(w http.ResponseWriter, r *http.Request) {
 	// Get the file path from URL (e.g., /api/delete/filename)
 	filePath := strings.TrimPrefix(r.URL.Path, "/api/delete/")
 	if filePath == "" {
-		log.Printf("Delete request missing file path")
 		http.Error(w, "File path required", http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("Delete request - Original path: %s", filePath)
+	vol, ok := lookupVolume(w, r.URL.Query().Get("volume"))
+	if !ok {
+		return
+	}
+
+	logger := logFor(r.Context())
 
 	// Clean the path - remove leading slash for filepath.Join
 	filePath = strings.TrimPrefix(filePath, "/")
 
-	// Build full path
-	fullPath := filepath.Join(STORAGE_MOUNT, filePath)
-
-	log.Printf("Delete request - Full path: %s (from: %s)", fullPath, filePath)
+	// Security: Ensure path doesn't escape the volume
+	fullPath, err := vol.resolve(filePath)
+	if err != nil {
+		logger.Warn("rejected path outside volume", "volume", vol.Name, "file", filePath)
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
 
-	// Security: Ensure path doesn't escape mount point
-	if !strings.HasPrefix(fullPath, STORAGE_MOUNT) {
-		log.Printf("Security error: path %s escapes mount point %s", fullPath, STORAGE_MOUNT)
+	// The volume root and internal directories can't be deleted through this endpoint
+	if fullPath == vol.Mount || vol.internal(fullPath) {
 		http.Error(w, "Invalid path", http.StatusBadRequest)
 		return
 	}
 
+	// Move to trash unless trash is disabled or a permanent delete was requested.
+	// Trash lives on the default volume, so other volumes always delete permanently.
+	toTrash := vol.Default && trashEnabled && r.URL.Query().Get("permanent") != "true"
+	if toTrash {
+		audit(r, "delete", storageRelativePath(fullPath))
+	} else {
+		audit(r, "purge", vol.qualify(vol.relative(fullPath)))
+	}
+
 	// Check if path exists
 	info, err := os.Stat(fullPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			log.Printf("File not found: %s (checked at: %s)", filePath, fullPath)
-			// List directory contents for debugging
-			dir := filepath.Dir(fullPath)
-			if entries, readErr := os.ReadDir(dir); readErr == nil {
-				log.Printf("Directory %s contents:", dir)
-				for _, entry := range entries {
-					log.Printf("  - %s", entry.Name())
-				}
-			}
+			logger.Info("file to delete not found", "file", filePath)
 			http.Error(w, fmt.Sprintf("File not found: %s", filePath), http.StatusNotFound)
 			return
 		}
-		log.Printf("Error accessing file %s: %v", fullPath, err)
+		logger.Error("failed to stat file", "file", filePath, "error", err)
 		http.Error(w, fmt.Sprintf("Error accessing file: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Delete file or directory
-	if info.IsDir() {
+	var trashItem *TrashItem
+	if toTrash {
+		trashItem, err = moveToTrash(requestUser(r), fullPath, info)
+	} else if info.IsDir() {
 		err = os.RemoveAll(fullPath)
 	} else {
 		err = os.Remove(fullPath)
 	}
 
 	if err != nil {
-		log.Printf("Error deleting: %v", err)
+		logger.Error("failed to delete", "file", filePath, "error", err)
+		metrics.BackendError("mount_delete")
 		http.Error(w, fmt.Sprintf("Error deleting: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Successfully deleted from RClone: %s", filePath)
+	if trashItem != nil {
+		logger.Info("moved to trash", "file", filePath, "trash_id", trashItem.ID)
+	} else {
+		logger.Info("deleted", "file", filePath)
+	}
 
-	// Invalidate stats cache after successful delete
-	InvalidateStatsCache()
+	if trashItem == nil {
+		trackPath(fullPath, "")
+	}
+	InvalidateThumbnails(vol.qualify(vol.relative(fullPath)))
+
+	deleted := WebhookEvent{
+		Type:    eventFileDeleted,
+		Path:    vol.qualify(vol.relative(fullPath)),
+		IsDir:   info.IsDir(),
+		User:    requestUser(r),
+		Trashed: trashItem != nil,
+	}
+	if !info.IsDir() {
+		deleted.Size = info.Size()
+	}
+	notify(deleted)
 
 	response := map[string]interface{}{
 		"success": true,
 		"message": "File deleted successfully",
 	}
+	if trashItem != nil {
+		response["message"] = "File moved to trash"
+		response["trash_id"] = trashItem.ID
+		response["expires_at"] = trashItem.ExpiresAt
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -178,6 +247,12 @@ func statsHandlerRClone(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Per-directory breakdowns come straight from the usage index
+	if r.URL.Query().Has("path") {
+		pathStatsHandler(w, r)
+		return
+	}
+
 	// Check for force refresh parameter
 	forceRefresh := r.URL.Query().Get("refresh") == "true"
 
@@ -185,13 +260,16 @@ func statsHandlerRClone(w http.ResponseWriter, r *http.Request) {
 	statsCacheMu.RLock()
 	cachedStats := statsCache
 	cacheTime := statsCacheTime
+	cacheRevision := statsCacheRevision
 	isCalculating := statsCalculating
 	statsCacheMu.RUnlock()
 
-	// If cache exists and is fresh (not invalidated), return it
-	// Note: cacheTime.IsZero() means cache was invalidated and needs refresh
-	if !forceRefresh && cachedStats != nil && !cacheTime.IsZero() && time.Since(cacheTime) < statsCacheTTL {
-		log.Printf("Serving cached stats (age: %v)", time.Since(cacheTime))
+	// If cache exists and nothing changed since it was built, return it. After
+	// a change the stats are rebuilt from the index, which is cheap.
+	if !forceRefresh && cachedStats != nil && cacheRevision == usage.revision.Load() &&
+		time.Since(cacheTime) < currentConfig().Storage.StatsCacheTTL {
+		logFor(r.Context()).Debug("serving cached stats", "cache_age", time.Since(cacheTime).String())
+		metrics.StatsCacheResult("hit")
 
 		// Update cache age in the response
 		cachedStats["cacheAge"] = time.Since(cacheTime).String()
@@ -203,9 +281,9 @@ func statsHandlerRClone(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// If calculation already in progress in background, return stale cache if available
-	// But only if cache wasn't invalidated (not zero time)
-	if isCalculating && cachedStats != nil && !cacheTime.IsZero() {
-		log.Printf("Calculation in progress, returning stale cache")
+	if isCalculating && cachedStats != nil {
+		logFor(r.Context()).Debug("stats calculation in progress, serving stale cache")
+		metrics.StatsCacheResult("stale")
 		cachedStats["calculatingInBackground"] = true
 		cachedStats["cacheAge"] = time.Since(cacheTime).String()
 
@@ -215,152 +293,23 @@ func statsHandlerRClone(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Calculating fresh stats using MinIO API")
+	logger := logFor(r.Context())
+	logger.Info("calculating fresh stats")
+	metrics.StatsCacheResult("miss")
 
 	// Set calculating flag
 	statsCacheMu.Lock()
 	statsCalculating = true
 	statsCacheMu.Unlock()
 
-	startTime := time.Now()
-	ctx := context.Background()
-
-	var totalObjects int64
-	var totalSize int64
-	var largestFile string
-	var largestFileSize int64
-	var walkDuration time.Duration
-
-	// Try to use Admin API (DataUsageInfo) first - FASTEST!
-	if madminClient != nil {
-		log.Printf("Attempting to use MinIO Admin API (DataUsageInfo) for instant stats")
-		dataUsage, err := madminClient.DataUsageInfo(ctx)
-		if err == nil && dataUsage.BucketsUsage != nil {
-			if bucketUsage, exists := dataUsage.BucketsUsage[bucketName]; exists {
-				totalObjects = int64(bucketUsage.ObjectsCount)
-				totalSize = int64(bucketUsage.Size)
-
-				walkDuration = time.Since(startTime)
-				log.Printf("Stats retrieved in %v using Admin API - Objects: %d, Total Size: %d bytes",
-					walkDuration, totalObjects, totalSize)
-
-				// Note: Admin API doesn't provide largest file info easily
-				// We'll skip it for performance
-				largestFile = "N/A (Admin API used for speed)"
-				largestFileSize = 0
-			} else {
-				log.Printf("Bucket %s not found in DataUsageInfo, falling back to ListObjects", bucketName)
-			}
-		} else {
-			log.Printf("Admin API call failed: %v, falling back to ListObjects", err)
-		}
-	}
-
-	// If Admin API didn't work or wasn't available, use ListObjects
-	if totalObjects == 0 && totalSize == 0 {
-		log.Printf("Using MinIO ListObjects API")
-		objectCh := minioClient.ListObjects(ctx, bucketName, minio.ListObjectsOptions{
-			Recursive: true,
-		})
-
-		for object := range objectCh {
-			if object.Err != nil {
-				log.Printf("Error listing object for stats: %v", object.Err)
-				continue
-			}
-			totalObjects++
-			totalSize += object.Size
-
-			if object.Size > largestFileSize {
-				largestFileSize = object.Size
-				largestFile = object.Key
-			}
-		}
-
-		walkDuration = time.Since(startTime)
-		log.Printf("Stats calculated in %v using ListObjects API - Objects: %d, Total Size: %d bytes", walkDuration, totalObjects, totalSize)
-	}
-
-	// Store last calculation duration
-	statsCacheMu.Lock()
-	statsLastDuration = walkDuration
-	statsCalculating = false
-	statsCacheMu.Unlock()
-
-	// Format sizes for display
-	formatBytes := func(bytes int64) string {
-		const unit = 1024
-		if bytes < unit {
-			return fmt.Sprintf("%d B", bytes)
-		}
-		div, exp := int64(unit), 0
-		for n := bytes / unit; n >= unit; n /= unit {
-			div *= unit
-			exp++
-		}
-		return fmt.Sprintf("%.2f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
-	}
-
-	estimatedDiskUsage := int64(float64(totalSize) * 1.1) // Add 10% overhead
-
-	// Get bucket name from environment or use default
-	bucket := os.Getenv("STORAGE_BUCKET")
-	if bucket == "" {
-		bucket = bucketName // fallback to global variable
-	}
-
-	// Prepare largest file info
-	largestFileName := largestFile
-	if largestFileName == "" {
-		largestFileName = "N/A"
-	}
-
-	// Calculate cache age
-	cacheAge := time.Since(statsCacheTime)
-	if statsCache == nil {
-		cacheAge = 0
-	}
-
-	stats := map[string]interface{}{
-		"storage": map[string]interface{}{
-			"totalObjects":       totalObjects,
-			"totalSize":          totalSize,
-			"totalSizeFormatted": formatBytes(totalSize),
-			"estimatedDiskUsage": formatBytes(estimatedDiskUsage),
-			"averageFileSize": formatBytes(func() int64 {
-				if totalObjects > 0 {
-					return totalSize / totalObjects
-				}
-				return 0
-			}()),
-		},
-		"largestFile": map[string]interface{}{
-			"name": largestFileName,
-			"size": formatBytes(largestFileSize),
-		},
-		"bucket":            bucket,
-		"timestamp":         time.Now().Format(time.RFC3339),
-		"mountPath":         STORAGE_MOUNT,
-		"cacheEnabled":      true,
-		"cacheTTL":          statsCacheTTL.String(),
-		"calculationTime":   walkDuration.String(),
-		"cacheAge":          cacheAge.String(),
-		"calculatingInBackground": false,
-	}
-
-	// Update cache
-	statsCacheMu.Lock()
-	statsCache = stats
-	statsCacheTime = time.Now()
-	statsCacheMu.Unlock()
+	// Keep the trace, but finish the scan even if the client goes away: the result is cached
+	stats := calculateStats(context.WithoutCancel(r.Context()), logger, forceRefresh)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("X-Cache-Hit", "false")
 	if err := json.NewEncoder(w).Encode(stats); err != nil {
-		log.Printf("Error encoding stats response: %v", err)
+		logger.Error("failed to encode stats response", "error", err)
 	}
-
-	log.Printf("Stats response sent successfully (calculated in %v, cached for %v)", walkDuration, statsCacheTTL)
 }
 
 // Background stats calculation - runs periodically to keep cache fresh
@@ -368,83 +317,68 @@ func calculateStatsInBackground() {
 	statsCacheMu.Lock()
 	if statsCalculating {
 		statsCacheMu.Unlock()
-		log.Printf("Stats calculation already in progress, skipping background refresh")
+		slog.Debug("stats calculation already in progress, skipping background refresh")
 		return
 	}
 	statsCalculating = true
 	statsCacheMu.Unlock()
 
-	log.Printf("Starting background stats calculation")
+	slog.Debug("starting background stats calculation")
+	// The index is kept current as files change; listings are left to reconciliation
+	calculateStats(context.Background(), slog.Default(), false)
+}
+
+// calculateStats builds the bucket-wide stats from the usage index, listing
+// the bucket first if rescan is set or the index isn't built yet. Until it is,
+// the MinIO admin API's usage figures are used if available. The result is
+// cached and the calculating flag cleared.
+func calculateStats(ctx context.Context, logger *slog.Logger, rescan bool) map[string]interface{} {
 	startTime := time.Now()
-	ctx := context.Background()
+	revision := usage.revision.Load()
 
 	var totalObjects int64
 	var totalSize int64
 	var largestFile string
 	var largestFileSize int64
-	var duration time.Duration
+	source := "index"
 
-	// Try to use Admin API (DataUsageInfo) first - FASTEST!
-	if madminClient != nil {
-		dataUsage, err := madminClient.DataUsageInfo(ctx)
+	if !rescan && !usage.isReady() && madminClient != nil {
+		// Try the Admin API (DataUsageInfo) rather than wait for the first listing
+		logger.Debug("requesting usage from MinIO admin API")
+		dataUsage, err := dataUsageInfo(ctx)
 		if err == nil && dataUsage.BucketsUsage != nil {
 			if bucketUsage, exists := dataUsage.BucketsUsage[bucketName]; exists {
 				totalObjects = int64(bucketUsage.ObjectsCount)
 				totalSize = int64(bucketUsage.Size)
-				duration = time.Since(startTime)
-				largestFile = "N/A (Admin API used)"
-				largestFileSize = 0
-
-				log.Printf("Background stats retrieved in %v using Admin API - Objects: %d, Total Size: %d bytes",
-					duration, totalObjects, totalSize)
+				source = "admin_api"
+			} else {
+				logger.Info("bucket missing from admin usage data, falling back to listing", "bucket", bucketName)
 			}
+		} else {
+			logger.Warn("admin usage request failed, falling back to listing", "error", err)
 		}
 	}
 
-	// Fallback to ListObjects if Admin API didn't work
-	if totalObjects == 0 && totalSize == 0 {
-		objectCh := minioClient.ListObjects(ctx, bucketName, minio.ListObjectsOptions{
-			Recursive: true,
-		})
-
-		for object := range objectCh {
-			if object.Err != nil {
-				log.Printf("Error listing object for background stats: %v", object.Err)
-				continue
-			}
-			totalObjects++
-			totalSize += object.Size
-
-			if object.Size > largestFileSize {
-				largestFileSize = object.Size
-				largestFile = object.Key
+	if source != "admin_api" {
+		if rescan || !usage.isReady() {
+			logger.Debug("listing all objects for stats")
+			if err := usage.rescan(ctx); err != nil {
+				logger.Error("failed to list objects for stats", "error", err)
 			}
 		}
-
-		duration = time.Since(startTime)
-		log.Printf("Background stats calculated in %v using ListObjects - Objects: %d, Total Size: %d bytes", duration, totalObjects, totalSize)
+		revision = usage.revision.Load()
+		totalObjects, totalSize, largestFile, largestFileSize = usage.totals()
 	}
 
-	// Format sizes
-	formatBytes := func(bytes int64) string {
-		const unit = 1024
-		if bytes < unit {
-			return fmt.Sprintf("%d B", bytes)
-		}
-		div, exp := int64(unit), 0
-		for n := bytes / unit; n >= unit; n /= unit {
-			div *= unit
-			exp++
-		}
-		return fmt.Sprintf("%.2f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
-	}
+	walkDuration := time.Since(startTime)
+	logger.Info("stats calculated", "source", source,
+		"duration_ms", walkDuration.Milliseconds(), "objects", totalObjects, "bytes", totalSize)
 
-	estimatedDiskUsage := int64(float64(totalSize) * 1.1)
-	bucket := os.Getenv("STORAGE_BUCKET")
-	if bucket == "" {
-		bucket = bucketName
-	}
+	estimatedDiskUsage := int64(float64(totalSize) * 1.1) // Add 10% overhead
 
+	bucket := currentConfig().Storage.Bucket
+
+	// Prepare largest file info
 	largestFileName := largestFile
 	if largestFileName == "" {
 		largestFileName = "N/A"
@@ -467,12 +401,14 @@ func calculateStatsInBackground() {
 			"name": largestFileName,
 			"size": formatBytes(largestFileSize),
 		},
+		"users":                   usage.userTotals(),
 		"bucket":                  bucket,
+		"source":                  source,
 		"timestamp":               time.Now().Format(time.RFC3339),
 		"mountPath":               STORAGE_MOUNT,
 		"cacheEnabled":            true,
-		"cacheTTL":                statsCacheTTL.String(),
-		"calculationTime":         duration.String(),
+		"cacheTTL":                currentConfig().Storage.StatsCacheTTL.String(),
+		"calculationTime":         walkDuration.String(),
 		"cacheAge":                "0s",
 		"calculatingInBackground": false,
 	}
@@ -481,11 +417,26 @@ func calculateStatsInBackground() {
 	statsCacheMu.Lock()
 	statsCache = stats
 	statsCacheTime = time.Now()
-	statsLastDuration = duration
+	statsCacheRevision = revision
+	statsLastDuration = walkDuration
 	statsCalculating = false
 	statsCacheMu.Unlock()
 
-	log.Printf("Background stats cache updated successfully")
+	return stats
+}
+
+// formatBytes renders a size for display, e.g. "1.50 GB"
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
 
 // Start background stats refresh - called once on server startup
@@ -493,23 +444,20 @@ func startBackgroundStatsRefresh() {
 	// Initial calculation
 	go calculateStatsInBackground()
 
-	// Periodic refresh every 5 minutes
-	statsBackgroundTicker = time.NewTicker(5 * time.Minute)
+	// Periodic refresh (storage.stats_refresh_interval)
+	interval := currentConfig().Storage.StatsRefreshInterval
+	statsBackgroundTicker = time.NewTicker(interval)
 	go func() {
-		for range statsBackgroundTicker.C {
-			calculateStatsInBackground()
+		defer statsBackgroundTicker.Stop()
+		for {
+			select {
+			case <-statsBackgroundTicker.C:
+				calculateStatsInBackground()
+			case <-backgroundCtx.Done():
+				return
+			}
 		}
 	}()
 
-	log.Printf("Background stats refresh started (every 5 minutes)")
-}
-
-// InvalidateStatsCache invalidates the stats cache - call after file uploads/deletes
-func InvalidateStatsCache() {
-	statsCacheMu.Lock()
-	defer statsCacheMu.Unlock()
-
-	// Reset cache time to force refresh on next request
-	statsCacheTime = time.Time{}
-	log.Printf("Stats cache invalidated")
+	slog.Info("background stats refresh started", "interval", interval.String())
 }
@@ -0,0 +1,691 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Hidden directory at the root of the mount holding share definitions
+const sharesDirName = ".shares"
+
+// Share modes
+const (
+	ShareModeRead   = "read"   // download / browse only
+	ShareModeUpload = "upload" // upload into a folder, no browsing
+)
+
+// Share is a public link to a file or folder
+type Share struct {
+	ID            string     `json:"id"`
+	Path          string     `json:"path"`
+	IsDir         bool       `json:"is_dir"`
+	Mode          string     `json:"mode"`
+	CreatedBy     string     `json:"created_by"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	MaxDownloads  int        `json:"max_downloads,omitempty"`
+	DownloadCount int        `json:"download_count"`
+	PasswordHash  string     `json:"password_hash,omitempty"`
+	UploadCount   int        `json:"upload_count,omitempty"`
+	UploadedBytes int64      `json:"uploaded_bytes,omitempty"`
+	Token         string     `json:"-"`
+	FileRequestOptions
+}
+
+// CreateShareRequest is the body of POST /api/share
+type CreateShareRequest struct {
+	Path         string `json:"path"`
+	Mode         string `json:"mode,omitempty"`
+	ExpiresIn    string `json:"expires_in,omitempty"` // e.g. "72h"
+	Password     string `json:"password,omitempty"`
+	MaxDownloads int    `json:"max_downloads,omitempty"`
+	FileRequestOptions
+}
+
+// ShareResponse is a share as returned to its owner (never includes the password hash)
+type ShareResponse struct {
+	ID            string     `json:"id"`
+	Token         string     `json:"token"`
+	URL           string     `json:"url"`
+	Path          string     `json:"path"`
+	IsDir         bool       `json:"is_dir"`
+	Mode          string     `json:"mode"`
+	CreatedBy     string     `json:"created_by"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	MaxDownloads  int        `json:"max_downloads,omitempty"`
+	DownloadCount int        `json:"download_count"`
+	HasPassword   bool       `json:"has_password"`
+	UploadCount   int        `json:"upload_count,omitempty"`
+	UploadedBytes int64      `json:"uploaded_bytes,omitempty"`
+	FileRequestOptions
+}
+
+var (
+	sharesMu    sync.Mutex
+	shares      = make(map[string]*Share) // id -> share
+	sharesDir   = filepath.Join(STORAGE_MOUNT, sharesDirName)
+	shareSecret []byte
+)
+
+// Wrong share passwords lock the share for everyone for shareLockout once
+// there have been sharePasswordAttempts of them within shareLockout, so a
+// password can't be guessed by rotating clients past the rate limiter
+const (
+	sharePasswordAttempts = 10
+	shareLockout          = 15 * time.Minute
+)
+
+// shareResumeWindow is how long a client that started a counted download may
+// resume it with Range requests after the share's download limit is reached
+const shareResumeWindow = 24 * time.Hour
+
+var (
+	sharePasswordMu       sync.Mutex
+	sharePasswordFailures = make(map[string]*passwordFailures) // share id -> recent wrong passwords
+
+	// shareDownloaders remembers who started a counted download of each
+	// share (share id -> client -> when). Guarded by sharesMu.
+	shareDownloaders = make(map[string]map[string]time.Time)
+)
+
+type passwordFailures struct {
+	count       int
+	since       time.Time
+	lockedUntil time.Time
+}
+
+// initShares loads the signing secret and persisted shares from the mount
+func initShares() error {
+	if err := os.MkdirAll(sharesDir, 0700); err != nil {
+		return fmt.Errorf("failed to create shares dir: %w", err)
+	}
+
+	secret, err := loadShareSecret()
+	if err != nil {
+		return err
+	}
+	shareSecret = secret
+
+	entries, err := os.ReadDir(sharesDir)
+	if err != nil {
+		return fmt.Errorf("failed to read shares dir: %w", err)
+	}
+
+	sharesMu.Lock()
+	defer sharesMu.Unlock()
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(sharesDir, entry.Name()))
+		if err != nil {
+			slog.Warn("skipping unreadable share", "file", entry.Name(), "error", err)
+			continue
+		}
+		var share Share
+		if err := json.Unmarshal(data, &share); err != nil {
+			slog.Warn("skipping invalid share", "file", entry.Name(), "error", err)
+			continue
+		}
+		share.Token = signShareID(share.ID)
+		shares[share.ID] = &share
+	}
+
+	slog.Info("share links initialized", "active", len(shares))
+	return nil
+}
+
+// loadShareSecret uses shares.secret, or a random secret persisted next to the shares
+// so links keep working across restarts and replicas
+func loadShareSecret() ([]byte, error) {
+	if secret := currentConfig().Shares.Secret; secret != "" {
+		return []byte(secret), nil
+	}
+
+	secretPath := filepath.Join(sharesDir, ".secret")
+	if data, err := os.ReadFile(secretPath); err == nil && len(data) >= 32 {
+		return data, nil
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate share secret: %w", err)
+	}
+	if err := os.WriteFile(secretPath, secret, 0600); err != nil {
+		return nil, fmt.Errorf("failed to persist share secret: %w", err)
+	}
+	slog.Info("generated new share signing secret (set SHARE_SECRET to manage it yourself)")
+	return secret, nil
+}
+
+// signShareID builds the public token "<id>.<signature>"
+func signShareID(id string) string {
+	mac := hmac.New(sha256.New, shareSecret)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// lookupShareToken verifies a token's signature and returns its share
+func lookupShareToken(token string) (*Share, bool) {
+	id, _, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signShareID(id)), []byte(token)) {
+		return nil, false
+	}
+	sharesMu.Lock()
+	defer sharesMu.Unlock()
+	share, exists := shares[id]
+	return share, exists
+}
+
+func newShareID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// saveShare persists a share. Caller holds sharesMu.
+func saveShare(share *Share) error {
+	data, err := json.MarshalIndent(share, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(sharesDir, share.ID+".json"), data, 0600)
+}
+
+// deleteShare removes a share. Caller holds sharesMu.
+func deleteShare(id string) error {
+	delete(shares, id)
+	delete(shareDownloaders, id)
+	sharePasswordMu.Lock()
+	delete(sharePasswordFailures, id)
+	sharePasswordMu.Unlock()
+	if err := os.Remove(filepath.Join(sharesDir, id+".json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *Share) expired(now time.Time) bool {
+	return s.ExpiresAt != nil && now.After(*s.ExpiresAt)
+}
+
+func (s *Share) response(r *http.Request) ShareResponse {
+	baseURL := strings.TrimSuffix(currentConfig().Shares.PublicBaseURL, "/")
+	if baseURL == "" {
+		baseURL = requestScheme(r) + "://" + r.Host
+	}
+	return ShareResponse{
+		ID:                 s.ID,
+		Token:              s.Token,
+		URL:                baseURL + "/api/s/" + s.Token,
+		Path:               s.Path,
+		IsDir:              s.IsDir,
+		Mode:               s.Mode,
+		CreatedBy:          s.CreatedBy,
+		CreatedAt:          s.CreatedAt,
+		ExpiresAt:          s.ExpiresAt,
+		MaxDownloads:       s.MaxDownloads,
+		DownloadCount:      s.DownloadCount,
+		HasPassword:        s.PasswordHash != "",
+		UploadCount:        s.UploadCount,
+		UploadedBytes:      s.UploadedBytes,
+		FileRequestOptions: s.FileRequestOptions,
+	}
+}
+
+// shareHandler manages share links (/api/share):
+//
+//	POST           create a share
+//	GET            list the caller's shares
+//	DELETE ?id=    revoke a share
+func shareHandler(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+
+	switch r.Method {
+	case http.MethodPost:
+		var req CreateShareRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeBodyError(w, err, "Invalid request body")
+			return
+		}
+
+		event := audit(r, "share", req.Path)
+		share, status, err := createShare(user, req)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		event.Path, event.ShareID = share.Path, share.ID
+		logFor(r.Context()).Info("share created", "share_id", share.ID, "mode", share.Mode, "file", share.Path)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(share.response(r))
+
+	case http.MethodGet:
+		sharesMu.Lock()
+		list := []ShareResponse{}
+		for _, share := range shares {
+			if share.CreatedBy == user {
+				list = append(list, share.response(r))
+			}
+		}
+		sharesMu.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		event := audit(r, "unshare", "")
+		event.ShareID = id
+
+		sharesMu.Lock()
+		share, exists := shares[id]
+		if !exists || share.CreatedBy != user {
+			sharesMu.Unlock()
+			http.Error(w, "Share not found", http.StatusNotFound)
+			return
+		}
+		event.Path = share.Path
+		err := deleteShare(id)
+		sharesMu.Unlock()
+		if err != nil {
+			logFor(r.Context()).Error("failed to revoke share", "share_id", id, "error", err)
+			http.Error(w, "Failed to revoke share", http.StatusInternalServerError)
+			return
+		}
+		logFor(r.Context()).Info("share revoked", "share_id", id)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"message": "Share revoked",
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createShare validates a request and stores the new share, returning an HTTP status on failure
+func createShare(user string, req CreateShareRequest) (*Share, int, error) {
+	fullPath, err := resolveStoragePath(req.Path)
+	if err != nil || req.Path == "" || isInternalPath(fullPath) {
+		return nil, http.StatusBadRequest, fmt.Errorf("Invalid path")
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, http.StatusNotFound, fmt.Errorf("File not found: %s", req.Path)
+	}
+
+	mode := req.Mode
+	if mode == "" {
+		mode = ShareModeRead
+	}
+	if mode != ShareModeRead && mode != ShareModeUpload {
+		return nil, http.StatusBadRequest, fmt.Errorf("Invalid mode %q (expected read or upload)", mode)
+	}
+	if mode == ShareModeUpload && !info.IsDir() {
+		return nil, http.StatusBadRequest, fmt.Errorf("Upload shares must point to a folder")
+	}
+	if req.MaxDownloads < 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("Invalid max_downloads")
+	}
+	if err := validateFileRequestOptions(req.FileRequestOptions, mode); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	id, err := newShareID()
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("Failed to create share")
+	}
+	share := &Share{
+		ID:           id,
+		Path:         storageRelativePath(fullPath),
+		IsDir:        info.IsDir(),
+		Mode:         mode,
+		CreatedBy:    user,
+		CreatedAt:    time.Now(),
+		MaxDownloads: req.MaxDownloads,
+		Token:        signShareID(id),
+
+		FileRequestOptions: req.FileRequestOptions,
+	}
+
+	if req.ExpiresIn != "" {
+		expiresIn, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || expiresIn <= 0 {
+			return nil, http.StatusBadRequest, fmt.Errorf("Invalid expires_in")
+		}
+		expiresAt := share.CreatedAt.Add(expiresIn)
+		share.ExpiresAt = &expiresAt
+	}
+
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("Invalid password")
+		}
+		share.PasswordHash = string(hash)
+	}
+
+	sharesMu.Lock()
+	defer sharesMu.Unlock()
+	if err := saveShare(share); err != nil {
+		slog.Error("failed to persist share", "share_id", share.ID, "error", err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("Failed to create share")
+	}
+	shares[share.ID] = share
+	return share, http.StatusCreated, nil
+}
+
+// publicShareHandler serves share links without authentication (/api/s/{token}[/sub/path]):
+//
+//	GET    file share        download the file
+//	GET    folder share      list the folder, or download a file below it
+//	POST   upload share      upload a file ("file" form field) into the folder
+//
+// Upload shares are file requests: holders can only add files, never list or download.
+// Large files use /api/multipart/* with the token in X-Share-Token.
+// The password, if any, is sent as X-Share-Password (or a "password" query value).
+func publicShareHandler(w http.ResponseWriter, r *http.Request) {
+	token, subPath, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/s/"), "/")
+
+	share, ok := authorizeShare(w, r, token)
+	if !ok {
+		return
+	}
+
+	rootPath, err := resolveStoragePath(share.Path)
+	if err != nil {
+		http.Error(w, "Share link not found or expired", http.StatusNotFound)
+		return
+	}
+
+	// Sub paths are only meaningful for folder shares and must stay inside the folder
+	targetPath := rootPath
+	if subPath != "" {
+		if !share.IsDir {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		targetPath = filepath.Join(rootPath, subPath)
+		if (targetPath != rootPath && !strings.HasPrefix(targetPath, rootPath+"/")) || isInternalPath(targetPath) {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodGet && share.Mode == ShareModeRead:
+		servePublicShareRead(w, r, share, rootPath, targetPath)
+	case r.Method == http.MethodPost && share.Mode == ShareModeUpload && targetPath == rootPath:
+		servePublicShareUpload(w, r, share, rootPath)
+	case r.Method == http.MethodGet || r.Method == http.MethodPost:
+		http.Error(w, "Not allowed for this share", http.StatusForbidden)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// authorizeShare checks a share token and its password, writing the error response on failure
+func authorizeShare(w http.ResponseWriter, r *http.Request, token string) (*Share, bool) {
+	share, ok := lookupShareToken(token)
+	if !ok || share.expired(time.Now()) {
+		// Same answer for unknown, forged and expired links
+		http.Error(w, "Share link not found or expired", http.StatusNotFound)
+		return nil, false
+	}
+
+	if share.PasswordHash != "" {
+		if wait := sharePasswordLocked(share.ID, time.Now()); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			http.Error(w, "Too many wrong passwords, try again later", http.StatusTooManyRequests)
+			return nil, false
+		}
+		password := r.Header.Get("X-Share-Password")
+		if password == "" {
+			password = r.URL.Query().Get("password")
+		}
+		if bcrypt.CompareHashAndPassword([]byte(share.PasswordHash), []byte(password)) != nil {
+			// Asking without a password is the prompt, not a guess
+			if password != "" && recordSharePasswordFailure(share.ID, time.Now()) {
+				logFor(r.Context()).Warn("share locked after repeated wrong passwords",
+					"share_id", share.ID, "lockout", shareLockout.String())
+			}
+			w.Header().Set("WWW-Authenticate", `Share-Password realm="share"`)
+			http.Error(w, "Password required", http.StatusUnauthorized)
+			return nil, false
+		}
+		sharePasswordMu.Lock()
+		delete(sharePasswordFailures, share.ID)
+		sharePasswordMu.Unlock()
+	}
+	return share, true
+}
+
+// sharePasswordLocked returns how long the share refuses password attempts
+func sharePasswordLocked(id string, now time.Time) time.Duration {
+	sharePasswordMu.Lock()
+	defer sharePasswordMu.Unlock()
+	if f, ok := sharePasswordFailures[id]; ok && now.Before(f.lockedUntil) {
+		return f.lockedUntil.Sub(now)
+	}
+	return 0
+}
+
+// recordSharePasswordFailure counts a wrong password and reports whether it locked the share
+func recordSharePasswordFailure(id string, now time.Time) bool {
+	sharePasswordMu.Lock()
+	defer sharePasswordMu.Unlock()
+	f, ok := sharePasswordFailures[id]
+	if !ok || now.Sub(f.since) > shareLockout {
+		f = &passwordFailures{since: now}
+		sharePasswordFailures[id] = f
+	}
+	f.count++
+	if f.count < sharePasswordAttempts {
+		return false
+	}
+	f.count, f.since, f.lockedUntil = 0, now, now.Add(shareLockout)
+	return true
+}
+
+// initialRange reports whether a request asks for the file from its first
+// byte: no Range at all, or a range starting at 0. Other ranges resume or
+// seek within a download that was already counted.
+func initialRange(r *http.Request) bool {
+	spec, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes=")
+	if !ok {
+		return true
+	}
+	first, _, _ := strings.Cut(spec, ",")
+	start, _, _ := strings.Cut(first, "-")
+	return strings.TrimSpace(start) == "0"
+}
+
+func servePublicShareRead(w http.ResponseWriter, r *http.Request, share *Share, rootPath, targetPath string) {
+	info, err := os.Stat(targetPath)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	if info.IsDir() {
+		entries, err := os.ReadDir(targetPath)
+		if err != nil {
+			logFor(r.Context()).Error("failed to read shared directory", "share_id", share.ID, "dir", storageRelativePath(targetPath), "error", err)
+			http.Error(w, "Error reading directory", http.StatusInternalServerError)
+			return
+		}
+		files := []FileInfo{}
+		for _, entry := range entries {
+			entryInfo, err := entry.Info()
+			if err != nil || isInternalPath(filepath.Join(targetPath, entry.Name())) {
+				continue
+			}
+			// Paths are relative to the share so the owner's folder layout isn't exposed
+			files = append(files, FileInfo{
+				Name:     entry.Name(),
+				Path:     "/" + strings.TrimPrefix(filepath.Join(strings.TrimPrefix(targetPath, rootPath), entry.Name()), "/"),
+				IsDir:    entry.IsDir(),
+				Size:     entryInfo.Size(),
+				Modified: entryInfo.ModTime(),
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"name":  filepath.Base(rootPath),
+			"files": files,
+		})
+		return
+	}
+
+	event := audit(r, "download", storageRelativePath(targetPath))
+	event.ShareID, event.Size = share.ID, info.Size()
+
+	// Count the download up front so concurrent requests can't exceed the limit.
+	// Only requests from the first byte count; seeking and resuming don't, and
+	// stay open to clients that started a download after the limit is reached.
+	now := time.Now()
+	client := clientKey(r)
+	sharesMu.Lock()
+	counted := initialRange(r)
+	limitReached := share.MaxDownloads > 0 && share.DownloadCount >= share.MaxDownloads
+	if limitReached && (counted || now.Sub(shareDownloaders[share.ID][client]) > shareResumeWindow) {
+		sharesMu.Unlock()
+		http.Error(w, "Download limit reached", http.StatusGone)
+		return
+	}
+	if counted {
+		share.DownloadCount++
+		if err := saveShare(share); err != nil {
+			logFor(r.Context()).Error("failed to persist share download count", "share_id", share.ID, "error", err)
+		}
+		rememberShareDownloader(share.ID, client, now)
+	}
+	count := share.DownloadCount
+	sharesMu.Unlock()
+
+	if counted {
+		logFor(r.Context()).Info("share download", "share_id", share.ID, "count", count, "file", storageRelativePath(targetPath))
+	}
+	serveMountFile(w, r, targetPath)
+}
+
+func servePublicShareUpload(w http.ResponseWriter, r *http.Request, share *Share, targetDir string) {
+	if refuseWhileDraining(w) {
+		return
+	}
+
+	// Reject oversized bodies before they are spooled to disk (allow some form overhead)
+	shareLimit := share.MaxFileSize + formOverhead
+	if share.MaxFileSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, shareLimit)
+	}
+	if err := parseMultipartForm(r, 100<<20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) && share.MaxFileSize > 0 && tooLarge.Limit == shareLimit {
+			writeFileRequestError(w, errFileRequestTooLarge)
+			return
+		}
+		writeBodyError(w, err, "Failed to parse form")
+		return
+	}
+	file, handler, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Failed to get file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if !allowedFileType(handler.Filename) {
+		writeFileTypeNotAllowed(w)
+		return
+	}
+
+	n, err := reserveShareUpload(share, handler.Size)
+	if err != nil {
+		writeFileRequestError(w, err)
+		return
+	}
+
+	// Anonymous uploaders never overwrite existing content
+	filename := fileRequestName(share, filepath.Base(handler.Filename), n, time.Now())
+	event := audit(r, "upload", storageRelativePath(filepath.Join(targetDir, filename)))
+	event.ShareID, event.Size = share.ID, handler.Size
+
+	response, err := saveUploadRClone(r.Context(), defaultVolume(), share.CreatedBy, file, filepath.Join(targetDir, filename), "rename")
+	if err != nil {
+		releaseShareUpload(share)
+		logFor(r.Context()).Error("share upload failed", "share_id", share.ID, "error", err)
+		writeFileRequestError(w, err)
+		return
+	}
+	completeShareUpload(share, response.Path, handler.Size)
+	event.Path = response.Path
+
+	// Don't reveal where the folder lives
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"name":    filepath.Base(response.Path),
+		"message": "File uploaded successfully",
+	})
+}
+
+// rememberShareDownloader records a counted download, forgetting those past
+// shareResumeWindow. Caller holds sharesMu.
+func rememberShareDownloader(id, client string, now time.Time) {
+	downloaders := shareDownloaders[id]
+	if downloaders == nil {
+		downloaders = make(map[string]time.Time)
+		shareDownloaders[id] = downloaders
+	}
+	for key, at := range downloaders {
+		if now.Sub(at) > shareResumeWindow {
+			delete(downloaders, key)
+		}
+	}
+	downloaders[client] = now
+}
+
+// serveMountFile streams a file from the RClone mount as a download, with Range support
+func serveMountFile(w http.ResponseWriter, r *http.Request, fullPath string) {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, "Failed to get file info", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", info.Name()))
+	http.ServeContent(metrics.CountDownload(w), r, info.Name(), info.ModTime(), file)
+}
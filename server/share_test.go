@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// addShare registers share for the test, with its file at share.Path on a temp mount
+func addShare(t *testing.T, share *Share, content string) string {
+	t.Helper()
+	dir := setupUploadVolume(t)
+	if err := os.MkdirAll(sharesDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	fullPath := filepath.Join(dir, share.Path)
+	writeFile(t, fullPath, content)
+
+	sharesMu.Lock()
+	shares[share.ID] = share
+	sharesMu.Unlock()
+	t.Cleanup(func() {
+		sharesMu.Lock()
+		deleteShare(share.ID)
+		sharesMu.Unlock()
+	})
+	return fullPath
+}
+
+func TestShareDownloadLimit(t *testing.T) {
+	share := &Share{ID: "limited", Path: "/report.txt", Mode: ShareModeRead, MaxDownloads: 2}
+	fullPath := addShare(t, share, "0123456789")
+
+	steps := []struct {
+		name   string
+		client string
+		rng    string
+		status int
+		count  int
+	}{
+		{"first download", "alice", "", http.StatusOK, 1},
+		{"resume isn't counted", "alice", "bytes=5-", http.StatusPartialContent, 1},
+		{"range from the start counts", "bob", "bytes=0-3", http.StatusPartialContent, 2},
+		{"limit reached", "carol", "", http.StatusGone, 2},
+		{"can't resume what wasn't started", "carol", "bytes=5-", http.StatusGone, 2},
+		{"started downloads resume", "alice", "bytes=5-", http.StatusPartialContent, 2},
+		{"starting over counts", "bob", "bytes=0-", http.StatusGone, 2},
+	}
+	for _, step := range steps {
+		r := httptest.NewRequest(http.MethodGet, "/api/s/token", nil)
+		r.RemoteAddr = map[string]string{"alice": "198.51.100.1:1000", "bob": "198.51.100.2:1000", "carol": "198.51.100.3:1000"}[step.client]
+		if step.rng != "" {
+			r.Header.Set("Range", step.rng)
+		}
+		rec := httptest.NewRecorder()
+		servePublicShareRead(rec, r, share, fullPath, fullPath)
+		if rec.Code != step.status || share.DownloadCount != step.count {
+			t.Errorf("%s: status %d, count %d; want %d, %d", step.name, rec.Code, share.DownloadCount, step.status, step.count)
+		}
+	}
+
+	// Past the resume window, even alice is turned away
+	sharesMu.Lock()
+	shareDownloaders[share.ID]["ip:198.51.100.1"] = time.Now().Add(-shareResumeWindow - time.Minute)
+	sharesMu.Unlock()
+	r := httptest.NewRequest(http.MethodGet, "/api/s/token", nil)
+	r.RemoteAddr = "198.51.100.1:1000"
+	r.Header.Set("Range", "bytes=5-")
+	rec := httptest.NewRecorder()
+	servePublicShareRead(rec, r, share, fullPath, fullPath)
+	if rec.Code != http.StatusGone {
+		t.Errorf("resume after the window: status %d, want 410", rec.Code)
+	}
+}
+
+func TestInitialRange(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		want   bool
+	}{
+		{"", true},
+		{"bytes=0-", true},
+		{"bytes=0-99", true},
+		{"bytes= 0-99", true},
+		{"bytes=0-9, 50-", true},
+		{"bytes=100-", false},
+		{"bytes=-500", false},
+		{"bytes=50-60, 0-9", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/s/token", nil)
+		if tt.header != "" {
+			r.Header.Set("Range", tt.header)
+		}
+		if got := initialRange(r); got != tt.want {
+			t.Errorf("Range %q: initial = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestRecordSharePasswordFailure(t *testing.T) {
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		spacing time.Duration // between wrong passwords
+		tries   int
+		locked  bool
+	}{
+		{"below the limit", time.Second, sharePasswordAttempts - 1, false},
+		{"at the limit", time.Second, sharePasswordAttempts, true},
+		{"spread past the window", shareLockout/sharePasswordAttempts + time.Minute, sharePasswordAttempts, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := "share-" + tt.name
+			t.Cleanup(func() {
+				sharePasswordMu.Lock()
+				delete(sharePasswordFailures, id)
+				sharePasswordMu.Unlock()
+			})
+			now := start
+			locked := false
+			for i := 0; i < tt.tries; i++ {
+				if recordSharePasswordFailure(id, now) {
+					if i != sharePasswordAttempts-1 {
+						t.Errorf("locked after %d wrong passwords", i+1)
+					}
+					locked = true
+				}
+				now = now.Add(tt.spacing)
+			}
+			last := now.Add(-tt.spacing)
+			if wait := sharePasswordLocked(id, last); (wait > 0) != tt.locked || locked != tt.locked {
+				t.Fatalf("locked = %v for %v, want %v", locked, wait, tt.locked)
+			}
+			if tt.locked {
+				if wait := sharePasswordLocked(id, last); wait != shareLockout {
+					t.Errorf("locked for %v, want %v", wait, shareLockout)
+				}
+				if wait := sharePasswordLocked(id, last.Add(shareLockout)); wait != 0 {
+					t.Errorf("still locked %v after the lockout", wait)
+				}
+				// A fresh run of guesses is needed to lock it again
+				if recordSharePasswordFailure(id, last.Add(shareLockout)) {
+					t.Error("locked again by a single wrong password")
+				}
+			}
+		})
+	}
+}
+
+func TestAuthorizeShareLockout(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("open sesame"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	share := &Share{ID: "guarded", Path: "/report.txt", Mode: ShareModeRead, PasswordHash: string(hash)}
+	addShare(t, share, "secret")
+	previous := shareSecret
+	t.Cleanup(func() { shareSecret = previous })
+	shareSecret = []byte("test secret")
+	token := signShareID(share.ID)
+
+	try := func(password string) int {
+		r := httptest.NewRequest(http.MethodGet, "/api/s/"+token, nil)
+		if password != "" {
+			r.Header.Set("X-Share-Password", password)
+		}
+		rec := httptest.NewRecorder()
+		authorizeShare(rec, r, token)
+		return rec.Code
+	}
+
+	// Asking without a password is the prompt, not a guess
+	for i := 0; i < 2*sharePasswordAttempts; i++ {
+		try("")
+	}
+	for i := 0; i < sharePasswordAttempts-1; i++ {
+		if status := try("wrong"); status != http.StatusUnauthorized {
+			t.Fatalf("wrong password %d: status %d", i+1, status)
+		}
+	}
+	// The right password clears the failures
+	if status := try("open sesame"); status != http.StatusOK {
+		t.Fatalf("right password: status %d", status)
+	}
+	for i := 0; i < sharePasswordAttempts-1; i++ {
+		if status := try("wrong"); status != http.StatusUnauthorized {
+			t.Fatalf("wrong password %d after the right one: status %d", i+1, status)
+		}
+	}
+	try("wrong")
+	// Locked for everyone, even with the right password
+	if status := try("open sesame"); status != http.StatusTooManyRequests {
+		t.Errorf("right password while locked: status %d, want 429", status)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+)
+
+// uploadsDirName holds direct upload sessions saved across restarts
+const uploadsDirName = ".uploads"
+
+var uploadsDir = filepath.Join(STORAGE_MOUNT, uploadsDirName)
+
+// backgroundCtx is cancelled at shutdown to stop the periodic jobs
+var backgroundCtx, stopBackground = context.WithCancel(context.Background())
+
+var (
+	// draining is set once shutdown starts: new uploads are refused while
+	// requests already in flight (including chunked uploads) may finish
+	draining atomic.Bool
+	inflight sync.WaitGroup
+)
+
+// trackInflight counts running handlers so shutdown can wait for them even
+// after their connections have been force-closed
+func trackInflight(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		inflight.Add(1)
+		defer inflight.Done()
+		next(w, r)
+	}
+}
+
+// acceptingUploads refuses to start new uploads once shutdown has begun
+func acceptingUploads(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions && refuseWhileDraining(w) {
+			return
+		}
+		next(w, r)
+	}
+}
+
+// refuseWhileDraining answers 503 and returns true if shutdown has begun
+func refuseWhileDraining(w http.ResponseWriter) bool {
+	if !draining.Load() {
+		return false
+	}
+	w.Header().Set("Retry-After", "30")
+	http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+	return true
+}
+
+// checkNotDraining fails readiness during shutdown so load balancers move on
+func checkNotDraining(ctx context.Context) (map[string]any, error) {
+	if draining.Load() {
+		return nil, errors.New("server is shutting down")
+	}
+	return nil, nil
+}
+
+// serve runs server until SIGTERM or SIGINT, then shuts down gracefully. It
+// serves HTTPS when the server has a TLS config.
+func serve(server *http.Server) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	errCh := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			// Certificates come from server.TLSConfig
+			errCh <- server.ListenAndServeTLS("", "")
+			return
+		}
+		errCh <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdown(server, currentConfig().Server.ShutdownTimeout)
+	return nil
+}
+
+// shutdown stops accepting requests, waits up to timeout for in-flight ones,
+// then cleans up upload sessions and flushes telemetry
+func shutdown(server *http.Server, timeout time.Duration) {
+	slog.Info("shutting down", "timeout", timeout.String())
+	draining.Store(true)
+	stopBackground()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("in-flight requests did not finish in time, closing connections", "error", err)
+		server.Close()
+	}
+
+	// Handlers of closed connections fail their next read or write and return quickly
+	done := make(chan struct{})
+	go func() {
+		inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		slog.Warn("handlers still running after connections were closed")
+	}
+
+	abortChunkedSessions()
+	if err := persistDirectSessions(); err != nil {
+		slog.Error("failed to save direct upload sessions, aborting them", "error", err)
+		abortDirectSessions()
+	}
+	if err := usage.syncOwners(); err != nil {
+		slog.Error("failed to save file owners", "error", err)
+	}
+
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFlush()
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Warn("failed to flush traces", "error", err)
+	}
+	closeAudit()
+	webhooks.release()
+
+	slog.Info("shutdown complete")
+}
+
+// abortChunkedSessions removes the temp files of unfinished chunked uploads.
+// They live on local disk, which doesn't survive the pod, so they can't be resumed.
+func abortChunkedSessions() {
+	sessionsRCloneMu.Lock()
+	defer sessionsRCloneMu.Unlock()
+
+	for id, session := range uploadSessionsRClone {
+		session.mu.Lock()
+		session.TempFile.Close()
+		os.Remove(session.TempFile.Name())
+		session.mu.Unlock()
+		if session.Share != nil {
+			releaseShareUpload(session.Share)
+		}
+		delete(uploadSessionsRClone, id)
+		slog.Info("chunked upload aborted by shutdown", "session_id", id, "file", session.displayPath())
+	}
+}
+
+// persistDirectSessions saves direct upload sessions to the mount. Their parts
+// are already in MinIO, so clients can still complete them after a restart.
+// Each process writes its own file so replicas don't overwrite each other.
+func persistDirectSessions() error {
+	sessionsMu.RLock()
+	defer sessionsMu.RUnlock()
+	if len(uploadSessions) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(uploadSessions)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(uploadsDir, 0700); err != nil {
+		return err
+	}
+	name := filepath.Join(uploadsDir, "sessions-"+uuid.New().String()+".json")
+	if err := os.WriteFile(name, data, 0600); err != nil {
+		return err
+	}
+	slog.Info("saved direct upload sessions", "count", len(uploadSessions))
+	return nil
+}
+
+// abortDirectSessions releases the parts of direct uploads that couldn't be saved
+func abortDirectSessions() {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for id, session := range uploadSessions {
+		if err := coreClient.AbortMultipartUpload(ctx, bucketName, session.FileName, session.UploadID); err != nil {
+			slog.Warn("failed to abort multipart upload", "session_id", id, "error", err)
+		}
+		delete(uploadSessions, id)
+	}
+}
+
+// restoreDirectSessions loads the sessions saved by processes that shut down
+func restoreDirectSessions() error {
+	files, err := filepath.Glob(filepath.Join(uploadsDir, "sessions-*.json"))
+	if err != nil {
+		return err
+	}
+
+	restored := 0
+	for _, file := range files {
+		// Claim the file first so a replica starting at the same time can't load it too
+		claimed := file + ".loading-" + uuid.New().String()
+		if err := os.Rename(file, claimed); err != nil {
+			continue
+		}
+		data, err := os.ReadFile(claimed)
+		os.Remove(claimed)
+		if err != nil {
+			return err
+		}
+
+		saved := make(map[string]*ChunkUploadSession)
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return fmt.Errorf("invalid sessions file %s: %w", filepath.Base(file), err)
+		}
+
+		sessionsMu.Lock()
+		for id, session := range saved {
+			if session.UploadedParts == nil {
+				session.UploadedParts = make(map[int]minio.CompletePart)
+			}
+			uploadSessions[id] = session
+		}
+		sessionsMu.Unlock()
+		restored += len(saved)
+	}
+
+	if restored > 0 {
+		slog.Info("restored direct upload sessions", "count", restored)
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// historyFileName holds the usage time series, next to the owners file
+const historyFileName = "history.json"
+
+// historyMaxDirs is how many top-level directories get their own series;
+// the smaller ones are summed under otherDirs
+const historyMaxDirs = 50
+
+const otherDirs = "(other)"
+
+// history records the usage index every storage.history_interval so
+// /api/stats/history can chart growth. Samples are kept at three resolutions:
+// every interval for two days, hourly for 90 days and daily for
+// storage.history_retention. Each sample is added to all three as it is
+// taken, so the coarser series are always complete and only need trimming.
+var history = &usageHistory{}
+
+type usageHistory struct {
+	mu     sync.Mutex
+	series historySeries
+
+	// Transfer counters at the last sample, to record the volume in between
+	lastUploaded, lastDownloaded int64
+}
+
+type historySeries struct {
+	Raw    []UsageSample `json:"raw"`
+	Hourly []UsageSample `json:"hourly"`
+	Daily  []UsageSample `json:"daily"`
+}
+
+// UsageSample is the usage at the end of a period and the transfers during it
+type UsageSample struct {
+	Time       time.Time        `json:"time"` // start of the period
+	Bytes      int64            `json:"bytes"`
+	Objects    int64            `json:"objects"`
+	Dirs       map[string]int64 `json:"dirs,omitempty"` // bytes under each top-level directory
+	Uploaded   int64            `json:"uploaded"`       // bytes received from clients
+	Downloaded int64            `json:"downloaded"`     // bytes sent to clients
+}
+
+// historyTier is one resolution of the series
+type historyTier struct {
+	samples    *[]UsageSample
+	resolution time.Duration
+	retention  time.Duration
+}
+
+// tiers lists the resolutions from finest to coarsest
+func (h *usageHistory) tiers() []historyTier {
+	settings := currentConfig().Storage
+	return []historyTier{
+		{&h.series.Raw, settings.HistoryInterval, 48 * time.Hour},
+		{&h.series.Hourly, time.Hour, 90 * 24 * time.Hour},
+		{&h.series.Daily, 24 * time.Hour, settings.HistoryRetention},
+	}
+}
+
+// run samples usage every interval until ctx is cancelled
+func (h *usageHistory) run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	h.mu.Lock()
+	h.lastUploaded, h.lastDownloaded = metrics.bytesUploaded.Load(), metrics.bytesDownloaded.Load()
+	var series historySeries
+	err := readStatsFile(historyFileName, &series)
+	if err == nil {
+		h.series = series
+	}
+	h.mu.Unlock()
+	if err != nil {
+		slog.Warn("failed to load usage history", "error", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if err := h.record(time.Now()); err != nil {
+			slog.Warn("failed to record usage sample", "error", err)
+		}
+	}
+}
+
+// record adds a sample for now. The series are read back first and merged
+// into, so replicas sharing the mount fill the same samples: the usage is
+// the same for all of them and their transfer volumes add up.
+func (h *usageHistory) record(now time.Time) error {
+	if !usage.isReady() {
+		return nil // nothing meaningful until the first listing is done
+	}
+	objects, bytes := usage.counts()
+	uploaded, downloaded := metrics.bytesUploaded.Load(), metrics.bytesDownloaded.Load()
+	sample := UsageSample{
+		Bytes:   bytes,
+		Objects: objects,
+		Dirs:    usage.topLevelBytes(historyMaxDirs),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sample.Uploaded, sample.Downloaded = uploaded-h.lastUploaded, downloaded-h.lastDownloaded
+
+	var series historySeries
+	if err := readStatsFile(historyFileName, &series); err != nil {
+		return err
+	}
+	h.series = series
+	for _, tier := range h.tiers() {
+		*tier.samples = addSample(*tier.samples, now.Truncate(tier.resolution), sample)
+		cutoff := now.Add(-tier.retention)
+		i := sort.Search(len(*tier.samples), func(i int) bool { return !(*tier.samples)[i].Time.Before(cutoff) })
+		*tier.samples = (*tier.samples)[i:]
+	}
+	if err := writeStatsFile(historyFileName, h.series); err != nil {
+		return err
+	}
+	h.lastUploaded, h.lastDownloaded = uploaded, downloaded
+	return nil
+}
+
+// addSample merges s into the period starting at slot: usage is overwritten
+// with the latest figures and transfers are added up. Samples stay sorted by time.
+func addSample(samples []UsageSample, slot time.Time, s UsageSample) []UsageSample {
+	i := sort.Search(len(samples), func(i int) bool { return !samples[i].Time.Before(slot) })
+	if i < len(samples) && samples[i].Time.Equal(slot) {
+		existing := &samples[i]
+		existing.Bytes, existing.Objects, existing.Dirs = s.Bytes, s.Objects, s.Dirs
+		existing.Uploaded += s.Uploaded
+		existing.Downloaded += s.Downloaded
+		return samples
+	}
+	s.Time = slot
+	samples = append(samples, UsageSample{})
+	copy(samples[i+1:], samples[i:])
+	samples[i] = s
+	return samples
+}
+
+// topLevelBytes returns the bytes under each top-level directory: the limit
+// largest ones by name, the rest summed under otherDirs
+func (x *usageIndex) topLevelBytes(limit int) map[string]int64 {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	names := make([]string, 0, len(x.dirs[""].subdirs))
+	for name := range x.dirs[""].subdirs {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return x.dirs[names[i]].bytes > x.dirs[names[j]].bytes })
+
+	dirs := make(map[string]int64, len(names))
+	for i, name := range names {
+		if i < limit {
+			dirs[name] = x.dirs[name].bytes
+		} else {
+			dirs[otherDirs] += x.dirs[name].bytes
+		}
+	}
+	return dirs
+}
+
+// HistoryResponse is the response of GET /api/stats/history
+type HistoryResponse struct {
+	Range      string        `json:"range"`
+	Step       string        `json:"step"`
+	Resolution string        `json:"resolution"` // of the stored samples the points were built from
+	Points     []UsageSample `json:"points"`
+	// Least-squares growth over the range, for capacity forecasts; 0 with fewer than two points
+	GrowthBytesPerDay float64 `json:"growthBytesPerDay"`
+}
+
+// maxHistoryPoints bounds the size of one history response
+const maxHistoryPoints = 2000
+
+// statsHistoryHandler serves GET /api/stats/history?range=30d&step=1d: usage
+// over the range, one point per step (periods without samples are left out).
+// Each point has the usage at the end of its step and the transfers during it.
+func statsHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if currentConfig().Storage.HistoryInterval <= 0 {
+		http.Error(w, "Usage history is disabled", http.StatusNotImplemented)
+		return
+	}
+
+	span, step := 7*24*time.Hour, time.Duration(0)
+	var err error
+	if value := r.URL.Query().Get("range"); value != "" {
+		if span, err = parseSpan(value); err != nil || span <= 0 {
+			http.Error(w, "Invalid range value", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := r.URL.Query().Get("step"); value != "" {
+		if step, err = parseSpan(value); err != nil || step <= 0 {
+			http.Error(w, "Invalid step value", http.StatusBadRequest)
+			return
+		}
+	} else if step = time.Hour; span > 7*24*time.Hour {
+		step = 24 * time.Hour
+	}
+
+	history.mu.Lock()
+	tier := history.tierFor(step)
+	if step < tier.resolution {
+		step = tier.resolution
+	}
+	if span/step > maxHistoryPoints {
+		history.mu.Unlock()
+		http.Error(w, "Too many points, use a larger step", http.StatusBadRequest)
+		return
+	}
+	start := time.Now().Add(-span)
+	points := []UsageSample{}
+	for _, s := range *tier.samples {
+		if !s.Time.Before(start) {
+			points = addSample(points, s.Time.Truncate(step), s)
+		}
+	}
+	history.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(HistoryResponse{
+		Range:             span.String(),
+		Step:              step.String(),
+		Resolution:        tier.resolution.String(),
+		Points:            points,
+		GrowthBytesPerDay: growthPerDay(points),
+	})
+}
+
+// tierFor picks the coarsest resolution that is still fine enough for step.
+// It reaches back the furthest and adds up to the same points as the finer ones.
+func (h *usageHistory) tierFor(step time.Duration) historyTier {
+	tiers := h.tiers()
+	chosen := tiers[0]
+	for _, tier := range tiers[1:] {
+		if tier.resolution > step {
+			break
+		}
+		chosen = tier
+	}
+	return chosen
+}
+
+// growthPerDay fits a line through the points' bytes and returns its slope
+func growthPerDay(points []UsageSample) float64 {
+	if len(points) < 2 {
+		return 0
+	}
+	origin := points[0].Time
+	var n, sumX, sumY, sumXY, sumXX float64
+	for _, p := range points {
+		x := p.Time.Sub(origin).Hours() / 24
+		y := float64(p.Bytes)
+		n++
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denominator
+}
+
+// parseSpan parses a duration that may also be given in days, weeks or years ("30d", "2w", "1y")
+func parseSpan(value string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour, "y": 365 * 24 * time.Hour} {
+		if number, ok := strings.CutSuffix(value, suffix); ok {
+			n, err := strconv.Atoi(number)
+			if err != nil {
+				return 0, err
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	return time.ParseDuration(value)
+}
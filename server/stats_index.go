@@ -0,0 +1,837 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/notification"
+)
+
+// usage indexes every object in the bucket, with counts, sizes, types and a
+// size histogram rolled up into each directory above it, and totals for each
+// user who uploaded files. It is filled by one listing at startup and then
+// kept current by the handlers, which report every file they write, move or
+// delete, and by MinIO's bucket events, so /api/stats can answer for any
+// folder without listing the bucket again. A slow periodic listing
+// (storage.reconcile_interval) corrects whatever both missed.
+var usage = newUsageIndex()
+
+type usageIndex struct {
+	mu           sync.RWMutex
+	files        map[string]indexedFile // by object key
+	dirs         map[string]*dirUsage   // by directory key; "" is the bucket root
+	users        map[string]*typeUsage  // by owner
+	largest      string                 // key of the largest file; "" until it is looked up again
+	owners       map[string]string      // owners loaded at startup, until the first listing places them
+	ownerChanges map[string]string      // not yet saved; "" for files that went away
+	ready        bool                   // the first listing finished
+	scannedAt    time.Time
+	revision     atomic.Uint64 // bumped by every change
+	following    atomic.Bool   // bucket events are being applied
+}
+
+type indexedFile struct {
+	size     int64
+	modified time.Time
+	indexed  time.Time // when the index last learned about the file
+	owner    string    // user who uploaded it through the API, if known
+}
+
+// dirUsage sums up everything below a directory
+type dirUsage struct {
+	files     int64
+	bytes     int64
+	here      map[string]bool // names of the files directly in the directory
+	subdirs   map[string]bool // names of child directories
+	types     map[string]*typeUsage
+	months    map[string]*typeUsage // by month last modified ("2006-01")
+	histogram [len(sizeBucketLimits) + 1]int64
+	ranking   *dirRanking // nil until /api/stats asks for the directory
+}
+
+// maxStatsTop is the most largest and oldest files /api/stats?path= lists
+const maxStatsTop = 100
+
+// dirRanking holds the keys of the maxStatsTop largest and oldest files below
+// a directory, best first, or of all of them when there are fewer. Changes are
+// merged in as they happen; when a ranked file gets smaller, newer or goes
+// away while the list is full, an unranked file may now belong in it, so the
+// ranking is dropped and rebuilt from the directory's files on the next request.
+type dirRanking struct {
+	largest []string
+	oldest  []string
+}
+
+type typeUsage struct {
+	files int64
+	bytes int64
+}
+
+// sizeBucketLimits are the upper bounds of the size histogram buckets;
+// anything larger lands in a final open-ended bucket
+var sizeBucketLimits = [...]int64{1 << 10, 64 << 10, 1 << 20, 16 << 20, 128 << 20, 1 << 30, 10 << 30}
+
+func newUsageIndex() *usageIndex {
+	return &usageIndex{
+		files:        make(map[string]indexedFile),
+		dirs:         map[string]*dirUsage{"": newDirUsage()},
+		users:        make(map[string]*typeUsage),
+		ownerChanges: make(map[string]string),
+	}
+}
+
+func newDirUsage() *dirUsage {
+	return &dirUsage{
+		here:    make(map[string]bool),
+		subdirs: make(map[string]bool),
+		types:   make(map[string]*typeUsage),
+		months:  make(map[string]*typeUsage),
+	}
+}
+
+// put records an object, replacing what was known about it. An empty owner
+// keeps the one already recorded.
+func (x *usageIndex) put(key string, size int64, modified time.Time, owner string) {
+	if key == "" || strings.HasSuffix(key, "/") {
+		return // directory markers
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.putLocked(key, indexedFile{size: size, modified: modified, indexed: time.Now(), owner: owner})
+}
+
+// remove forgets an object
+func (x *usageIndex) remove(key string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.removeLocked(key)
+}
+
+// removeTree forgets an object, or a directory and everything below it
+func (x *usageIndex) removeTree(key string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.removeTreeLocked(key)
+}
+
+// moveTree re-keys an object, or a directory and everything below it, keeping
+// owners. Whatever was indexed at the destination is replaced.
+func (x *usageIndex) moveTree(from, to string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	moved := make(map[string]indexedFile)
+	if f, ok := x.files[from]; ok {
+		moved[to] = f
+		x.removeLocked(from)
+	}
+	if x.dirs[from] != nil {
+		prefix := from + "/"
+		for key, f := range x.files {
+			if strings.HasPrefix(key, prefix) {
+				moved[to+"/"+key[len(prefix):]] = f
+				x.removeLocked(key)
+			}
+		}
+	}
+	x.removeTreeLocked(to)
+	now := time.Now()
+	for key, f := range moved {
+		f.indexed = now
+		x.putLocked(key, f)
+	}
+}
+
+// replaceTree makes the index hold exactly found for key and, if key is a
+// directory, everything below it. Files in found without an owner keep the
+// one already recorded.
+func (x *usageIndex) replaceTree(key string, found map[string]indexedFile) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if _, ok := found[key]; !ok {
+		x.removeLocked(key)
+	}
+	for k, f := range found {
+		x.putLocked(k, f)
+	}
+	if x.dirs[key] != nil {
+		prefix := key + "/"
+		for k := range x.files {
+			if _, ok := found[k]; !ok && strings.HasPrefix(k, prefix) {
+				x.removeLocked(k)
+			}
+		}
+	}
+}
+
+func (x *usageIndex) putLocked(key string, f indexedFile) {
+	old, existed := x.files[key]
+	known := x.owners[key]
+	if existed {
+		known = old.owner
+		x.account(key, old, -1)
+	}
+	if f.owner == "" {
+		f.owner = known
+	}
+	if f.owner != known {
+		x.ownerChanges[key] = f.owner
+	}
+	if x.largest == key {
+		if f.size < old.size {
+			x.largest = ""
+		}
+	} else if x.largest != "" && f.size > x.files[x.largest].size {
+		x.largest = key
+	}
+	x.files[key] = f
+	x.account(key, f, 1)
+	if existed {
+		x.rerank(key, &old, &f)
+	} else {
+		x.rerank(key, nil, &f)
+	}
+	x.revision.Add(1)
+}
+
+func (x *usageIndex) removeLocked(key string) {
+	old, ok := x.files[key]
+	if !ok {
+		return
+	}
+	delete(x.files, key)
+	x.account(key, old, -1)
+	x.rerank(key, &old, nil)
+	if old.owner != "" {
+		x.ownerChanges[key] = ""
+	}
+	if x.largest == key {
+		x.largest = ""
+	}
+	x.revision.Add(1)
+}
+
+func (x *usageIndex) removeTreeLocked(key string) {
+	x.removeLocked(key)
+	if x.dirs[key] == nil {
+		return
+	}
+	prefix := key + "/"
+	for k := range x.files {
+		if strings.HasPrefix(k, prefix) {
+			x.removeLocked(k)
+		}
+	}
+}
+
+// account adds (sign 1) or subtracts (sign -1) a file from its owner and
+// every directory above it, dropping directories that no longer hold any files
+func (x *usageIndex) account(key string, f indexedFile, sign int64) {
+	size := f.size
+	if f.owner != "" {
+		addUsage(x.users, f.owner, sign, size)
+	}
+
+	ext := strings.ToLower(path.Ext(key))
+	month := f.modified.UTC().Format("2006-01")
+	bucket := sizeBucket(size)
+	child := ""
+	for dir := parentKey(key); ; dir = parentKey(dir) {
+		d := x.dirs[dir]
+		if d == nil {
+			d = newDirUsage()
+			x.dirs[dir] = d
+		}
+		d.files += sign
+		d.bytes += sign * size
+		d.histogram[bucket] += sign
+		addUsage(d.types, ext, sign, size)
+		addUsage(d.months, month, sign, size)
+		if child == "" {
+			if sign > 0 {
+				d.here[path.Base(key)] = true
+			} else {
+				delete(d.here, path.Base(key))
+			}
+		} else if x.dirs[child] == nil {
+			delete(d.subdirs, path.Base(child))
+		} else {
+			d.subdirs[path.Base(child)] = true
+		}
+		if d.files == 0 && dir != "" {
+			delete(x.dirs, dir)
+		}
+		if dir == "" {
+			return
+		}
+		child = dir
+	}
+}
+
+// addUsage adds (sign 1) or subtracts (sign -1) a file of size to by[name],
+// dropping the entry once it holds no files
+func addUsage(by map[string]*typeUsage, name string, sign, size int64) {
+	t := by[name]
+	if t == nil {
+		t = &typeUsage{}
+		by[name] = t
+	}
+	t.files += sign
+	t.bytes += sign * size
+	if t.files == 0 {
+		delete(by, name)
+	}
+}
+
+// rerank updates the rankings of the directories above key for a file that
+// was added (old is nil), changed, or removed (f is nil). Server bookkeeping
+// is left out of the root's rankings, since it can't be opened through the API.
+func (x *usageIndex) rerank(key string, old, f *indexedFile) {
+	if old != nil && f != nil && old.size == f.size && old.modified.Equal(f.modified) {
+		return
+	}
+	first, _, _ := strings.Cut(key, "/")
+	internal := isHiddenRootEntry(first)
+	for dir := parentKey(key); ; dir = parentKey(dir) {
+		if d := x.dirs[dir]; d != nil && d.ranking != nil && !(dir == "" && internal) {
+			largest, ok := x.rerankList(d.ranking.largest, key, old != nil && f != nil && f.size < old.size, f != nil, x.larger)
+			if ok {
+				d.ranking.largest = largest
+				older := old != nil && f != nil && f.modified.After(old.modified)
+				d.ranking.oldest, ok = x.rerankList(d.ranking.oldest, key, older, f != nil, x.older)
+			}
+			if !ok {
+				d.ranking = nil
+			}
+		}
+		if dir == "" {
+			return
+		}
+	}
+}
+
+// rerankList moves key to its place in a ranking ordered by better, adds it,
+// or takes it out when it's no longer present. It reports false when the
+// ranking can't be kept: it is full and a ranked file got worse or went away.
+func (x *usageIndex) rerankList(keys []string, key string, worse, present bool, better func(a, b string) bool) ([]string, bool) {
+	if i := slices.Index(keys, key); i >= 0 {
+		if (worse || !present) && len(keys) == maxStatsTop {
+			return nil, false
+		}
+		keys = slices.Delete(keys, i, i+1)
+	}
+	if !present || len(keys) == maxStatsTop && !better(key, keys[len(keys)-1]) {
+		return keys, true
+	}
+	at := sort.Search(len(keys), func(i int) bool { return better(key, keys[i]) })
+	keys = slices.Insert(keys, at, key)
+	if len(keys) > maxStatsTop {
+		keys = keys[:maxStatsTop]
+	}
+	return keys, true
+}
+
+// larger orders files by size, largest first
+func (x *usageIndex) larger(a, b string) bool {
+	if sa, sb := x.files[a].size, x.files[b].size; sa != sb {
+		return sa > sb
+	}
+	return a < b
+}
+
+// older orders files by modification time, oldest first
+func (x *usageIndex) older(a, b string) bool {
+	if ma, mb := x.files[a].modified, x.files[b].modified; !ma.Equal(mb) {
+		return ma.Before(mb)
+	}
+	return a < b
+}
+
+// rankingLocked returns the ranking of dir, building it from the files below
+// it if it isn't kept yet
+func (x *usageIndex) rankingLocked(dir string, d *dirUsage) *dirRanking {
+	if d.ranking != nil {
+		return d.ranking
+	}
+	var keys []string
+	var walk func(dir string, d *dirUsage)
+	walk = func(dir string, d *dirUsage) {
+		for name := range d.here {
+			if dir != "" || !isHiddenRootEntry(name) {
+				keys = append(keys, path.Join(dir, name))
+			}
+		}
+		for name := range d.subdirs {
+			if sub := x.dirs[path.Join(dir, name)]; sub != nil && (dir != "" || !isHiddenRootEntry(name)) {
+				walk(path.Join(dir, name), sub)
+			}
+		}
+	}
+	walk(dir, d)
+
+	ranking := &dirRanking{}
+	sort.Slice(keys, func(i, j int) bool { return x.larger(keys[i], keys[j]) })
+	ranking.largest = slices.Clone(keys[:min(len(keys), maxStatsTop)])
+	sort.Slice(keys, func(i, j int) bool { return x.older(keys[i], keys[j]) })
+	ranking.oldest = slices.Clone(keys[:min(len(keys), maxStatsTop)])
+	d.ranking = ranking
+	return ranking
+}
+
+// fileStats describes the first n files of a ranking
+func (x *usageIndex) fileStats(keys []string, n int) []FileStats {
+	files := []FileStats{}
+	for _, key := range keys[:min(n, len(keys))] {
+		f := x.files[key]
+		files = append(files, FileStats{Path: "/" + key, Size: f.size, Modified: f.modified})
+	}
+	return files
+}
+
+// parentKey returns the directory key holding key ("" for the root)
+func parentKey(key string) string {
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		return key[:i]
+	}
+	return ""
+}
+
+func sizeBucket(size int64) int {
+	for i, limit := range sizeBucketLimits {
+		if size < limit {
+			return i
+		}
+	}
+	return len(sizeBucketLimits)
+}
+
+// usageDrift is how far the index was out of step with a listing
+type usageDrift struct {
+	missing int   // listed but not indexed
+	stale   int   // indexed but no longer listed
+	resized int   // indexed with a different size
+	bytes   int64 // indexed bytes minus listed bytes
+}
+
+// rescan lists the whole bucket and brings the index in line with it.
+// Objects the index learned about while the listing ran are newer than the
+// listing and kept as they are. After the first listing, what had to be
+// corrected is logged and counted as drift.
+func (x *usageIndex) rescan(ctx context.Context) error {
+	start := time.Now()
+	listed := make(map[string]indexedFile)
+	for object := range minioClient.ListObjects(ctx, bucketName, minio.ListObjectsOptions{Recursive: true}) {
+		if object.Err != nil {
+			metrics.BackendError("s3_list_objects")
+			return object.Err
+		}
+		if !strings.HasSuffix(object.Key, "/") {
+			listed[object.Key] = indexedFile{size: object.Size, modified: object.LastModified, indexed: start}
+		}
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var drift usageDrift
+	for key, f := range listed {
+		current, ok := x.files[key]
+		switch {
+		case !ok:
+			drift.missing++
+			drift.bytes -= f.size
+		case current.indexed.After(start):
+			continue
+		case current.size != f.size:
+			drift.resized++
+			drift.bytes += current.size - f.size
+		case current.modified.Equal(f.modified):
+			continue
+		}
+		x.putLocked(key, f)
+	}
+	for key, f := range x.files {
+		if _, ok := listed[key]; !ok && f.indexed.Before(start) {
+			drift.stale++
+			drift.bytes += f.size
+			x.removeLocked(key)
+		}
+	}
+	wasReady := x.ready
+	x.ready, x.scannedAt, x.owners = true, time.Now(), nil
+
+	duration := time.Since(start).Milliseconds()
+	switch {
+	case !wasReady:
+		slog.Info("usage index rebuilt", "objects", len(x.files), "bytes", x.dirs[""].bytes, "duration_ms", duration)
+	case drift != usageDrift{}:
+		slog.Warn("usage index drifted from the bucket, corrected", "missing", drift.missing, "stale", drift.stale,
+			"resized", drift.resized, "bytes", drift.bytes, "duration_ms", duration)
+		metrics.UsageDrift("missing", drift.missing)
+		metrics.UsageDrift("stale", drift.stale)
+		metrics.UsageDrift("resized", drift.resized)
+	default:
+		slog.Info("usage index matches the bucket", "objects", len(x.files), "duration_ms", duration)
+	}
+	return nil
+}
+
+// reconcile lists the bucket every interval to correct what the handlers and
+// bucket events missed, such as files changed directly in the bucket or
+// events lost while disconnected. It returns when ctx is cancelled.
+func (x *usageIndex) reconcile(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if !x.isReady() {
+			continue // the startup listing is still running
+		}
+		if err := x.rescan(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("usage reconciliation failed", "error", err)
+		}
+	}
+}
+
+// isReady reports whether the first listing has finished
+func (x *usageIndex) isReady() bool {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.ready
+}
+
+// follow applies MinIO bucket events to the index until ctx is cancelled, so
+// changes made past the API are seen too. Events can be missed while
+// disconnected, so the bucket is listed again when the subscription is
+// re-established (the first listing is done by the startup stats
+// calculation). Servers without bucket events (e.g. AWS S3) are left to the
+// handlers' updates and the periodic reconciliation.
+func (x *usageIndex) follow(ctx context.Context) {
+	events := []string{"s3:ObjectCreated:*", "s3:ObjectRemoved:*"}
+	for ctx.Err() == nil {
+		ch := minioClient.ListenBucketNotification(ctx, bucketName, "", "", events)
+		x.following.Store(true)
+		if x.isReady() {
+			go func() {
+				if err := x.rescan(ctx); err != nil && ctx.Err() == nil {
+					slog.Warn("usage index rebuild failed", "error", err)
+				}
+			}()
+		}
+
+		for info := range ch {
+			if info.Err != nil {
+				slog.Warn("bucket events interrupted, usage index falls back to reconciliation", "error", info.Err)
+				metrics.BackendError("s3_listen_notification")
+				break
+			}
+			for _, event := range info.Records {
+				x.apply(event)
+			}
+		}
+		x.following.Store(false)
+
+		select {
+		case <-time.After(time.Minute):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// apply updates the index from one bucket event
+func (x *usageIndex) apply(event notification.Event) {
+	key, err := url.QueryUnescape(event.S3.Object.Key)
+	if err != nil {
+		key = event.S3.Object.Key
+	}
+	switch {
+	case strings.HasPrefix(event.EventName, "s3:ObjectCreated:"):
+		modified, err := time.Parse(time.RFC3339, event.EventTime)
+		if err != nil {
+			modified = time.Now()
+		}
+		x.put(key, event.S3.Object.Size, modified, "")
+	case strings.HasPrefix(event.EventName, "s3:ObjectRemoved:"):
+		x.remove(key)
+	}
+}
+
+// totals returns the object count and bytes of the whole bucket, and its largest file
+func (x *usageIndex) totals() (files, bytes int64, largest string, largestSize int64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.largest == "" {
+		// Only looked up again after the largest file shrank or went away
+		for key, f := range x.files {
+			if f.size > x.files[x.largest].size {
+				x.largest = key
+			}
+		}
+	}
+	root := x.dirs[""]
+	return root.files, root.bytes, x.largest, x.files[x.largest].size
+}
+
+// counts returns the object count and bytes of the whole bucket
+func (x *usageIndex) counts() (files, bytes int64) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	root := x.dirs[""]
+	return root.files, root.bytes
+}
+
+// UserStats is what one user has stored through the API
+type UserStats struct {
+	User  string `json:"user"`
+	Files int64  `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+// userTotals returns the usage of every user with files, largest first
+func (x *usageIndex) userTotals() []UserStats {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	users := make([]UserStats, 0, len(x.users))
+	for user, u := range x.users {
+		users = append(users, UserStats{User: user, Files: u.files, Bytes: u.bytes})
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].Bytes != users[j].Bytes {
+			return users[i].Bytes > users[j].Bytes
+		}
+		return users[i].User < users[j].User
+	})
+	return users
+}
+
+// PathStats is the response of GET /api/stats?path=
+type PathStats struct {
+	Path          string            `json:"path"`
+	Files         int64             `json:"files"`
+	Bytes         int64             `json:"bytes"`
+	FilesHere     int64             `json:"filesHere"` // directly in the directory, not in subdirectories
+	BytesHere     int64             `json:"bytesHere"`
+	Directories   []DirectoryStats  `json:"directories"`
+	ByExtension   []TypeStats       `json:"byExtension"`
+	ByType        []TypeStats       `json:"byType"`
+	SizeHistogram []HistogramBucket `json:"sizeHistogram"`
+	Largest       []FileStats       `json:"largest"`
+	Oldest        []FileStats       `json:"oldest"`
+	Growth        []GrowthPoint     `json:"growth"`
+	IndexedAt     time.Time         `json:"indexedAt"`
+	Live          bool              `json:"live"` // kept current from bucket events
+}
+
+type DirectoryStats struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Files    int64  `json:"files"`
+	Bytes    int64  `json:"bytes"`
+	Internal bool   `json:"internal,omitempty"` // trash, versions and other server bookkeeping
+}
+
+// TypeStats is the usage of one extension (".jpg") or media type ("image")
+type TypeStats struct {
+	Name     string `json:"name"`
+	MimeType string `json:"mimeType,omitempty"`
+	Files    int64  `json:"files"`
+	Bytes    int64  `json:"bytes"`
+}
+
+type HistogramBucket struct {
+	MinSize int64  `json:"minSize"`
+	MaxSize *int64 `json:"maxSize"` // exclusive; null for the last bucket
+	Label   string `json:"label"`
+	Files   int64  `json:"files"`
+}
+
+type FileStats struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// GrowthPoint is the content last modified in one month, and the running total up to it
+type GrowthPoint struct {
+	Month           string `json:"month"` // "2024-05"
+	Files           int64  `json:"files"`
+	Bytes           int64  `json:"bytes"`
+	CumulativeFiles int64  `json:"cumulativeFiles"`
+	CumulativeBytes int64  `json:"cumulativeBytes"`
+}
+
+// pathStats summarizes the directory at dir (an object key prefix without
+// slashes at either end). It returns nil if nothing is stored there.
+func (x *usageIndex) pathStats(dir string, top int) *PathStats {
+	// Lock rather than RLock: the ranking may need to be rebuilt
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	d := x.dirs[dir]
+	if d == nil {
+		return nil
+	}
+	stats := &PathStats{
+		Path:        "/" + dir,
+		Files:       d.files,
+		Bytes:       d.bytes,
+		FilesHere:   d.files,
+		BytesHere:   d.bytes,
+		Directories: []DirectoryStats{},
+		IndexedAt:   x.scannedAt,
+		Live:        x.following.Load(),
+	}
+
+	for name := range d.subdirs {
+		key := path.Join(dir, name)
+		sub := x.dirs[key]
+		if sub == nil {
+			continue
+		}
+		stats.FilesHere -= sub.files
+		stats.BytesHere -= sub.bytes
+		stats.Directories = append(stats.Directories, DirectoryStats{
+			Name:     name,
+			Path:     "/" + key,
+			Files:    sub.files,
+			Bytes:    sub.bytes,
+			Internal: dir == "" && isHiddenRootEntry(name),
+		})
+	}
+	sort.Slice(stats.Directories, func(i, j int) bool { return stats.Directories[i].Bytes > stats.Directories[j].Bytes })
+
+	mediaTypes := make(map[string]*TypeStats)
+	for ext, t := range d.types {
+		mimeType := mime.TypeByExtension(ext)
+		name := ext
+		if name == "" {
+			name = "(none)"
+		}
+		stats.ByExtension = append(stats.ByExtension, TypeStats{Name: name, MimeType: mimeType, Files: t.files, Bytes: t.bytes})
+
+		media, _, _ := strings.Cut(mimeType, "/")
+		if media == "" {
+			media = "other"
+		}
+		if mediaTypes[media] == nil {
+			mediaTypes[media] = &TypeStats{Name: media}
+		}
+		mediaTypes[media].Files += t.files
+		mediaTypes[media].Bytes += t.bytes
+	}
+	for _, t := range mediaTypes {
+		stats.ByType = append(stats.ByType, *t)
+	}
+	sort.Slice(stats.ByExtension, func(i, j int) bool { return stats.ByExtension[i].Bytes > stats.ByExtension[j].Bytes })
+	sort.Slice(stats.ByType, func(i, j int) bool { return stats.ByType[i].Bytes > stats.ByType[j].Bytes })
+
+	var lower int64
+	for i, files := range d.histogram {
+		bucket := HistogramBucket{MinSize: lower, Files: files}
+		if i < len(sizeBucketLimits) {
+			limit := sizeBucketLimits[i]
+			bucket.MaxSize = &limit
+			bucket.Label = "< " + formatSize(limit)
+			lower = limit
+		} else {
+			bucket.Label = ">= " + formatSize(lower)
+		}
+		stats.SizeHistogram = append(stats.SizeHistogram, bucket)
+	}
+
+	ranking := x.rankingLocked(dir, d)
+	stats.Largest = x.fileStats(ranking.largest, top)
+	stats.Oldest = x.fileStats(ranking.oldest, top)
+
+	for month, t := range d.months {
+		stats.Growth = append(stats.Growth, GrowthPoint{Month: month, Files: t.files, Bytes: t.bytes})
+	}
+	sort.Slice(stats.Growth, func(i, j int) bool { return stats.Growth[i].Month < stats.Growth[j].Month })
+	var files, bytes int64
+	for i := range stats.Growth {
+		files += stats.Growth[i].Files
+		bytes += stats.Growth[i].Bytes
+		stats.Growth[i].CumulativeFiles, stats.Growth[i].CumulativeBytes = files, bytes
+	}
+	return stats
+}
+
+// formatSize renders a byte count like "64 KiB"
+func formatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return strconv.FormatInt(bytes, 10) + " B"
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit && n%unit == 0; n /= unit {
+		div *= unit
+		exp++
+	}
+	return strconv.FormatInt(bytes/div, 10) + " " + string("KMGTPE"[exp]) + "iB"
+}
+
+// pathStatsHandler serves GET /api/stats?path=/docs&top=10 from the usage
+// index: totals, subdirectories, types, a size histogram, the largest and
+// oldest files, and growth by month for the directory and everything in it
+func pathStatsHandler(w http.ResponseWriter, r *http.Request) {
+	requestPath := r.URL.Query().Get("path")
+	fullPath, err := resolveStoragePath(requestPath)
+	if err == nil && isInternalPath(fullPath) {
+		// Trash, versions, shares and webhooks hold other users' file names
+		err = fmt.Errorf("path %s is internal", requestPath)
+	}
+	if err != nil {
+		logFor(r.Context()).Warn("rejected stats path", "error", err)
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	top := 10
+	if value := r.URL.Query().Get("top"); value != "" {
+		top, err = strconv.Atoi(value)
+		if err != nil || top < 0 || top > maxStatsTop {
+			http.Error(w, fmt.Sprintf("top must be between 0 and %d", maxStatsTop), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !usage.isReady() {
+		// Nothing to answer from until the first listing is done
+		if err := usage.rescan(context.WithoutCancel(r.Context())); err != nil {
+			logFor(r.Context()).Error("failed to build usage index", "error", err)
+			http.Error(w, "Failed to calculate stats", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	dir := strings.TrimPrefix(storageRelativePath(fullPath), "/")
+	stats := usage.pathStats(dir, top)
+	if stats == nil {
+		http.Error(w, "No files stored under "+requestPath, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
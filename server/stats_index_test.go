@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// expectedStats works out the largest and oldest files and the growth below
+// dir the slow way, from every file in the index
+func expectedStats(x *usageIndex, dir string) (largest, oldest []FileStats, growth []GrowthPoint) {
+	prefix := dir + "/"
+	if dir == "" {
+		prefix = ""
+	}
+	months := make(map[string]*GrowthPoint)
+	var files []FileStats
+	for key, f := range x.files {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		month := f.modified.UTC().Format("2006-01")
+		if months[month] == nil {
+			months[month] = &GrowthPoint{Month: month}
+		}
+		months[month].Files++
+		months[month].Bytes += f.size
+		if first, _, _ := strings.Cut(key, "/"); dir == "" && isHiddenRootEntry(first) {
+			continue
+		}
+		files = append(files, FileStats{Path: "/" + key, Size: f.size, Modified: f.modified})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Size != files[j].Size {
+			return files[i].Size > files[j].Size
+		}
+		return files[i].Path < files[j].Path
+	})
+	largest = append([]FileStats{}, files[:min(len(files), maxStatsTop)]...)
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].Modified.Equal(files[j].Modified) {
+			return files[i].Modified.Before(files[j].Modified)
+		}
+		return files[i].Path < files[j].Path
+	})
+	oldest = append([]FileStats{}, files[:min(len(files), maxStatsTop)]...)
+
+	for _, point := range months {
+		growth = append(growth, *point)
+	}
+	sort.Slice(growth, func(i, j int) bool { return growth[i].Month < growth[j].Month })
+	var n, bytes int64
+	for i := range growth {
+		n += growth[i].Files
+		bytes += growth[i].Bytes
+		growth[i].CumulativeFiles, growth[i].CumulativeBytes = n, bytes
+	}
+	return largest, oldest, growth
+}
+
+func TestPathStatsFollowsChanges(t *testing.T) {
+	x := newUsageIndex()
+	random := rand.New(rand.NewSource(1))
+	dirs := []string{"", "a", "a/b", "c", ".trash/alice", ".versions/a"}
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	randomFile := func() string {
+		return strings.TrimPrefix(fmt.Sprintf("%s/f%d", dirs[random.Intn(len(dirs))], random.Intn(150)), "/")
+	}
+
+	for round := 0; round < 40; round++ {
+		for i := 0; i < 50; i++ {
+			// Few sizes and dates, so ties have to be broken by path
+			size := int64(random.Intn(20)) << 10
+			modified := base.AddDate(0, random.Intn(12), random.Intn(3))
+			switch op := random.Intn(10); {
+			case op < 6:
+				x.put(randomFile(), size, modified, "alice")
+			case op < 8:
+				x.remove(randomFile())
+			case op < 9:
+				x.moveTree(randomFile(), randomFile())
+			default:
+				x.moveTree("a/b", dirs[1+random.Intn(len(dirs)-1)]+"/moved")
+			}
+		}
+		for _, dir := range []string{"", "a", "a/b", "c"} {
+			stats := x.pathStats(dir, maxStatsTop)
+			if stats == nil {
+				continue
+			}
+			largest, oldest, growth := expectedStats(x, dir)
+			if !reflect.DeepEqual(stats.Largest, largest) {
+				t.Fatalf("round %d, %q: largest\n got %v\nwant %v", round, dir, stats.Largest, largest)
+			}
+			if !reflect.DeepEqual(stats.Oldest, oldest) {
+				t.Fatalf("round %d, %q: oldest\n got %v\nwant %v", round, dir, stats.Oldest, oldest)
+			}
+			if !reflect.DeepEqual(stats.Growth, growth) {
+				t.Fatalf("round %d, %q: growth\n got %v\nwant %v", round, dir, stats.Growth, growth)
+			}
+		}
+	}
+}
+
+func TestPathStatsTop(t *testing.T) {
+	x := newUsageIndex()
+	now := time.Now()
+	x.put("docs/big", 3<<20, now, "alice")
+	x.put("docs/old", 1<<10, now.AddDate(-2, 0, 0), "alice")
+	x.put("docs/new", 2<<10, now, "alice")
+	x.put(".trash/bob/secret-plans.txt", 1<<30, now.AddDate(-5, 0, 0), "bob")
+
+	stats := x.pathStats("", 2)
+	if len(stats.Largest) != 2 || stats.Largest[0].Path != "/docs/big" || stats.Largest[1].Path != "/docs/new" {
+		t.Errorf("largest = %v", stats.Largest)
+	}
+	if len(stats.Oldest) != 2 || stats.Oldest[0].Path != "/docs/old" {
+		t.Errorf("oldest = %v", stats.Oldest)
+	}
+	// Trash still counts towards the totals, just isn't listed
+	if stats.Files != 4 || stats.Growth[0].Files != 1 {
+		t.Errorf("files = %d, growth = %v", stats.Files, stats.Growth)
+	}
+	if stats := x.pathStats("docs", 0); stats.Largest == nil || len(stats.Largest) != 0 {
+		t.Errorf("top=0: largest = %#v, want empty", stats.Largest)
+	}
+}
+
+func TestPathStatsRejectsInternalPaths(t *testing.T) {
+	previous := usage
+	t.Cleanup(func() { usage = previous })
+	usage = newUsageIndex()
+	usage.ready = true
+	usage.put("docs/report.pdf", 1<<10, time.Now(), "alice")
+	usage.put(".trash/bob/secret-plans.txt", 1<<10, time.Now(), "bob")
+	usage.put(".versions/docs/report.pdf/1", 1<<10, time.Now(), "alice")
+
+	for _, tt := range []struct {
+		path string
+		want int
+	}{
+		{"/", http.StatusOK},
+		{"/docs", http.StatusOK},
+		{"/.trash", http.StatusBadRequest},
+		{"/.trash/bob", http.StatusBadRequest},
+		{"/.versions/docs", http.StatusBadRequest},
+		{"/.shares", http.StatusBadRequest},
+		{"/.webhooks", http.StatusBadRequest},
+		{"/docs/../.trash/bob", http.StatusBadRequest},
+		{"/../etc", http.StatusBadRequest},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/stats?path="+url.QueryEscape(tt.path), nil)
+		rec := httptest.NewRecorder()
+		pathStatsHandler(rec, r)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.path, rec.Code, tt.want)
+		}
+		if strings.Contains(rec.Body.String(), "secret-plans") {
+			t.Errorf("%s: shows another user's trash:\n%s", tt.path, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Thumbnail defaults (override with THUMBNAIL_* environment variables)
+const (
+	defaultThumbnailSize      = 256
+	maxThumbnailSize          = 1024
+	defaultThumbnailCacheSize = 512 << 20 // 512 MB on disk
+	defaultThumbnailWorkers   = 2
+	defaultThumbnailMaxPixels = 50_000_000 // ~200 MB decoded RGBA
+)
+
+// sourcePathSuffix names the file next to a source's thumbnails that records
+// its API path ("<path hash>.path"), so directory invalidation still finds
+// them after a restart
+const sourcePathSuffix = ".path"
+
+// thumbnailEntry is one cached thumbnail file tracked by the LRU
+type thumbnailEntry struct {
+	key      string // cache file name
+	pathHash string // hash of the source path, shared by all sizes
+	path     string // source API path, empty if its .path file was lost
+	size     int64
+}
+
+// ThumbnailCache is an on-disk thumbnail cache with LRU eviction by total size
+type ThumbnailCache struct {
+	dir      string
+	maxBytes int64
+
+	mu       sync.Mutex
+	lru      *list.List               // front = most recently used
+	entries  map[string]*list.Element // key -> element
+	sources  map[string]int           // path hash -> thumbnails cached for it
+	used     int64
+	inFlight map[string]chan struct{} // key -> closed when generation finishes
+
+	// sem bounds how many images are decoded at once
+	sem chan struct{}
+}
+
+var thumbnailCache *ThumbnailCache
+
+// initThumbnailCache creates the cache directory and indexes thumbnails left by a previous run
+func initThumbnailCache() error {
+	settings := currentConfig().Thumbnails
+	dir := settings.CacheDir
+
+	cache := &ThumbnailCache{
+		dir:      dir,
+		maxBytes: settings.CacheMaxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		sources:  make(map[string]int),
+		inFlight: make(map[string]chan struct{}),
+		sem:      make(chan struct{}, settings.Concurrency),
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create thumbnail cache dir: %w", err)
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read thumbnail cache dir: %w", err)
+	}
+
+	// Oldest first, so the most recently written end up at the front of the LRU
+	type cachedFile struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	var files []cachedFile
+	sourcePaths := make(map[string]string)
+	for _, entry := range dirEntries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(entry.Name(), ".tmp-") {
+			// Leftover from a generation interrupted by a restart
+			os.Remove(filepath.Join(dir, entry.Name()))
+			continue
+		}
+		if pathHash, ok := strings.CutSuffix(entry.Name(), sourcePathSuffix); ok {
+			if data, err := os.ReadFile(filepath.Join(dir, entry.Name())); err == nil {
+				sourcePaths[pathHash] = string(data)
+			}
+			continue
+		}
+		files = append(files, cachedFile{name: entry.Name(), size: info.Size(), modTime: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	for _, file := range files {
+		pathHash, _, ok := strings.Cut(file.name, "_")
+		if !ok {
+			continue
+		}
+		cache.add(&thumbnailEntry{key: file.name, pathHash: pathHash, path: sourcePaths[pathHash], size: file.size})
+	}
+	for pathHash := range sourcePaths {
+		if cache.sources[pathHash] == 0 {
+			os.Remove(filepath.Join(dir, pathHash+sourcePathSuffix))
+		}
+	}
+	cache.evict()
+
+	thumbnailCache = cache
+	slog.Info("thumbnail cache initialized", "dir", dir, "entries", cache.lru.Len(),
+		"bytes", cache.used, "max_bytes", cache.maxBytes)
+	return nil
+}
+
+// thumbnailHandlerRClone serves a resized preview (e.g. /api/thumbnail/photos/a.jpg?w=200&h=200)
+func thumbnailHandlerRClone(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if thumbnailCache == nil {
+		http.Error(w, "Thumbnail service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	filePath := strings.TrimPrefix(r.URL.Path, "/api/thumbnail/")
+	if filePath == "" {
+		http.Error(w, "File path required", http.StatusBadRequest)
+		return
+	}
+
+	width, err := parseThumbnailDimension(r.URL.Query().Get("w"))
+	if err != nil {
+		http.Error(w, "Invalid width", http.StatusBadRequest)
+		return
+	}
+	height, err := parseThumbnailDimension(r.URL.Query().Get("h"))
+	if err != nil {
+		http.Error(w, "Invalid height", http.StatusBadRequest)
+		return
+	}
+
+	vol, ok := lookupVolume(w, r.URL.Query().Get("volume"))
+	if !ok {
+		return
+	}
+
+	fullPath, err := vol.resolve(filePath)
+	if err == nil && vol.internal(fullPath) {
+		err = fmt.Errorf("path %s is internal", filePath)
+	}
+	if err != nil {
+		logFor(r.Context()).Warn("rejected thumbnail path", "error", err)
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, fmt.Sprintf("File not found: %s", filePath), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error accessing file: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if info.IsDir() {
+		http.Error(w, "Thumbnails are only available for files", http.StatusBadRequest)
+		return
+	}
+
+	relativePath := vol.qualify(vol.relative(fullPath))
+	cachedPath, contentType, hit, err := thumbnailCache.Get(relativePath, fullPath, info.ModTime(), width, height)
+	if err != nil {
+		if err == errUnsupportedImage {
+			http.Error(w, "Preview not available for this file type", http.StatusUnsupportedMediaType)
+			return
+		}
+		if errors.Is(err, errImageTooLarge) {
+			http.Error(w, "Image too large to preview", http.StatusUnprocessableEntity)
+			return
+		}
+		logFor(r.Context()).Error("failed to generate thumbnail", "file", relativePath, "error", err)
+		http.Error(w, "Failed to generate thumbnail", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Header().Set("X-Cache-Hit", strconv.FormatBool(hit))
+	http.ServeFile(w, r, cachedPath)
+}
+
+func parseThumbnailDimension(value string) (int, error) {
+	if value == "" {
+		return defaultThumbnailSize, nil
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid dimension %q", value)
+	}
+	if size > maxThumbnailSize {
+		size = maxThumbnailSize
+	}
+	return size, nil
+}
+
+var errUnsupportedImage = fmt.Errorf("unsupported image format")
+
+// errImageTooLarge is returned for images over thumbnails.max_pixels
+var errImageTooLarge = fmt.Errorf("image too large to preview")
+
+// Get returns the cached thumbnail file for a source, generating it if missing or stale
+func (c *ThumbnailCache) Get(relativePath, fullPath string, sourceModTime time.Time, width, height int) (string, string, bool, error) {
+	pathHash := thumbnailPathHash(relativePath)
+	prefix := fmt.Sprintf("%s_%dx%d", pathHash, width, height)
+
+	for {
+		c.mu.Lock()
+		if key, ok := c.lookup(prefix, sourceModTime); ok {
+			c.mu.Unlock()
+			return filepath.Join(c.dir, key), thumbnailContentType(key), true, nil
+		}
+
+		// Another request is already generating this thumbnail - wait for it
+		if done, busy := c.inFlight[prefix]; busy {
+			c.mu.Unlock()
+			<-done
+			continue
+		}
+		done := make(chan struct{})
+		c.inFlight[prefix] = done
+		c.mu.Unlock()
+
+		key, err := c.generate(relativePath, fullPath, pathHash, prefix, width, height)
+
+		c.mu.Lock()
+		delete(c.inFlight, prefix)
+		c.mu.Unlock()
+		close(done)
+
+		if err != nil {
+			return "", "", false, err
+		}
+		return filepath.Join(c.dir, key), thumbnailContentType(key), false, nil
+	}
+}
+
+// lookup finds a fresh cache entry for the prefix and marks it recently used. Caller holds c.mu.
+func (c *ThumbnailCache) lookup(prefix string, sourceModTime time.Time) (string, bool) {
+	for _, ext := range []string{".jpg", ".png"} {
+		key := prefix + ext
+		element, ok := c.entries[key]
+		if !ok {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(c.dir, key))
+		if err != nil || info.ModTime().Before(sourceModTime) {
+			// Source changed outside the API (or cache file vanished) - drop it
+			c.remove(element)
+			continue
+		}
+		c.lru.MoveToFront(element)
+		return key, true
+	}
+	return "", false
+}
+
+// generate decodes, resizes and stores a thumbnail, holding a decode slot for the duration
+func (c *ThumbnailCache) generate(relativePath, fullPath, pathHash, prefix string, width, height int) (string, error) {
+	c.sem <- struct{}{}
+	defer func() { <-c.sem }()
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// Check dimensions before decoding so a huge image can't exhaust memory
+	config, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return "", errUnsupportedImage
+	}
+	if int64(config.Width)*int64(config.Height) > currentConfig().Thumbnails.MaxPixels {
+		return "", fmt.Errorf("%w: %dx%d", errImageTooLarge, config.Width, config.Height)
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return "", err
+	}
+
+	startTime := time.Now()
+	source, _, err := image.Decode(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode %s image: %w", format, err)
+	}
+
+	thumbWidth, thumbHeight := fitWithin(config.Width, config.Height, width, height)
+	thumb := image.NewRGBA(image.Rect(0, 0, thumbWidth, thumbHeight))
+	draw.CatmullRom.Scale(thumb, thumb.Bounds(), source, source.Bounds(), draw.Src, nil)
+
+	// Keep transparency for formats that may have it, JPEG for everything else
+	var buf bytes.Buffer
+	ext := ".jpg"
+	if format == "png" || format == "gif" {
+		ext = ".png"
+		err = png.Encode(&buf, thumb)
+	} else {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+
+	key := prefix + ext
+	tempFile, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tempFile.Write(buf.Bytes()); err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return "", err
+	}
+	tempFile.Close()
+	if err := os.Rename(tempFile.Name(), filepath.Join(c.dir, key)); err != nil {
+		os.Remove(tempFile.Name())
+		return "", err
+	}
+
+	c.mu.Lock()
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	if c.sources[pathHash] == 0 {
+		if err := os.WriteFile(filepath.Join(c.dir, pathHash+sourcePathSuffix), []byte(relativePath), 0644); err != nil {
+			slog.Warn("failed to record thumbnail source path", "file", relativePath, "error", err)
+		}
+	}
+	c.add(&thumbnailEntry{key: key, pathHash: pathHash, path: relativePath, size: int64(buf.Len())})
+	c.evict()
+	c.mu.Unlock()
+
+	slog.Debug("generated thumbnail", "file", relativePath, "source_width", config.Width, "source_height", config.Height,
+		"width", thumbWidth, "height", thumbHeight, "duration_ms", time.Since(startTime).Milliseconds())
+	return key, nil
+}
+
+// add inserts an entry at the front of the LRU. Caller holds c.mu.
+func (c *ThumbnailCache) add(entry *thumbnailEntry) {
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.sources[entry.pathHash]++
+	c.used += entry.size
+}
+
+// remove deletes an entry and its file. Caller holds c.mu.
+func (c *ThumbnailCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*thumbnailEntry)
+	delete(c.entries, entry.key)
+	c.used -= entry.size
+	if err := os.Remove(filepath.Join(c.dir, entry.key)); err != nil && !os.IsNotExist(err) {
+		slog.Warn("failed to remove cached thumbnail", "key", entry.key, "error", err)
+	}
+	if c.sources[entry.pathHash]--; c.sources[entry.pathHash] == 0 {
+		delete(c.sources, entry.pathHash)
+		os.Remove(filepath.Join(c.dir, entry.pathHash+sourcePathSuffix))
+	}
+}
+
+// evict drops least recently used thumbnails until the cache fits its limit. Caller holds c.mu.
+func (c *ThumbnailCache) evict() {
+	for c.used > c.maxBytes && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Invalidate drops all thumbnails of a file, or of every file below it for directories
+func (c *ThumbnailCache) Invalidate(relativePath string) {
+	pathHash := thumbnailPathHash(relativePath)
+	dirPrefix := strings.TrimSuffix(relativePath, "/") + "/"
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for element := c.lru.Front(); element != nil; {
+		next := element.Next()
+		entry := element.Value.(*thumbnailEntry)
+		if entry.pathHash == pathHash || (entry.path != "" && strings.HasPrefix(entry.path, dirPrefix)) {
+			c.remove(element)
+			removed++
+		}
+		element = next
+	}
+	if removed > 0 {
+		slog.Debug("invalidated thumbnails", "file", relativePath, "count", removed)
+	}
+}
+
+// InvalidateThumbnails is called by the upload/delete handlers when a source changes
+func InvalidateThumbnails(relativePath string) {
+	if thumbnailCache != nil {
+		thumbnailCache.Invalidate(relativePath)
+	}
+}
+
+func thumbnailPathHash(relativePath string) string {
+	sum := sha256.Sum256([]byte(relativePath))
+	return hex.EncodeToString(sum[:16])
+}
+
+func thumbnailContentType(key string) string {
+	if strings.HasSuffix(key, ".png") {
+		return "image/png"
+	}
+	return "image/jpeg"
+}
+
+// fitWithin scales srcW x srcH to fit inside maxW x maxH, preserving aspect ratio and never upscaling
+func fitWithin(srcW, srcH, maxW, maxH int) (int, int) {
+	if srcW <= maxW && srcH <= maxH {
+		return srcW, srcH
+	}
+	scale := float64(maxW) / float64(srcW)
+	if heightScale := float64(maxH) / float64(srcH); heightScale < scale {
+		scale = heightScale
+	}
+	width := int(float64(srcW)*scale + 0.5)
+	height := int(float64(srcH)*scale + 0.5)
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	return width, height
+}
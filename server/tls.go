@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// serverCerts holds the serving certificate and client CAs loaded from the
+// tls.* files. They are reloaded when the files change, so renewed
+// certificates (e.g. from cert-manager) are picked up without a restart.
+var serverCerts tlsCertificates
+
+type tlsCertificates struct {
+	mu       sync.RWMutex
+	config   *tls.Config // per-handshake config with the current files
+	leaf     *x509.Certificate
+	checksum string
+}
+
+// tlsEnabled reports whether the server serves HTTPS (tls.cert_file is set)
+func tlsEnabled() bool {
+	return currentConfig().TLS.CertFile != ""
+}
+
+// newTLSConfig loads the certificate files and returns the server's TLS
+// config. HTTP/2 is offered through ALPN; handshakes always use the most
+// recently loaded certificate and client CAs.
+func newTLSConfig() (*tls.Config, error) {
+	if err := serverCerts.load(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion: tlsVersion(currentConfig().TLS.MinVersion),
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &serverCerts.current().Certificates[0], nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return serverCerts.current(), nil
+		},
+	}, nil
+}
+
+func (c *tlsCertificates) current() *tls.Config {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.config
+}
+
+// load reads the certificate, key and client CA files. On error the
+// previously loaded files stay in use.
+func (c *tlsCertificates) load() error {
+	settings := currentConfig().TLS
+	cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse TLS certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		MinVersion:   tlsVersion(settings.MinVersion),
+		NextProtos:   []string{"h2", "http/1.1"},
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tlsClientAuth(settings.ClientAuth),
+	}
+	if settings.ClientCAFile != "" {
+		pem, err := os.ReadFile(settings.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("client CA file contains no PEM certificates")
+		}
+		config.ClientCAs = pool
+	}
+
+	c.mu.Lock()
+	c.config, c.leaf, c.checksum = config, leaf, tlsFilesChecksum()
+	c.mu.Unlock()
+
+	slog.Info("TLS certificate loaded", "subject", leaf.Subject.String(), "not_after", leaf.NotAfter,
+		"client_auth", settings.ClientAuth)
+	if time.Until(leaf.NotAfter) < 7*24*time.Hour {
+		slog.Warn("TLS certificate expires soon", "not_after", leaf.NotAfter)
+	}
+	return nil
+}
+
+// watch reloads the files whenever their content changes, checked every
+// tls.reload_interval. It returns when ctx is cancelled.
+func (c *tlsCertificates) watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		c.mu.RLock()
+		unchanged := c.checksum == tlsFilesChecksum()
+		c.mu.RUnlock()
+		if unchanged {
+			continue
+		}
+		// Renewals often write the certificate and key separately; a
+		// mismatched pair fails to load and is retried next tick
+		if err := c.load(); err != nil {
+			slog.Error("TLS reload failed, keeping the current certificate", "error", err)
+		}
+	}
+}
+
+// expiry returns when the serving certificate expires
+func (c *tlsCertificates) expiry() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.leaf == nil {
+		return time.Time{}
+	}
+	return c.leaf.NotAfter
+}
+
+// tlsFilesChecksum combines the checksums of the certificate, key and client CA files
+func tlsFilesChecksum() string {
+	settings := currentConfig().TLS
+	return fileChecksum(settings.CertFile) + fileChecksum(settings.KeyFile) + fileChecksum(settings.ClientCAFile)
+}
+
+func tlsVersion(version string) uint16 {
+	if version == "1.3" {
+		return tls.VersionTLS13
+	}
+	return tls.VersionTLS12
+}
+
+// tlsClientAuth maps tls.client_auth to the handshake policy: "require" rejects
+// clients without a certificate signed by the client CA, "optional" verifies a
+// certificate only if the client sends one
+func tlsClientAuth(mode string) tls.ClientAuthType {
+	switch mode {
+	case "require":
+		return tls.RequireAndVerifyClientCert
+	case "optional":
+		return tls.VerifyClientCertIfGiven
+	default:
+		return tls.NoClientCert
+	}
+}
+
+// mtlsEnabled reports whether client certificates identify users: HTTPS with
+// tls.client_auth optional or require
+func mtlsEnabled() bool {
+	return tlsEnabled() && tlsClientAuth(currentConfig().TLS.ClientAuth) != tls.NoClientCert
+}
+
+// clientCertUser returns the user named by the request's verified client
+// certificate, taken from the field chosen by tls.client_user_from, or ""
+func clientCertUser(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	switch currentConfig().TLS.ClientUserFrom {
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case "uri":
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	case "dns":
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+	return ""
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority generated for the test
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue signs a certificate for template's names and returns it with its key, PEM encoded
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// clientCert issues a client certificate usable by an http.Client
+func (ca *testCA) clientCert(t *testing.T, template *x509.Certificate) tls.Certificate {
+	t.Helper()
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	certPEM, keyPEM := ca.issue(t, template)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// mtlsServer serves /whoami (the caller's user) and /api/admin/config over
+// HTTPS with a server certificate from ca, client certificates checked
+// against ca in the given client_auth mode
+func mtlsServer(t *testing.T, ca *testCA, clientAuth, userFrom string, edit func(*Config)) *httptest.Server {
+	t.Helper()
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	files := map[string][]byte{"server.crt": certPEM, "server.key": keyPEM, "ca.crt": ca.pem}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	previous := currentConfig()
+	t.Cleanup(func() { setConfig(previous, nil, nil) })
+	cfg := defaultConfig()
+	cfg.TLS.CertFile = filepath.Join(dir, "server.crt")
+	cfg.TLS.KeyFile = filepath.Join(dir, "server.key")
+	cfg.TLS.ClientCAFile = filepath.Join(dir, "ca.crt")
+	cfg.TLS.ClientAuth = clientAuth
+	cfg.TLS.ClientUserFrom = userFrom
+	cfg.Server.AdminUsers = []string{"root"}
+	if edit != nil {
+		edit(cfg)
+	}
+	setConfig(cfg, nil, nil)
+
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, requestUser(r))
+	})
+	mux.HandleFunc("/api/admin/config", adminConfigHandler)
+	srv := httptest.NewUnstartedServer(mux)
+	srv.TLS = tlsConfig
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// mtlsClient trusts ca for the server and presents certs, if any. The
+// certificate is sent even if the server asks for another CA's, as an
+// attacker's client would.
+func mtlsClient(ca *testCA, certs ...tls.Certificate) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs: roots,
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				if len(certs) == 0 {
+					return &tls.Certificate{}, nil
+				}
+				return &certs[0], nil
+			},
+		},
+	}}
+}
+
+// mtlsGet requests path with the headers a client might use to impersonate an
+// admin, returning the status and body
+func mtlsGet(t *testing.T, client *http.Client, srv *httptest.Server, path string, spoof bool) (int, string, error) {
+	t.Helper()
+	r, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spoof {
+		r.Header.Set("X-Forwarded-User", "root")
+		r.Header.Set("X-User", "root")
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body), nil
+}
+
+func TestMTLSRequire(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	srv := mtlsServer(t, ca, "require", "cn", nil)
+
+	alice := ca.clientCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}})
+	status, body, err := mtlsGet(t, mtlsClient(ca, alice), srv, "/whoami", true)
+	if err != nil || status != http.StatusOK || body != "alice" {
+		t.Errorf("client certificate for alice with spoofed headers: %d %q %v, want alice", status, body, err)
+	}
+	if status, _, _ := mtlsGet(t, mtlsClient(ca, alice), srv, "/api/admin/config", true); status != http.StatusForbidden {
+		t.Errorf("alice posing as root reached admin config: status %d", status)
+	}
+
+	if _, _, err := mtlsGet(t, mtlsClient(ca), srv, "/whoami", true); err == nil {
+		t.Error("client without a certificate got through client_auth=require")
+	}
+
+	other := newTestCA(t, "other CA")
+	mallory := other.clientCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "root"}})
+	if _, _, err := mtlsGet(t, mtlsClient(ca, mallory), srv, "/whoami", false); err == nil {
+		t.Error("certificate from another CA accepted")
+	}
+}
+
+func TestMTLSOptional(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	// Even a trusted proxy's headers are ignored once certificates identify users
+	srv := mtlsServer(t, ca, "optional", "cn", func(cfg *Config) {
+		cfg.Server.TrustedProxies = []string{"127.0.0.0/8", "::1"}
+	})
+
+	status, body, err := mtlsGet(t, mtlsClient(ca), srv, "/whoami", true)
+	if err != nil || status != http.StatusOK || body != "anonymous" {
+		t.Errorf("no certificate with spoofed headers: %d %q %v, want anonymous", status, body, err)
+	}
+	if status, _, _ := mtlsGet(t, mtlsClient(ca), srv, "/api/admin/config", true); status != http.StatusForbidden {
+		t.Errorf("X-User: root without a certificate reached admin config: status %d", status)
+	}
+
+	root := ca.clientCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "root"}})
+	if status, _, err := mtlsGet(t, mtlsClient(ca, root), srv, "/api/admin/config", false); err != nil || status != http.StatusOK {
+		t.Errorf("admin certificate: status %d, %v", status, err)
+	}
+
+	other := newTestCA(t, "other CA")
+	mallory := other.clientCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "root"}})
+	if _, _, err := mtlsGet(t, mtlsClient(ca, mallory), srv, "/whoami", false); err == nil {
+		t.Error("certificate from another CA accepted under client_auth=optional")
+	}
+}
+
+func TestMTLSMissingIdentityField(t *testing.T) {
+	for _, tt := range []struct {
+		from string
+		with *x509.Certificate
+		want string
+	}{
+		{"email", &x509.Certificate{Subject: pkix.Name{CommonName: "root"}, EmailAddresses: []string{"alice@example.com"}}, "alice@example.com"},
+		{"uri", &x509.Certificate{Subject: pkix.Name{CommonName: "root"}, URIs: []*url.URL{{Scheme: "spiffe", Host: "example.com", Path: "/alice"}}}, "spiffe://example.com/alice"},
+		{"dns", &x509.Certificate{Subject: pkix.Name{CommonName: "root"}, DNSNames: []string{"alice.example.com"}}, "alice.example.com"},
+	} {
+		t.Run(tt.from, func(t *testing.T) {
+			ca := newTestCA(t, "test CA")
+			srv := mtlsServer(t, ca, "require", tt.from, nil)
+
+			withField := ca.clientCert(t, tt.with)
+			if _, body, err := mtlsGet(t, mtlsClient(ca, withField), srv, "/whoami", true); err != nil || body != tt.want {
+				t.Errorf("certificate with %s: %q %v, want %q", tt.from, body, err, tt.want)
+			}
+
+			// Only a common name, which is "root" but not the configured field
+			without := ca.clientCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "root"}})
+			if _, body, err := mtlsGet(t, mtlsClient(ca, without), srv, "/whoami", true); err != nil || body != "anonymous" {
+				t.Errorf("certificate without %s and spoofed headers: %q %v, want anonymous", tt.from, body, err)
+			}
+			if status, _, _ := mtlsGet(t, mtlsClient(ca, without), srv, "/api/admin/config", true); status != http.StatusForbidden {
+				t.Errorf("certificate without %s reached admin config: status %d", tt.from, status)
+			}
+		})
+	}
+}
+
+func TestRequestUserWithoutMTLS(t *testing.T) {
+	setTrustedProxies(t, "10.0.0.0/8")
+
+	tests := []struct {
+		peer   string
+		header string
+		want   string
+	}{
+		{"203.0.113.7:5555", "X-Forwarded-User", "anonymous"},
+		{"203.0.113.7:5555", "X-User", "anonymous"},
+		{"10.0.0.5:5555", "X-Forwarded-User", "root"},
+		{"10.0.0.5:5555", "X-User", "root"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/audit", nil)
+		r.RemoteAddr = tt.peer
+		r.Header.Set(tt.header, "root")
+		if got := requestUser(r); got != tt.want {
+			t.Errorf("%s: %s from %s = %q, want %q", tt.header, "root", tt.peer, got, tt.want)
+		}
+	}
+}
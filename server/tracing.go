@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// Span kinds as numbered in the OTLP protocol
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// traceparentHeader is the W3C Trace Context header used to propagate traces
+const traceparentHeader = "traceparent"
+
+// tracer is the process-wide tracer. Until initTracing configures an exporter
+// it is a no-op: spans are not allocated and nothing is exported.
+var tracer = NewTracer(nil, 1)
+
+// SpanExporter receives finished, sampled spans
+type SpanExporter interface {
+	ExportSpans(ctx context.Context, spans []*Span) error
+	Shutdown(ctx context.Context) error
+}
+
+// Tracer creates spans and hands finished ones to its exporter
+type Tracer struct {
+	exporter SpanExporter
+	ratio    float64 // fraction of new traces sampled
+}
+
+// NewTracer creates a tracer. A nil exporter makes every span a no-op.
+func NewTracer(exporter SpanExporter, ratio float64) *Tracer {
+	return &Tracer{exporter: exporter, ratio: ratio}
+}
+
+// Span is a single timed operation within a trace
+type Span struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	ParentID   [8]byte
+	Name       string
+	Kind       int
+	StartTime  time.Time
+	EndTime    time.Time
+	Attributes map[string]any
+	Err        string
+	Sampled    bool
+
+	tracer *Tracer
+	mu     sync.Mutex
+	ended  bool
+}
+
+// spanContext is the part of a span that crosses process boundaries
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+type spanKey struct{}
+type remoteSpanKey struct{}
+
+// Start begins a span as a child of the span (or remote parent) in ctx
+func (t *Tracer) Start(ctx context.Context, name string, kind int, attrs ...any) (context.Context, *Span) {
+	if t == nil || t.exporter == nil {
+		return ctx, nil
+	}
+
+	span := &Span{Name: name, Kind: kind, StartTime: time.Now(), tracer: t}
+	if parent := spanFromContext(ctx); parent != nil {
+		span.TraceID, span.ParentID, span.Sampled = parent.TraceID, parent.SpanID, parent.Sampled
+	} else if remote, ok := ctx.Value(remoteSpanKey{}).(spanContext); ok {
+		// The browser marks every trace sampled, so the ratio still applies to remote parents
+		span.TraceID, span.ParentID = remote.traceID, remote.spanID
+		span.Sampled = remote.sampled && t.sample(remote.traceID)
+	} else {
+		rand.Read(span.TraceID[:])
+		span.Sampled = t.sample(span.TraceID)
+	}
+	rand.Read(span.SpanID[:])
+	span.SetAttributes(attrs...)
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// sample decides from the trace ID so every service makes the same choice
+func (t *Tracer) sample(traceID [16]byte) bool {
+	if t.ratio >= 1 {
+		return true
+	}
+	var n uint64
+	for _, b := range traceID[8:] {
+		n = n<<8 | uint64(b)
+	}
+	return float64(n>>11)/float64(uint64(1)<<53) < t.ratio
+}
+
+// startSpan starts an internal span on the global tracer
+func startSpan(ctx context.Context, name string, attrs ...any) (context.Context, *Span) {
+	return tracer.Start(ctx, name, spanKindInternal, attrs...)
+}
+
+func spanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// SetAttributes adds key/value pairs (alternating string keys and values)
+func (s *Span) SetAttributes(attrs ...any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Attributes == nil && len(attrs) > 0 {
+		s.Attributes = make(map[string]any, len(attrs)/2)
+	}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if key, ok := attrs[i].(string); ok {
+			s.Attributes[key] = attrs[i+1]
+		}
+	}
+}
+
+// RecordError marks the span as failed
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Err = err.Error()
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export if sampled
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = time.Now()
+	s.mu.Unlock()
+
+	if s.Sampled {
+		s.tracer.exporter.ExportSpans(context.Background(), []*Span{s})
+	}
+}
+
+// traceparent formats the span as a W3C traceparent header value
+func (s *Span) traceparent() string {
+	flags := "00"
+	if s.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.TraceID[:]) + "-" + hex.EncodeToString(s.SpanID[:]) + "-" + flags
+}
+
+// parseTraceparent reads a W3C traceparent header (version 00)
+func parseTraceparent(value string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil || sc.traceID == [16]byte{} {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil || sc.spanID == [8]byte{} {
+		return sc, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return sc, false
+	}
+	sc.sampled = flags&1 == 1
+	return sc, true
+}
+
+// withTracing starts a server span per request, continuing the caller's trace
+// when a valid traceparent header is present
+func withTracing(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if remote, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+			ctx = context.WithValue(ctx, remoteSpanKey{}, remote)
+		}
+
+		ctx, span := tracer.Start(ctx, r.Method+" "+route, spanKindServer,
+			"http.request.method", r.Method,
+			"http.route", route,
+			"url.path", redactPath(route, r.URL.Path),
+		)
+		if span == nil {
+			next(w, r)
+			return
+		}
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r.WithContext(ctx))
+
+		span.SetAttributes("http.response.status_code", recorder.status, "http.response.body.size", recorder.bytes)
+		if r.ContentLength > 0 {
+			span.SetAttributes("http.request.body.size", r.ContentLength)
+		}
+		if recorder.status >= 500 {
+			span.RecordError(fmt.Errorf("HTTP %d", recorder.status))
+		}
+	}
+}
+
+// tracingTransport creates a client span for each outgoing request (MinIO API
+// calls) and propagates the trace to the server
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer.Start(req.Context(), "minio "+req.Method, spanKindClient,
+		"http.request.method", req.Method,
+		"server.address", req.URL.Host,
+		"url.path", req.URL.Path,
+	)
+	if span == nil {
+		return t.base.RoundTrip(req)
+	}
+	defer span.End()
+
+	req = req.Clone(ctx)
+	req.Header.Set(traceparentHeader, span.traceparent())
+	if req.ContentLength > 0 {
+		span.SetAttributes("http.request.body.size", req.ContentLength)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttributes("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= 500 {
+		span.RecordError(fmt.Errorf("HTTP %d", resp.StatusCode))
+	}
+	return resp, nil
+}
+
+// parseMultipartForm is r.ParseMultipartForm in its own span: spooling a large
+// form to disk is often where an upload spends its time
+func parseMultipartForm(r *http.Request, maxMemory int64) error {
+	_, span := startSpan(r.Context(), "multipart.parse", "http.request.body.size", r.ContentLength)
+	defer span.End()
+
+	err := r.ParseMultipartForm(maxMemory)
+	span.RecordError(err)
+	return err
+}
+
+// newTracedTransport wraps minio-go's default transport in a tracingTransport
+func newTracedTransport(secure bool) (http.RoundTripper, error) {
+	base, err := minio.DefaultTransport(secure)
+	if err != nil {
+		return nil, err
+	}
+	return &tracingTransport{base: base}, nil
+}
+
+// SpanRecorder keeps finished spans in memory, for tests and debugging
+type SpanRecorder struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (r *SpanRecorder) ExportSpans(ctx context.Context, spans []*Span) error {
+	r.mu.Lock()
+	r.spans = append(r.spans, spans...)
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *SpanRecorder) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// Spans returns the spans recorded so far
+func (r *SpanRecorder) Spans() []*Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Span(nil), r.spans...)
+}
+
+// otlpExporter batches spans and POSTs them as OTLP/HTTP JSON
+type otlpExporter struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	client      *http.Client
+
+	queue chan *Span
+	flush chan chan struct{}
+	done  chan struct{}
+}
+
+const (
+	otlpQueueSize = 2048
+	otlpBatchSize = 512
+)
+
+func newOTLPExporter(endpoint, serviceName string, headers map[string]string) *otlpExporter {
+	e := &otlpExporter{
+		endpoint:    endpoint,
+		headers:     headers,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan *Span, otlpQueueSize),
+		flush:       make(chan chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go e.run(5 * time.Second)
+	return e
+}
+
+// ExportSpans queues spans without blocking; spans are dropped if the collector can't keep up
+func (e *otlpExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	for _, span := range spans {
+		select {
+		case e.queue <- span:
+		default:
+		}
+	}
+	return nil
+}
+
+// Shutdown sends whatever is queued and stops the background sender
+func (e *otlpExporter) Shutdown(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case e.flush <- flushed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	close(e.done)
+	return nil
+}
+
+func (e *otlpExporter) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, otlpBatchSize)
+	send := func() {
+		if len(batch) > 0 {
+			if err := e.send(batch); err != nil {
+				slog.Warn("failed to export spans", "spans", len(batch), "error", err)
+			}
+			batch = batch[:0]
+		}
+	}
+
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) >= otlpBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case flushed := <-e.flush:
+			for drained := false; !drained; {
+				select {
+				case span := <-e.queue:
+					batch = append(batch, span)
+				default:
+					drained = true
+				}
+			}
+			send()
+			close(flushed)
+		case <-e.done:
+			return
+		}
+	}
+}
+
+func (e *otlpExporter) send(spans []*Span) error {
+	body, err := json.Marshal(otlpRequest(e.serviceName, spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// otlpRequest builds an ExportTraceServiceRequest in the OTLP JSON encoding
+func otlpRequest(serviceName string, spans []*Span) map[string]any {
+	encoded := make([]map[string]any, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		span := map[string]any{
+			"traceId":           hex.EncodeToString(s.TraceID[:]),
+			"spanId":            hex.EncodeToString(s.SpanID[:]),
+			"name":              s.Name,
+			"kind":              s.Kind,
+			"startTimeUnixNano": strconv.FormatInt(s.StartTime.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.Attributes),
+		}
+		if s.ParentID != [8]byte{} {
+			span["parentSpanId"] = hex.EncodeToString(s.ParentID[:])
+		}
+		if s.Err != "" {
+			span["status"] = map[string]any{"code": 2, "message": s.Err}
+		}
+		s.mu.Unlock()
+		encoded = append(encoded, span)
+	}
+
+	return map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttributes(map[string]any{"service.name": serviceName}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "github.com/khoa-nguyendang/rclone-file-upload"},
+				"spans": encoded,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attrs map[string]any) []map[string]any {
+	out := make([]map[string]any, 0, len(attrs))
+	for key, value := range attrs {
+		var v map[string]any
+		switch value := value.(type) {
+		case string:
+			v = map[string]any{"stringValue": value}
+		case bool:
+			v = map[string]any{"boolValue": value}
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(value)}
+		case int64:
+			v = map[string]any{"intValue": strconv.FormatInt(value, 10)}
+		case float64:
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+			v = map[string]any{"doubleValue": value}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(value)}
+		}
+		out = append(out, map[string]any{"key": key, "value": v})
+	}
+	return out
+}
+
+// initTracing enables OTLP export when tracing.endpoint (or the traces-specific
+// tracing.traces_endpoint) is set; otherwise tracing stays a no-op
+func initTracing() {
+	settings := currentConfig().Tracing
+	endpoint := settings.TracesEndpoint
+	if endpoint == "" {
+		if base := settings.Endpoint; base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return
+	}
+
+	serviceName := settings.ServiceName
+	ratio := settings.SampleRatio
+
+	// Headers usually carry collector credentials, so they are never logged
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(settings.Headers, ",") {
+		if key, value, ok := strings.Cut(pair, "="); ok {
+			headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+
+	tracer = NewTracer(newOTLPExporter(endpoint, serviceName, headers), ratio)
+	slog.Info("tracing enabled", "endpoint", endpoint, "service", serviceName, "sample_ratio", ratio)
+}
+
+// shutdownTracing flushes queued spans
+func shutdownTracing(ctx context.Context) error {
+	if tracer.exporter == nil {
+		return nil
+	}
+	return tracer.exporter.Shutdown(ctx)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// recordSpans points the global tracer at an in-memory recorder for the test
+func recordSpans(t *testing.T) *SpanRecorder {
+	t.Helper()
+	recorder := &SpanRecorder{}
+	previous := tracer
+	tracer = NewTracer(recorder, 1)
+	t.Cleanup(func() { tracer = previous })
+	return recorder
+}
+
+// spanNamed returns the only recorded span called name
+func spanNamed(t *testing.T, spans []*Span, name string) *Span {
+	t.Helper()
+	var found *Span
+	for _, span := range spans {
+		if span.Name == name {
+			if found != nil {
+				t.Fatalf("more than one %q span", name)
+			}
+			found = span
+		}
+	}
+	if found == nil {
+		var names []string
+		for _, span := range spans {
+			names = append(names, span.Name)
+		}
+		t.Fatalf("no %q span among %v", name, names)
+	}
+	return found
+}
+
+// assertChild fails unless child was started inside parent
+func assertChild(t *testing.T, child, parent *Span) {
+	t.Helper()
+	if child.TraceID != parent.TraceID {
+		t.Errorf("%s: trace %x, want %x (from %s)", child.Name, child.TraceID, parent.TraceID, parent.Name)
+	}
+	if child.ParentID != parent.SpanID {
+		t.Errorf("%s: parent %x, want %s's span %x", child.Name, child.ParentID, parent.Name, parent.SpanID)
+	}
+}
+
+// setupUploadVolume serves uploads from a temporary storage mount
+func setupUploadVolume(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	previousMount, previousConfig := STORAGE_MOUNT, currentConfig()
+	t.Cleanup(func() {
+		setStorageMount(previousMount)
+		setConfig(previousConfig, nil, nil)
+		initVolumes()
+	})
+
+	setStorageMount(dir)
+	setConfig(defaultConfig(), nil, nil)
+	if err := initVolumes(); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// uploadRequest builds the multipart form the UI sends to /api/upload
+func uploadRequest(t *testing.T, name, content string, fields map[string]string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for key, value := range fields {
+		form.WriteField(key, value)
+	}
+	part, err := form.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(content))
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/upload", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return r
+}
+
+func TestWithTracingStartsServerSpan(t *testing.T) {
+	recorder := recordSpans(t)
+
+	handler := withTracing("/api/files", func(w http.ResponseWriter, r *http.Request) {
+		if spanFromContext(r.Context()) == nil {
+			t.Error("handler context carries no span")
+		}
+		w.Write([]byte("[]"))
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/files?path=/docs", nil))
+
+	spans := recorder.Spans()
+	if len(spans) != 1 {
+		t.Fatalf("recorded %d spans, want 1", len(spans))
+	}
+	span := spans[0]
+	if span.Name != "GET /api/files" || span.Kind != spanKindServer {
+		t.Errorf("span %q kind %d, want \"GET /api/files\" kind %d", span.Name, span.Kind, spanKindServer)
+	}
+	if span.ParentID != ([8]byte{}) {
+		t.Errorf("new trace has parent %x", span.ParentID)
+	}
+	if span.EndTime.Before(span.StartTime) {
+		t.Errorf("span ended at %v, before it started at %v", span.EndTime, span.StartTime)
+	}
+	want := map[string]any{
+		"http.request.method":       "GET",
+		"http.route":                "/api/files",
+		"url.path":                  "/api/files",
+		"http.response.status_code": http.StatusOK,
+		"http.response.body.size":   int64(2),
+	}
+	for key, value := range want {
+		if span.Attributes[key] != value {
+			t.Errorf("attribute %s = %#v, want %#v", key, span.Attributes[key], value)
+		}
+	}
+	if span.Err != "" {
+		t.Errorf("successful request recorded error %q", span.Err)
+	}
+}
+
+func TestWithTracingRecordsServerErrors(t *testing.T) {
+	recorder := recordSpans(t)
+
+	for _, status := range []int{http.StatusNotFound, http.StatusServiceUnavailable} {
+		handler := withTracing("/api/info/", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		})
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/info/a.txt", nil))
+	}
+
+	spans := recorder.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("recorded %d spans, want 2", len(spans))
+	}
+	if spans[0].Err != "" {
+		t.Errorf("404 recorded error %q; only server errors should", spans[0].Err)
+	}
+	if spans[1].Err != "HTTP 503" {
+		t.Errorf("503 recorded error %q, want \"HTTP 503\"", spans[1].Err)
+	}
+	if spans[1].Attributes["http.response.status_code"] != http.StatusServiceUnavailable {
+		t.Errorf("status attribute = %v", spans[1].Attributes["http.response.status_code"])
+	}
+}
+
+func TestWithTracingContinuesRemoteTrace(t *testing.T) {
+	recorder := recordSpans(t)
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+
+	handler := withTracing("/api/files", func(w http.ResponseWriter, r *http.Request) {
+		_, child := startSpan(r.Context(), "mount.list")
+		child.End()
+	})
+	r := httptest.NewRequest(http.MethodGet, "/api/files", nil)
+	r.Header.Set(traceparentHeader, "00-"+traceID+"-"+parentID+"-01")
+	handler(httptest.NewRecorder(), r)
+
+	spans := recorder.Spans()
+	server := spanNamed(t, spans, "GET /api/files")
+	if got := hex.EncodeToString(server.TraceID[:]); got != traceID {
+		t.Errorf("server span trace %s, want the caller's %s", got, traceID)
+	}
+	if got := hex.EncodeToString(server.ParentID[:]); got != parentID {
+		t.Errorf("server span parent %s, want the caller's %s", got, parentID)
+	}
+	child := spanNamed(t, spans, "mount.list")
+	assertChild(t, child, server)
+	if child.Kind != spanKindInternal {
+		t.Errorf("startSpan kind %d, want %d", child.Kind, spanKindInternal)
+	}
+}
+
+func TestWithTracingIgnoresUnsampledOrInvalidParents(t *testing.T) {
+	for _, header := range []string{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", // caller didn't sample
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01", // all-zero trace ID
+		"garbage",
+	} {
+		recorder := recordSpans(t)
+		handler := withTracing("/api/files", func(w http.ResponseWriter, r *http.Request) {})
+		r := httptest.NewRequest(http.MethodGet, "/api/files", nil)
+		r.Header.Set(traceparentHeader, header)
+		handler(httptest.NewRecorder(), r)
+
+		spans := recorder.Spans()
+		switch {
+		case strings.HasSuffix(header, "-00"):
+			if len(spans) != 0 {
+				t.Errorf("%s: exported %d spans from an unsampled trace", header, len(spans))
+			}
+		case len(spans) != 1:
+			t.Errorf("%s: recorded %d spans, want 1", header, len(spans))
+		case spans[0].ParentID != ([8]byte{}):
+			t.Errorf("%s: invalid header became parent %x", header, spans[0].ParentID)
+		}
+	}
+}
+
+func TestUploadSpans(t *testing.T) {
+	dir := setupUploadVolume(t)
+	recorder := recordSpans(t)
+
+	rec := httptest.NewRecorder()
+	withTracing("/api/upload", withAudit(uploadHandlerRClone))(rec, uploadRequest(t, "report.txt", "hello", map[string]string{"path": "/docs"}))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload: status %d: %s", rec.Code, rec.Body)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "docs", "report.txt")); err != nil || string(data) != "hello" {
+		t.Fatalf("uploaded file = %q, %v", data, err)
+	}
+
+	spans := recorder.Spans()
+	server := spanNamed(t, spans, "POST /api/upload")
+	parse := spanNamed(t, spans, "multipart.parse")
+	write := spanNamed(t, spans, "mount.write")
+	assertChild(t, parse, server)
+	assertChild(t, write, server)
+
+	if size, _ := parse.Attributes["http.request.body.size"].(int64); size <= 0 {
+		t.Errorf("multipart.parse body size = %v", parse.Attributes["http.request.body.size"])
+	}
+	if write.Attributes["file.path"] != "/docs/report.txt" || write.Attributes["file.size"] != int64(5) {
+		t.Errorf("mount.write attributes = %v", write.Attributes)
+	}
+	for _, span := range spans {
+		if span.Err != "" {
+			t.Errorf("%s recorded error %q", span.Name, span.Err)
+		}
+		if span.EndTime.IsZero() {
+			t.Errorf("%s was exported before it ended", span.Name)
+		}
+	}
+}
+
+func TestUploadSpansRecordErrors(t *testing.T) {
+	dir := setupUploadVolume(t)
+	recorder := recordSpans(t)
+
+	// A directory where the file should go: the upload is written, but can't
+	// be moved over it
+	if err := os.MkdirAll(filepath.Join(dir, "report.txt", "keep"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	withTracing("/api/upload", withAudit(uploadHandlerRClone))(rec, uploadRequest(t, "report.txt", "hello", map[string]string{"conflictAction": "replace"}))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("upload over a directory: status %d, want 500", rec.Code)
+	}
+
+	spans := recorder.Spans()
+	server := spanNamed(t, spans, "POST /api/upload")
+	write := spanNamed(t, spans, "mount.write")
+	assertChild(t, write, server)
+	if write.Err == "" {
+		t.Error("mount.write recorded no error")
+	}
+	if server.Err != "HTTP 500" {
+		t.Errorf("server span error %q, want \"HTTP 500\"", server.Err)
+	}
+
+	// A body that isn't a multipart form fails in multipart.parse
+	recorder = recordSpans(t)
+	r := httptest.NewRequest(http.MethodPost, "/api/upload", strings.NewReader("not a form"))
+	r.Header.Set("Content-Type", "multipart/form-data; boundary=missing")
+	withTracing("/api/upload", withAudit(uploadHandlerRClone))(httptest.NewRecorder(), r)
+
+	spans = recorder.Spans()
+	parse := spanNamed(t, spans, "multipart.parse")
+	assertChild(t, parse, spanNamed(t, spans, "POST /api/upload"))
+	if parse.Err == "" {
+		t.Error("multipart.parse recorded no error")
+	}
+}
+
+func TestNoopTracerRecordsNothing(t *testing.T) {
+	previous := tracer
+	tracer = NewTracer(nil, 1)
+	t.Cleanup(func() { tracer = previous })
+
+	called := false
+	withTracing("/api/files", func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		ctx, span := startSpan(r.Context(), "mount.list")
+		if span != nil || spanFromContext(ctx) != nil {
+			t.Error("no-op tracer allocated a span")
+		}
+		span.SetAttributes("k", "v") // nil spans are safe to use
+		span.RecordError(os.ErrNotExist)
+		span.End()
+	})(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/files", nil))
+	if !called {
+		t.Error("handler was not called")
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Hidden directory at the root of the mount holding per-user trash
+const trashDirName = ".trash"
+
+// TrashItem records where a deleted file or directory came from
+type TrashItem struct {
+	ID           string    `json:"id"`
+	User         string    `json:"user"`
+	Name         string    `json:"name"`
+	OriginalPath string    `json:"original_path"`
+	IsDir        bool      `json:"is_dir"`
+	Size         int64     `json:"size"`
+	DeletedAt    time.Time `json:"deleted_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+var (
+	trashEnabled bool
+	trashRoot    = filepath.Join(STORAGE_MOUNT, trashDirName)
+	trashMu      sync.Mutex // serializes moves in and out of the trash
+)
+
+// initTrash enables soft delete (trash.enabled) and starts the retention purger
+func initTrash() {
+	trashEnabled = currentConfig().Trash.Enabled
+	if !trashEnabled {
+		slog.Info("trash disabled, deletes are permanent")
+		return
+	}
+
+	go purgeTrashPeriodically(currentConfig().Trash.PurgeInterval)
+	slog.Info("trash enabled", "retention", currentConfig().Trash.Retention.String())
+}
+
+// isHiddenRootEntry reports whether a top-level mount entry is internal bookkeeping
+func isHiddenRootEntry(name string) bool {
+	return name == versionsDirName || name == trashDirName || name == sharesDirName ||
+		name == healthDirName || name == uploadsDirName || name == statsDirName || name == webhooksDirName
+}
+
+// isInternalPath reports whether a full mount path lies inside internal bookkeeping
+func isInternalPath(fullPath string) bool {
+	first, _, _ := strings.Cut(strings.TrimPrefix(fullPath, STORAGE_MOUNT+"/"), "/")
+	return fullPath != STORAGE_MOUNT && isHiddenRootEntry(first)
+}
+
+func userTrashDir(user string) string {
+	return filepath.Join(trashRoot, safeName(user))
+}
+
+// moveToTrash moves fullPath into the user's trash and records its origin
+func moveToTrash(user, fullPath string, info os.FileInfo) (*TrashItem, error) {
+	trashMu.Lock()
+	defer trashMu.Unlock()
+	return moveToTrashLocked(user, fullPath, info)
+}
+
+func moveToTrashLocked(user, fullPath string, info os.FileInfo) (*TrashItem, error) {
+	now := time.Now()
+	item := &TrashItem{
+		ID:           uuid.New().String(),
+		User:         user,
+		Name:         info.Name(),
+		OriginalPath: storageRelativePath(fullPath),
+		IsDir:        info.IsDir(),
+		DeletedAt:    now,
+		ExpiresAt:    now.Add(currentConfig().Trash.Retention),
+	}
+	if !info.IsDir() {
+		item.Size = info.Size()
+	}
+
+	itemDir := filepath.Join(userTrashDir(user), item.ID)
+	if err := os.MkdirAll(itemDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create trash dir: %w", err)
+	}
+
+	if err := movePath(fullPath, filepath.Join(itemDir, item.Name)); err != nil {
+		os.Remove(itemDir)
+		return nil, fmt.Errorf("failed to move to trash: %w", err)
+	}
+	if err := writeTrashItem(item); err != nil {
+		// The data is already in the trash - without metadata it can't be listed, so put it back
+		movePath(filepath.Join(itemDir, item.Name), fullPath)
+		os.Remove(itemDir)
+		return nil, err
+	}
+	trackMove(fullPath, filepath.Join(itemDir, item.Name))
+
+	return item, nil
+}
+
+func writeTrashItem(item *TrashItem) error {
+	data, err := json.MarshalIndent(item, "", "  ")
+	if err != nil {
+		return err
+	}
+	metaPath := filepath.Join(userTrashDir(item.User), item.ID+".json")
+	if err := os.WriteFile(metaPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write trash metadata: %w", err)
+	}
+	trackPath(metaPath, "")
+	return nil
+}
+
+// listTrash returns a user's trash items, most recently deleted first
+func listTrash(user string) ([]TrashItem, error) {
+	entries, err := os.ReadDir(userTrashDir(user))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []TrashItem{}, nil
+		}
+		return nil, err
+	}
+
+	items := []TrashItem{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		item, err := readTrashItem(user, strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			slog.Warn("skipping unreadable trash metadata", "file", entry.Name(), "error", err)
+			continue
+		}
+		items = append(items, *item)
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].DeletedAt.After(items[j].DeletedAt) })
+	return items, nil
+}
+
+func readTrashItem(user, id string) (*TrashItem, error) {
+	data, err := os.ReadFile(filepath.Join(userTrashDir(user), safeName(id)+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var item TrashItem
+	if err := json.Unmarshal(data, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// restoreFromTrash moves an item back to its original path. If that path is
+// taken, the item is renamed, or with conflictAction=replace whatever is there
+// goes to the user's trash in turn.
+func restoreFromTrash(user, id, conflictAction string) (string, error) {
+	trashMu.Lock()
+	defer trashMu.Unlock()
+
+	item, err := readTrashItem(user, id)
+	if err != nil {
+		return "", err
+	}
+
+	targetPath, err := resolveStoragePath(item.OriginalPath)
+	if err != nil {
+		return "", err
+	}
+	var replaced *TrashItem
+	if info, err := os.Stat(targetPath); err == nil {
+		if conflictAction == "replace" {
+			if replaced, err = moveToTrashLocked(user, targetPath, info); err != nil {
+				return "", err
+			}
+			slog.Info("moved replaced item to trash", "file", item.OriginalPath, "trash_id", replaced.ID)
+		} else {
+			targetPath = generateUniqueFilename(targetPath)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return "", err
+	}
+	itemDir := filepath.Join(userTrashDir(user), item.ID)
+	if err := movePath(filepath.Join(itemDir, item.Name), targetPath); err != nil {
+		if replaced != nil {
+			// Put back what was there
+			replacedPath := filepath.Join(userTrashDir(user), replaced.ID, replaced.Name)
+			if movePath(replacedPath, targetPath) == nil {
+				trackMove(replacedPath, targetPath)
+				removeTrashItem(replaced)
+			}
+		}
+		return "", fmt.Errorf("failed to restore from trash: %w", err)
+	}
+	trackMove(filepath.Join(itemDir, item.Name), targetPath)
+
+	removeTrashItem(item)
+	return storageRelativePath(targetPath), nil
+}
+
+// purgeTrashItem permanently deletes one trash item
+func purgeTrashItem(item *TrashItem) error {
+	itemDir := filepath.Join(userTrashDir(item.User), item.ID)
+	if err := os.RemoveAll(itemDir); err != nil {
+		return err
+	}
+	trackPath(itemDir, "")
+	removeTrashItem(item)
+	return nil
+}
+
+// removeTrashItem drops the bookkeeping of an item whose data is gone
+func removeTrashItem(item *TrashItem) {
+	os.Remove(filepath.Join(userTrashDir(item.User), item.ID))
+	metaPath := filepath.Join(userTrashDir(item.User), item.ID+".json")
+	os.Remove(metaPath)
+	trackPath(metaPath, "")
+}
+
+// purgeExpiredTrash removes items past their retention across all users
+func purgeExpiredTrash() (int, error) {
+	users, err := os.ReadDir(trashRoot)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	purged := 0
+	now := time.Now()
+	retention := currentConfig().Trash.Retention
+	for _, userEntry := range users {
+		if !userEntry.IsDir() {
+			continue
+		}
+		items, err := listTrash(userEntry.Name())
+		if err != nil {
+			slog.Error("failed to list trash", "trash_user", userEntry.Name(), "error", err)
+			continue
+		}
+		for i := range items {
+			if now.Before(items[i].DeletedAt.Add(retention)) {
+				continue
+			}
+			trashMu.Lock()
+			err := purgeTrashItem(&items[i])
+			trashMu.Unlock()
+			if err != nil {
+				slog.Error("failed to purge trash item", "trash_id", items[i].ID, "error", err)
+				continue
+			}
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func purgeTrashPeriodically(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-backgroundCtx.Done():
+			return
+		}
+
+		purged, err := purgeExpiredTrash()
+		if err != nil {
+			slog.Error("trash purge failed", "error", err)
+			continue
+		}
+		if purged > 0 {
+			slog.Info("purged expired trash items", "count", purged)
+		}
+	}
+}
+
+// trashHandlerRClone serves /api/trash:
+//
+//	GET                list the caller's trash
+//	DELETE ?id=        purge one item
+//	DELETE             empty the caller's trash
+func trashHandlerRClone(w http.ResponseWriter, r *http.Request) {
+	if !trashEnabled {
+		http.Error(w, "Trash is disabled", http.StatusNotImplemented)
+		return
+	}
+
+	user := requestUser(r)
+	id := r.URL.Query().Get("id")
+
+	switch r.Method {
+	case http.MethodGet:
+		items, err := listTrash(user)
+		if err != nil {
+			logFor(r.Context()).Error("failed to list trash", "error", err)
+			http.Error(w, fmt.Sprintf("Failed to list trash: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"items":     items,
+			"retention": currentConfig().Trash.Retention.String(),
+		})
+
+	case http.MethodDelete:
+		var items []TrashItem
+		if id != "" {
+			item, err := readTrashItem(user, id)
+			if err != nil {
+				http.Error(w, "Trash item not found", http.StatusNotFound)
+				return
+			}
+			items = []TrashItem{*item}
+		} else {
+			var err error
+			if items, err = listTrash(user); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to list trash: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		purged := 0
+		trashMu.Lock()
+		for i := range items {
+			event := audit(r, "purge", items[i].OriginalPath)
+			event.Size = items[i].Size
+			if err := purgeTrashItem(&items[i]); err != nil {
+				logFor(r.Context()).Error("failed to purge trash item", "trash_id", items[i].ID, "error", err)
+				event.Status = http.StatusInternalServerError
+				continue
+			}
+			purged++
+		}
+		trashMu.Unlock()
+
+		logFor(r.Context()).Info("purged trash items", "count", purged)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": purged == len(items),
+			"purged":  purged,
+			"message": fmt.Sprintf("Permanently deleted %d items", purged),
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// trashRestoreHandlerRClone moves a trash item back (POST /api/trash/restore?id=&conflictAction=)
+func trashRestoreHandlerRClone(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !trashEnabled {
+		http.Error(w, "Trash is disabled", http.StatusNotImplemented)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Trash item ID required", http.StatusBadRequest)
+		return
+	}
+
+	user := requestUser(r)
+	event := audit(r, "restore", "")
+	if item, err := readTrashItem(user, id); err == nil {
+		event.Path, event.Size = item.OriginalPath, item.Size
+	}
+
+	restoredPath, err := restoreFromTrash(user, id, r.URL.Query().Get("conflictAction"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Trash item not found", http.StatusNotFound)
+			return
+		}
+		logFor(r.Context()).Error("failed to restore trash item", "trash_id", id, "error", err)
+		http.Error(w, fmt.Sprintf("Failed to restore: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	event.Target = restoredPath
+	logFor(r.Context()).Info("restored trash item", "trash_id", id, "file", restoredPath)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"path":    restoredPath,
+		"message": fmt.Sprintf("Restored to %s", restoredPath),
+	})
+}
+
+// movePath renames src to dst, falling back to copy+delete where the mount
+// can't rename (e.g. non-empty directories on S3 remotes)
+func movePath(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return copyFile(src, dst)
+	}
+
+	err = filepath.WalkDir(src, func(walkPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, strings.TrimPrefix(walkPath, src))
+		if entry.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		return copyFile(walkPath, target)
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// trashFile writes content at relativePath and moves it to user's trash
+func trashFile(t *testing.T, dir, user, relativePath, content string) *TrashItem {
+	t.Helper()
+	fullPath := filepath.Join(dir, relativePath)
+	writeFile(t, fullPath, content)
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err := moveToTrash(user, fullPath, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return item
+}
+
+func TestRestoreFromTrash(t *testing.T) {
+	tests := []struct {
+		name     string
+		action   string
+		conflict string // what is at the original path by then: "", "file" or "dir"
+		renamed  bool
+		replaced bool
+	}{
+		{"free path", "", "", false, false},
+		{"rename", "rename", "file", true, false},
+		{"default is rename", "", "file", true, false},
+		{"replace file", "replace", "file", false, true},
+		{"replace directory", "replace", "dir", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := setupUploadVolume(t)
+			item := trashFile(t, dir, "alice", "docs/a.txt", "old")
+			original := filepath.Join(dir, "docs", "a.txt")
+			switch tt.conflict {
+			case "file":
+				writeFile(t, original, "new")
+			case "dir":
+				writeFile(t, filepath.Join(original, "nested.txt"), "new")
+			}
+
+			restored, err := restoreFromTrash("alice", item.ID, tt.action)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if renamed := restored != "/docs/a.txt"; renamed != tt.renamed {
+				t.Fatalf("restored to %s", restored)
+			}
+			assertContent(t, filepath.Join(dir, restored), "old")
+			if tt.renamed {
+				assertContent(t, original, "new")
+			}
+
+			items, err := listTrash("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.replaced {
+				if len(items) != 0 {
+					t.Errorf("trash = %v, want empty", items)
+				}
+				return
+			}
+			// What the restore replaced is in the trash, not gone
+			if len(items) != 1 || items[0].OriginalPath != "/docs/a.txt" || items[0].IsDir != (tt.conflict == "dir") {
+				t.Fatalf("trash = %+v, want the replaced %s", items, tt.conflict)
+			}
+			trashed := filepath.Join(userTrashDir("alice"), items[0].ID, "a.txt")
+			if tt.conflict == "dir" {
+				trashed = filepath.Join(trashed, "nested.txt")
+			}
+			assertContent(t, trashed, "new")
+		})
+	}
+}
+
+func TestRestoreFromTrashFailedReplace(t *testing.T) {
+	dir := setupUploadVolume(t)
+	item := trashFile(t, dir, "alice", "docs/a.txt", "old")
+	writeFile(t, filepath.Join(dir, "docs", "a.txt"), "new")
+	// The trashed data went missing, so there is nothing to restore
+	os.RemoveAll(filepath.Join(userTrashDir("alice"), item.ID, item.Name))
+
+	if _, err := restoreFromTrash("alice", item.ID, "replace"); err == nil {
+		t.Fatal("restore without data succeeded")
+	}
+	assertContent(t, filepath.Join(dir, "docs", "a.txt"), "new")
+	items, _ := listTrash("alice")
+	if len(items) != 1 || items[0].ID != item.ID {
+		t.Errorf("trash = %+v, want only the original item", items)
+	}
+}
+
+func TestPurgeExpiredTrash(t *testing.T) {
+	dir := setupUploadVolume(t)
+	expired := trashFile(t, dir, "alice", "old.txt", "old")
+	expired.DeletedAt = time.Now().Add(-currentConfig().Trash.Retention - time.Hour)
+	if err := writeTrashItem(expired); err != nil {
+		t.Fatal(err)
+	}
+	recent := trashFile(t, dir, "bob", "new.txt", "new")
+
+	purged, err := purgeExpiredTrash()
+	if err != nil || purged != 1 {
+		t.Fatalf("purged %d, %v; want 1", purged, err)
+	}
+	if _, err := os.Stat(filepath.Join(userTrashDir("alice"), expired.ID)); !os.IsNotExist(err) {
+		t.Errorf("expired item still on disk: %v", err)
+	}
+	items, _ := listTrash("bob")
+	if len(items) != 1 || items[0].ID != recent.ID {
+		t.Errorf("bob's trash = %+v, want the recent item", items)
+	}
+	assertContent(t, filepath.Join(userTrashDir("bob"), recent.ID, "new.txt"), "new")
+}
+
+func TestTrashItemsStayOutOfReach(t *testing.T) {
+	dir := setupUploadVolume(t)
+	item := trashFile(t, dir, "alice", "docs/a.txt", "old")
+	if _, err := readTrashItem("bob", item.ID); !os.IsNotExist(err) {
+		t.Errorf("bob read alice's trash item: %v", err)
+	}
+	if _, err := readTrashItem("alice", "../bob/"+item.ID); err == nil {
+		t.Errorf("trash id escaping the user's trash accepted: %v", err)
+	}
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -13,6 +13,29 @@ import (
 	"github.com/google/uuid"
 )
 
+// uploadDir is the folder an upload goes to: the one requested, or uploads.path
+func uploadDir(requested string) string {
+	if requested == "" || requested == "/" {
+		return "/" + currentConfig().Uploads.Path
+	}
+	return requested
+}
+
+// allowedFileType checks a file name against uploads.allowed_file_types
+func allowedFileType(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range currentConfig().Uploads.AllowedFileTypes {
+		if ext == "*" || strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeFileTypeNotAllowed(w http.ResponseWriter) {
+	http.Error(w, "File type not allowed", http.StatusUnsupportedMediaType)
+}
+
 // Upload handler using RClone POSIX operations
 func uploadHandlerRClone(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -21,27 +44,33 @@ func uploadHandlerRClone(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Parse multipart form
-	err := r.ParseMultipartForm(100 << 20) // 100 MB memory buffer
+	err := parseMultipartForm(r, 100<<20) // 100 MB memory buffer
 	if err != nil {
-		log.Printf("Failed to parse form: %v", err)
-		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		logFor(r.Context()).Warn("failed to parse upload form", "error", err)
+		writeBodyError(w, err, "Failed to parse form")
 		return
 	}
 
 	file, handler, err := r.FormFile("file")
 	if err != nil {
-		log.Printf("Failed to get file from form: %v", err)
+		logFor(r.Context()).Warn("upload form has no file", "error", err)
 		http.Error(w, "Failed to get file", http.StatusBadRequest)
 		return
 	}
 	defer file.Close()
+	if !allowedFileType(handler.Filename) {
+		writeFileTypeNotAllowed(w)
+		return
+	}
 
-	// Get the upload path from form
-	uploadPath := r.FormValue("path")
-	if uploadPath == "" {
-		uploadPath = "/"
+	vol, ok := lookupVolume(w, r.FormValue("volume"))
+	if !ok {
+		return
 	}
 
+	// Get the upload path from form
+	uploadPath := uploadDir(r.FormValue("path"))
+
 	// Get conflict resolution strategy
 	conflictAction := r.FormValue("conflictAction")
 	if conflictAction == "" {
@@ -51,19 +80,48 @@ func uploadHandlerRClone(w http.ResponseWriter, r *http.Request) {
 	// Construct full path in RClone
 	var targetPath string
 	if uploadPath == "/" || uploadPath == "" {
-		targetPath = filepath.Join(STORAGE_MOUNT, handler.Filename)
+		targetPath = filepath.Join(vol.Mount, handler.Filename)
 	} else {
 		// Clean the path and ensure it's relative
 		uploadPath = strings.TrimPrefix(filepath.Clean(uploadPath), "/")
-		targetPath = filepath.Join(STORAGE_MOUNT, uploadPath, handler.Filename)
+		targetPath = filepath.Join(vol.Mount, uploadPath, handler.Filename)
+	}
+
+	event := audit(r, "upload", vol.qualify(vol.relative(targetPath)))
+	event.Size = handler.Size
+
+	response, err := saveUploadRClone(r.Context(), vol, requestUser(r), file, targetPath, conflictAction)
+	if err == errInvalidUploadPath {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logFor(r.Context()).Error("failed to save upload", "error", err)
+		http.Error(w, "Failed to upload file", http.StatusInternalServerError)
+		return
+	}
+	event.Path = vol.qualify(response.Path)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// errInvalidUploadPath is returned when an upload target escapes the volume
+var errInvalidUploadPath = fmt.Errorf("invalid upload path")
+
+// saveUploadRClone writes an uploaded file to targetPath in the volume on
+// behalf of user, resolving name conflicts by renaming (default) or replacing
+// the existing file
+func saveUploadRClone(ctx context.Context, vol *Volume, user string, file io.Reader, targetPath, conflictAction string) (*UploadResponse, error) {
+	// Security: Ensure path doesn't escape the volume
+	if !strings.HasPrefix(filepath.Clean(targetPath), vol.Mount+"/") || vol.internal(filepath.Clean(targetPath)) {
+		return nil, errInvalidUploadPath
 	}
 
 	// Ensure directory exists
 	targetDir := filepath.Dir(targetPath)
 	if err := os.MkdirAll(targetDir, 0755); err != nil {
-		log.Printf("Failed to create directory: %v", err)
-		http.Error(w, "Failed to create directory", http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("failed to create directory: %w", err)
 	}
 
 	// Check if file exists and handle conflict
@@ -72,49 +130,84 @@ func uploadHandlerRClone(w http.ResponseWriter, r *http.Request) {
 	if _, err := os.Stat(targetPath); err == nil {
 		fileExists = true
 		if conflictAction == "replace" {
-			// Remove existing file
-			log.Printf("File exists, replacing: %s", targetPath)
+			logFor(ctx).Info("replacing existing file", "file", vol.qualify(vol.relative(targetPath)))
 		} else {
 			// Generate unique filename
-			ext := filepath.Ext(handler.Filename)
-			nameWithoutExt := strings.TrimSuffix(handler.Filename, ext)
+			filename := filepath.Base(targetPath)
+			ext := filepath.Ext(filename)
+			nameWithoutExt := strings.TrimSuffix(filename, ext)
 			shortUUID := uuid.New().String()[:8]
 			newFilename := fmt.Sprintf("%s_%s%s", nameWithoutExt, shortUUID, ext)
 			targetPath = filepath.Join(targetDir, newFilename)
-			log.Printf("File exists, renaming to: %s", targetPath)
+			logFor(ctx).Info("file exists, renaming upload", "file", vol.qualify(vol.relative(targetPath)))
 		}
 	}
 
-	// Create the file in RClone
-	outFile, err := os.Create(targetPath)
+	_, span := startSpan(ctx, "mount.write", "file.path", vol.qualify(vol.relative(targetPath)))
+	defer span.End()
+
+	// Write next to the target and move it into place once complete, so a
+	// failed upload never leaves a truncated file or takes the one it replaces
+	partialPath := filepath.Join(targetDir, fmt.Sprintf(".%s.%s.partial", filepath.Base(targetPath), uuid.New().String()[:8]))
+	outFile, err := os.Create(partialPath)
 	if err != nil {
-		log.Printf("Failed to create file in RClone: %v", err)
-		http.Error(w, "Failed to create file", http.StatusInternalServerError)
-		return
+		metrics.BackendError("mount_write")
+		span.RecordError(err)
+		notifyUploadFailed(vol, targetPath, user, "failed to create file")
+		return nil, fmt.Errorf("failed to create file: %w", err)
 	}
-	defer outFile.Close()
 
-	// Copy data to RClone file
 	written, err := io.Copy(outFile, file)
+	metrics.AddBytesUploaded(written)
+	span.SetAttributes("file.size", written)
+	if closeErr := outFile.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		log.Printf("Failed to write file to RClone: %v", err)
-		http.Error(w, "Failed to write file", http.StatusInternalServerError)
-		return
+		span.RecordError(err)
+		os.Remove(partialPath)
+		notifyUploadFailed(vol, targetPath, user, "failed to write file")
+		return nil, fmt.Errorf("failed to write file: %w", err)
 	}
 
-	// Get relative path for response
-	relativePath := strings.TrimPrefix(targetPath, STORAGE_MOUNT)
-	if !strings.HasPrefix(relativePath, "/") {
-		relativePath = "/" + relativePath
+	// Keep the content being replaced as a version (no-op when versioning is
+	// off, and versions are only kept for the default volume)
+	unarchive := func() {}
+	if fileExists && conflictAction == "replace" && vol.Default {
+		_, archiveSpan := startSpan(ctx, "version.archive", "file.path", storageRelativePath(targetPath))
+		unarchive, err = ArchiveCurrentVersion(targetPath)
+		archiveSpan.RecordError(err)
+		archiveSpan.End()
+		if err != nil {
+			os.Remove(partialPath)
+			notifyUploadFailed(vol, targetPath, user, "failed to preserve previous version")
+			return nil, fmt.Errorf("failed to preserve previous version: %w", err)
+		}
+	}
+	if err := os.Rename(partialPath, targetPath); err != nil {
+		metrics.BackendError("mount_write")
+		span.RecordError(err)
+		os.Remove(partialPath)
+		unarchive()
+		notifyUploadFailed(vol, targetPath, user, "failed to write file")
+		return nil, fmt.Errorf("failed to move upload into place: %w", err)
 	}
 
-	log.Printf("Successfully uploaded file to RClone: %s (%d bytes)", relativePath, written)
+	// Get relative path for response
+	relativePath := vol.relative(targetPath)
 
-	// Invalidate stats cache after successful upload
-	InvalidateStatsCache()
+	logFor(ctx).Info("upload saved", "file", vol.qualify(relativePath), "size", written)
 
-	// Return success response
-	response := UploadResponse{
+	trackFile(targetPath, written, user)
+	InvalidateThumbnails(vol.qualify(relativePath))
+
+	eventType := eventFileCreated
+	if fileExists && conflictAction == "replace" {
+		eventType = eventFileReplaced
+	}
+	notify(WebhookEvent{Type: eventType, Path: vol.qualify(relativePath), Size: written, User: user})
+
+	response := &UploadResponse{
 		Success:    true,
 		Path:       relativePath,
 		Message:    "File uploaded successfully",
@@ -123,16 +216,15 @@ func uploadHandlerRClone(w http.ResponseWriter, r *http.Request) {
 
 	if fileExists {
 		response.OriginalName = filepath.Base(originalPath)
-		if conflictAction == "rename" {
+		if conflictAction == "replace" {
+			response.ConflictAction = "replaced"
+			response.Message = "File replaced successfully"
+		} else {
 			response.ConflictAction = "renamed"
 			response.RenamedTo = filepath.Base(targetPath)
 			response.Message = fmt.Sprintf("File renamed to %s (original already exists)", filepath.Base(targetPath))
-		} else {
-			response.ConflictAction = "replaced"
-			response.Message = "File replaced successfully"
 		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	return response, nil
 }
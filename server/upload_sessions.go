@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// recentUploadsLimit is how many finished chunked uploads /api/admin/uploads remembers
+const recentUploadsLimit = 100
+
+// recentUploads keeps the last finished chunked uploads, newest last
+var recentUploads = &finishedUploads{}
+
+type finishedUploads struct {
+	mu      sync.Mutex
+	entries []FinishedUpload
+}
+
+// FinishedUpload is a chunked upload that completed, failed or was aborted
+type FinishedUpload struct {
+	SessionID      string    `json:"session_id"`
+	User           string    `json:"user"`
+	Path           string    `json:"path"`
+	Status         string    `json:"status"` // completed, failed, aborted
+	Error          string    `json:"error,omitempty"`
+	AbortedBy      string    `json:"aborted_by,omitempty"`
+	Parts          int       `json:"parts"`
+	TotalParts     int       `json:"total_parts"`
+	Bytes          int64     `json:"bytes"`
+	StartedAt      time.Time `json:"started_at"`
+	FinishedAt     time.Time `json:"finished_at"`
+	DurationMs     int64     `json:"duration_ms"`
+	BytesPerSecond float64   `json:"bytes_per_second"`
+}
+
+// add records how a session ended and returns the record
+func (f *finishedUploads) add(session *ChunkUploadSessionRClone, status, errMsg, abortedBy string) FinishedUpload {
+	session.mu.Lock()
+	parts, bytes := len(session.ReceivedParts), session.BytesReceived
+	session.mu.Unlock()
+
+	now := time.Now()
+	duration := now.Sub(session.StartTime)
+	entry := FinishedUpload{
+		SessionID:  session.SessionID,
+		User:       session.User,
+		Path:       session.displayPath(),
+		Status:     status,
+		Error:      errMsg,
+		AbortedBy:  abortedBy,
+		Parts:      parts,
+		TotalParts: session.TotalParts,
+		Bytes:      bytes,
+		StartedAt:  session.StartTime,
+		FinishedAt: now,
+		DurationMs: duration.Milliseconds(),
+	}
+	if duration > 0 {
+		entry.BytesPerSecond = float64(bytes) / duration.Seconds()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries = append(f.entries, entry)
+	if len(f.entries) > recentUploadsLimit {
+		f.entries = f.entries[len(f.entries)-recentUploadsLimit:]
+	}
+	return entry
+}
+
+// list returns the finished uploads, newest first
+func (f *finishedUploads) list() []FinishedUpload {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entries := make([]FinishedUpload, len(f.entries))
+	for i, entry := range f.entries {
+		entries[len(entries)-1-i] = entry
+	}
+	return entries
+}
+
+// removeChunkedSession ends a chunked upload: the session is dropped, its
+// temp file deleted and its file request reservation released. A chunk
+// being written fails. It returns nil if there is no such session.
+func removeChunkedSession(id string) *ChunkUploadSessionRClone {
+	sessionsRCloneMu.Lock()
+	session, exists := uploadSessionsRClone[id]
+	delete(uploadSessionsRClone, id)
+	sessionsRCloneMu.Unlock()
+	if !exists {
+		return nil
+	}
+
+	session.TempFile.Close()
+	os.Remove(session.TempFile.Name())
+	if session.Share != nil {
+		releaseShareUpload(session.Share)
+	}
+	return session
+}
+
+// ActiveUpload is a chunked upload in progress, as listed by /api/admin/uploads
+type ActiveUpload struct {
+	SessionID     string    `json:"session_id"`
+	User          string    `json:"user"`
+	Client        string    `json:"client"` // see clientKey
+	Path          string    `json:"path"`
+	ShareID       string    `json:"share_id,omitempty"`
+	PartsReceived int       `json:"parts_received"`
+	TotalParts    int       `json:"total_parts"`
+	BytesReceived int64     `json:"bytes_received"`
+	FileSize      int64     `json:"file_size"`
+	StartedAt     time.Time `json:"started_at"`
+	Age           string    `json:"age"`
+	Idle          string    `json:"idle"` // since the last chunk, or the start
+	TempFile      string    `json:"temp_file"`
+	TempFileBytes int64     `json:"temp_file_bytes"` // on disk
+}
+
+// chunkedUploads lists the chunked uploads in progress, oldest first
+func chunkedUploads() []ActiveUpload {
+	sessionsRCloneMu.RLock()
+	sessions := make([]*ChunkUploadSessionRClone, 0, len(uploadSessionsRClone))
+	for _, session := range uploadSessionsRClone {
+		sessions = append(sessions, session)
+	}
+	sessionsRCloneMu.RUnlock()
+
+	now := time.Now()
+	uploads := make([]ActiveUpload, 0, len(sessions))
+	for _, session := range sessions {
+		session.mu.Lock()
+		upload := ActiveUpload{
+			SessionID:     session.SessionID,
+			User:          session.User,
+			Client:        session.Owner,
+			Path:          session.displayPath(),
+			PartsReceived: len(session.ReceivedParts),
+			TotalParts:    session.TotalParts,
+			BytesReceived: session.BytesReceived,
+			FileSize:      session.FileSize,
+			StartedAt:     session.StartTime,
+			Age:           now.Sub(session.StartTime).Round(time.Second).String(),
+			TempFile:      session.TempFile.Name(),
+		}
+		lastActivity := session.LastChunk
+		session.mu.Unlock()
+
+		if lastActivity.IsZero() {
+			lastActivity = session.StartTime
+		}
+		upload.Idle = now.Sub(lastActivity).Round(time.Second).String()
+		if session.Share != nil {
+			upload.ShareID = session.Share.ID
+		}
+		if info, err := os.Stat(upload.TempFile); err == nil {
+			upload.TempFileBytes = info.Size()
+		}
+		uploads = append(uploads, upload)
+	}
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].StartedAt.Before(uploads[j].StartedAt) })
+	return uploads
+}
+
+// adminUploadsHandler serves /api/admin/uploads to admins:
+//
+//	GET                  active chunked uploads and the recently finished ones
+//	DELETE ?session_id=  abort an active chunked upload
+func adminUploadsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "Admin access required", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(map[string]any{
+			"sessions":   chunkedUploads(),
+			"recent":     recentUploads.list(),
+			"temp_bytes": tempUploadBytes(),
+		})
+
+	case http.MethodDelete:
+		sessionID := r.URL.Query().Get("session_id")
+		if sessionID == "" {
+			http.Error(w, "Session ID required", http.StatusBadRequest)
+			return
+		}
+		session := removeChunkedSession(sessionID)
+		if session == nil {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		entry := recentUploads.add(session, "aborted", "", requestUser(r))
+		audit(r, "abort", entry.Path).Size = entry.Bytes
+
+		logFor(r.Context()).Info("chunked upload aborted by admin", "session_id", sessionID,
+			"file", entry.Path, "upload_user", entry.User, "bytes", entry.Bytes)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(MultipartResponse{
+			Success: true,
+			Message: fmt.Sprintf("Upload of %s aborted", entry.Path),
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// statsDirName holds the usage bookkeeping: who uploaded which file and the
+// usage history
+const statsDirName = ".stats"
+
+// ownersFileName maps object keys to the user who uploaded them. Bucket
+// events and listings don't say who wrote a file, so per-user totals depend
+// on it across restarts and replicas.
+const ownersFileName = "owners.json"
+
+// usageKey maps a full path on the default volume's mount to its object key
+func usageKey(fullPath string) (string, bool) {
+	if !strings.HasPrefix(fullPath, STORAGE_MOUNT+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(fullPath, STORAGE_MOUNT+"/"), true
+}
+
+// trackPath tells the usage index what is now at fullPath, a file or a
+// directory on the default volume that was written, replaced or removed.
+// Files are attributed to user; an empty user keeps the recorded owners.
+// Paths on other volumes aren't indexed and are ignored.
+func trackPath(fullPath, user string) {
+	key, ok := usageKey(fullPath)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	found := make(map[string]indexedFile)
+	// A path that no longer exists finds nothing, so the index drops it
+	filepath.WalkDir(fullPath, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		k, _ := usageKey(p)
+		found[k] = indexedFile{size: info.Size(), modified: info.ModTime(), indexed: now, owner: user}
+		return nil
+	})
+	usage.replaceTree(key, found)
+}
+
+// trackFile tells the usage index about a file of size just written at
+// fullPath by user, without looking at the mount
+func trackFile(fullPath string, size int64, user string) {
+	if key, ok := usageKey(fullPath); ok {
+		usage.put(key, size, time.Now(), user)
+	}
+}
+
+// trackMove tells the usage index that a file or directory moved from one full
+// path to another. Files keep their owners within the default volume.
+func trackMove(from, to string) {
+	fromKey, fromIndexed := usageKey(from)
+	toKey, toIndexed := usageKey(to)
+	switch {
+	case fromIndexed && toIndexed:
+		usage.moveTree(fromKey, toKey)
+	case fromIndexed:
+		usage.removeTree(fromKey)
+	case toIndexed:
+		trackPath(to, "")
+	}
+}
+
+// syncOwners saves the owner changes made since the last call, merged into
+// the owners file so replicas don't overwrite each other's, and takes over
+// the owners other replicas recorded. Until the first listing has filled
+// the index, the loaded owners are held for it to place.
+func (x *usageIndex) syncOwners() error {
+	x.mu.Lock()
+	changes := x.ownerChanges
+	x.ownerChanges = make(map[string]string)
+	x.mu.Unlock()
+
+	owners := make(map[string]string)
+	err := readStatsFile(ownersFileName, &owners)
+	if err == nil && len(changes) > 0 {
+		for key, owner := range changes {
+			if owner == "" {
+				delete(owners, key)
+			} else {
+				owners[key] = owner
+			}
+		}
+		err = writeStatsFile(ownersFileName, owners)
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err != nil {
+		// Keep the changes for the next attempt, unless they were superseded meanwhile
+		for key, owner := range changes {
+			if _, ok := x.ownerChanges[key]; !ok {
+				x.ownerChanges[key] = owner
+			}
+		}
+		return err
+	}
+	if !x.ready {
+		x.owners = owners
+		return nil
+	}
+	for key, owner := range owners {
+		f, ok := x.files[key]
+		if _, pending := x.ownerChanges[key]; !ok || pending || f.owner == owner {
+			continue
+		}
+		x.account(key, f, -1)
+		f.owner = owner
+		x.files[key] = f
+		x.account(key, f, 1)
+		x.revision.Add(1)
+	}
+	return nil
+}
+
+// persistOwners syncs the owners file every minute until ctx is cancelled
+func (x *usageIndex) persistOwners(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		if err := x.syncOwners(); err != nil {
+			slog.Warn("failed to sync file owners", "error", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// readStatsFile decodes a file in the stats dir into v, leaving v as it is if there's no file
+func readStatsFile(name string, v any) error {
+	data, err := os.ReadFile(filepath.Join(STORAGE_MOUNT, statsDirName, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeStatsFile replaces a file in the stats dir through a rename, so a
+// crash can't leave it half written
+func writeStatsFile(name string, v any) error {
+	dir := filepath.Join(STORAGE_MOUNT, statsDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, name+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, name))
+}
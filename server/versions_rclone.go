@@ -0,0 +1,742 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+)
+
+// Hidden directory at the root of the mount holding prior versions (mount mode)
+const versionsDirName = ".versions"
+
+// latestVersionID addresses the current content of a file in the versions API
+const latestVersionID = "latest"
+
+// VersionInfo describes one stored version of a file
+type VersionInfo struct {
+	VersionID      string    `json:"version_id"`
+	Size           int64     `json:"size"`
+	Modified       time.Time `json:"modified"`
+	IsLatest       bool      `json:"is_latest"`
+	IsDeleteMarker bool      `json:"is_delete_marker,omitempty"`
+}
+
+// VersionPolicy controls which noncurrent versions are pruned
+type VersionPolicy struct {
+	MaxVersions int           // noncurrent versions to keep per file, 0 = unlimited
+	MaxAge      time.Duration // drop noncurrent versions older than this, 0 = unlimited
+}
+
+// VersionStore keeps prior file contents when a file is replaced
+type VersionStore interface {
+	// Archive preserves the current content of relativePath before it is
+	// overwritten. Should the overwrite fail, undo puts that content back.
+	Archive(relativePath string) (undo func() error, err error)
+	// List returns all versions of a file, newest first
+	List(ctx context.Context, relativePath string) ([]VersionInfo, error)
+	// Open returns the content of a single version
+	Open(ctx context.Context, relativePath, versionID string) (io.ReadCloser, VersionInfo, error)
+	// Restore makes a prior version the current content, keeping the replaced one as a version
+	Restore(ctx context.Context, relativePath, versionID string) error
+	// Delete permanently removes a single noncurrent version
+	Delete(ctx context.Context, relativePath, versionID string) error
+	// Prune applies the policy to one file, or to every file when relativePath is empty
+	Prune(ctx context.Context, relativePath string, policy VersionPolicy) (int, error)
+}
+
+var versionStore VersionStore // nil when versioning is disabled
+
+// currentVersionPolicy returns the retention policy from versioning.*
+func currentVersionPolicy() VersionPolicy {
+	settings := currentConfig().Versioning
+	return VersionPolicy{MaxVersions: settings.MaxVersions, MaxAge: settings.MaxAge}
+}
+
+var errVersionNotFound = fmt.Errorf("version not found")
+
+// initVersioning selects the version store from versioning.mode (off, s3, mount)
+func initVersioning() error {
+	settings := currentConfig().Versioning
+	mode := settings.Mode
+	switch mode {
+	case "", "off":
+		slog.Info("object versioning disabled")
+		return nil
+	case "s3":
+		ctx := context.Background()
+		if err := minioClient.EnableVersioning(ctx, bucketName); err != nil {
+			return fmt.Errorf("failed to enable bucket versioning: %w", err)
+		}
+		versionStore = &s3VersionStore{}
+	case "mount":
+		if err := os.MkdirAll(filepath.Join(STORAGE_MOUNT, versionsDirName), 0755); err != nil {
+			return fmt.Errorf("failed to create versions dir: %w", err)
+		}
+		versionStore = &mountVersionStore{root: filepath.Join(STORAGE_MOUNT, versionsDirName)}
+	default:
+		return fmt.Errorf("unknown versioning.mode %q (expected off, s3 or mount)", mode)
+	}
+
+	slog.Info("object versioning enabled", "mode", mode,
+		"max_versions", settings.MaxVersions, "max_age", settings.MaxAge.String())
+
+	go pruneVersionsPeriodically(settings.PruneInterval)
+	return nil
+}
+
+// ArchiveCurrentVersion is called by upload handlers right before a file is
+// overwritten. If writing the new content then fails, unarchive puts the
+// archived file back, so the path isn't left without its content.
+func ArchiveCurrentVersion(fullPath string) (unarchive func(), err error) {
+	unarchive = func() {}
+	if versionStore == nil {
+		return unarchive, nil
+	}
+	if info, err := os.Stat(fullPath); err != nil || !info.Mode().IsRegular() {
+		return unarchive, nil // nothing to preserve; only files have versions
+	}
+	relativePath := storageRelativePath(fullPath)
+	undo, err := versionStore.Archive(relativePath)
+	if err != nil {
+		return unarchive, err
+	}
+	return func() {
+		if err := undo(); err != nil {
+			slog.Error("failed to put back archived version", "file", relativePath, "error", err)
+		}
+	}, nil
+}
+
+func pruneVersionsPeriodically(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-backgroundCtx.Done():
+			return
+		}
+
+		pruned, err := versionStore.Prune(backgroundCtx, "", currentVersionPolicy())
+		if err != nil {
+			slog.Error("version pruning failed", "error", err)
+			continue
+		}
+		if pruned > 0 {
+			slog.Info("pruned old versions", "count", pruned)
+		}
+	}
+}
+
+// versionsHandlerRClone serves /api/versions/{path}:
+//
+//	GET                   list versions
+//	GET    ?version_id=   download a version
+//	POST   ?version_id=   restore a version as current
+//	DELETE ?version_id=   delete a version
+//	DELETE [?keep=&max_age=] prune versions by policy
+func versionsHandlerRClone(w http.ResponseWriter, r *http.Request) {
+	if versionStore == nil {
+		http.Error(w, "Versioning is disabled", http.StatusNotImplemented)
+		return
+	}
+
+	filePath := strings.TrimPrefix(r.URL.Path, "/api/versions/")
+	if filePath == "" {
+		http.Error(w, "File path required", http.StatusBadRequest)
+		return
+	}
+
+	fullPath, err := resolveStoragePath(filePath)
+	if err == nil && isInternalPath(fullPath) {
+		err = fmt.Errorf("path %s is internal", filePath)
+	}
+	if err != nil {
+		logFor(r.Context()).Warn("rejected version path", "error", err)
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	relativePath := storageRelativePath(fullPath)
+	versionID := r.URL.Query().Get("version_id")
+	ctx := r.Context()
+
+	switch {
+	case r.Method == http.MethodGet && versionID == "":
+		versions, err := versionStore.List(ctx, relativePath)
+		if err != nil {
+			logFor(r.Context()).Error("failed to list versions", "file", relativePath, "error", err)
+			http.Error(w, fmt.Sprintf("Failed to list versions: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if len(versions) == 0 {
+			http.Error(w, fmt.Sprintf("File not found: %s", relativePath), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"path":     relativePath,
+			"versions": versions,
+		})
+
+	case r.Method == http.MethodGet:
+		event := audit(r, "download", relativePath)
+		event.VersionID = versionID
+
+		reader, version, err := versionStore.Open(ctx, relativePath, versionID)
+		if err != nil {
+			writeVersionError(w, r, relativePath, versionID, err)
+			return
+		}
+		defer reader.Close()
+
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", path.Base(relativePath)))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(version.Size, 10))
+		written, err := io.Copy(w, reader)
+		metrics.AddBytesDownloaded(written)
+		event.Size = written
+		if err != nil {
+			logFor(r.Context()).Warn("version download interrupted", "file", relativePath, "version_id", versionID, "error", err)
+			return
+		}
+		logFor(r.Context()).Debug("version download streamed", "file", relativePath, "version_id", versionID, "size", written)
+
+	case r.Method == http.MethodPost && versionID != "":
+		audit(r, "restore", relativePath).VersionID = versionID
+		if err := versionStore.Restore(ctx, relativePath, versionID); err != nil {
+			writeVersionError(w, r, relativePath, versionID, err)
+			return
+		}
+		logFor(r.Context()).Info("version restored", "file", relativePath, "version_id", versionID)
+
+		trackPath(fullPath, requestUser(r))
+		InvalidateThumbnails(relativePath)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"message": fmt.Sprintf("Version %s restored", versionID),
+		})
+
+	case r.Method == http.MethodDelete && versionID != "":
+		audit(r, "purge", relativePath).VersionID = versionID
+		if err := versionStore.Delete(ctx, relativePath, versionID); err != nil {
+			writeVersionError(w, r, relativePath, versionID, err)
+			return
+		}
+		logFor(r.Context()).Info("version deleted", "file", relativePath, "version_id", versionID)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"message": fmt.Sprintf("Version %s deleted", versionID),
+		})
+
+	case r.Method == http.MethodDelete:
+		policy := currentVersionPolicy()
+		if keep := r.URL.Query().Get("keep"); keep != "" {
+			if policy.MaxVersions, err = strconv.Atoi(keep); err != nil || policy.MaxVersions < 0 {
+				http.Error(w, "Invalid keep value", http.StatusBadRequest)
+				return
+			}
+		}
+		if maxAge := r.URL.Query().Get("max_age"); maxAge != "" {
+			if policy.MaxAge, err = time.ParseDuration(maxAge); err != nil || policy.MaxAge < 0 {
+				http.Error(w, "Invalid max_age value", http.StatusBadRequest)
+				return
+			}
+		}
+
+		audit(r, "purge", relativePath)
+		pruned, err := versionStore.Prune(ctx, relativePath, policy)
+		if err != nil {
+			logFor(r.Context()).Error("failed to prune versions", "file", relativePath, "error", err)
+			http.Error(w, fmt.Sprintf("Failed to prune versions: %v", err), http.StatusInternalServerError)
+			return
+		}
+		logFor(r.Context()).Info("pruned versions", "file", relativePath, "count", pruned)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"pruned":  pruned,
+			"message": fmt.Sprintf("Pruned %d versions", pruned),
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeVersionError(w http.ResponseWriter, r *http.Request, relativePath, versionID string, err error) {
+	if err == errVersionNotFound || os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("Version %s of %s not found", versionID, relativePath), http.StatusNotFound)
+		return
+	}
+	logFor(r.Context()).Error("version operation failed", "file", relativePath, "version_id", versionID, "error", err)
+	http.Error(w, fmt.Sprintf("Version operation failed: %v", err), http.StatusInternalServerError)
+}
+
+// selectPrunable returns the noncurrent versions (given newest first) that violate the policy
+func selectPrunable(versions []VersionInfo, policy VersionPolicy, now time.Time) []VersionInfo {
+	var prunable []VersionInfo
+	kept := 0
+	for _, version := range versions {
+		if version.IsLatest {
+			continue
+		}
+		tooMany := policy.MaxVersions > 0 && kept >= policy.MaxVersions
+		tooOld := policy.MaxAge > 0 && now.Sub(version.Modified) > policy.MaxAge
+		if tooMany || tooOld {
+			prunable = append(prunable, version)
+			continue
+		}
+		kept++
+	}
+	return prunable
+}
+
+// s3VersionStore relies on MinIO bucket versioning; writes through the mount create versions automatically
+type s3VersionStore struct{}
+
+func (s *s3VersionStore) Archive(relativePath string) (func() error, error) {
+	// The bucket keeps the overwritten object as a noncurrent version, and
+	// nothing changes until the new content is written
+	return func() error { return nil }, nil
+}
+
+func (s *s3VersionStore) List(ctx context.Context, relativePath string) ([]VersionInfo, error) {
+	objectKey := strings.TrimPrefix(relativePath, "/")
+	var versions []VersionInfo
+
+	objectCh := minioClient.ListObjects(ctx, bucketName, minio.ListObjectsOptions{
+		Prefix:       objectKey,
+		WithVersions: true,
+	})
+	for object := range objectCh {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		// The prefix also matches siblings like "a.txt.bak" - keep only the exact key
+		if object.Key != objectKey {
+			continue
+		}
+		versions = append(versions, VersionInfo{
+			VersionID:      object.VersionID,
+			Size:           object.Size,
+			Modified:       object.LastModified,
+			IsLatest:       object.IsLatest,
+			IsDeleteMarker: object.IsDeleteMarker,
+		})
+	}
+
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].Modified.After(versions[j].Modified) })
+	return versions, nil
+}
+
+func (s *s3VersionStore) Open(ctx context.Context, relativePath, versionID string) (io.ReadCloser, VersionInfo, error) {
+	objectKey := strings.TrimPrefix(relativePath, "/")
+	opts := minio.GetObjectOptions{}
+	if versionID != latestVersionID {
+		opts.VersionID = versionID
+	}
+
+	object, err := minioClient.GetObject(ctx, bucketName, objectKey, opts)
+	if err != nil {
+		return nil, VersionInfo{}, err
+	}
+	stat, err := object.Stat()
+	if err != nil {
+		object.Close()
+		if minio.ToErrorResponse(err).StatusCode == http.StatusNotFound {
+			return nil, VersionInfo{}, errVersionNotFound
+		}
+		return nil, VersionInfo{}, err
+	}
+
+	return object, VersionInfo{
+		VersionID: stat.VersionID,
+		Size:      stat.Size,
+		Modified:  stat.LastModified,
+		IsLatest:  stat.IsLatest,
+	}, nil
+}
+
+func (s *s3VersionStore) Restore(ctx context.Context, relativePath, versionID string) error {
+	objectKey := strings.TrimPrefix(relativePath, "/")
+
+	// Copying a version onto its own key makes it the latest; the mount picks it up on its next poll
+	_, err := minioClient.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: bucketName, Object: objectKey},
+		minio.CopySrcOptions{Bucket: bucketName, Object: objectKey, VersionID: versionID},
+	)
+	if err != nil && minio.ToErrorResponse(err).StatusCode == http.StatusNotFound {
+		return errVersionNotFound
+	}
+	return err
+}
+
+func (s *s3VersionStore) Delete(ctx context.Context, relativePath, versionID string) error {
+	objectKey := strings.TrimPrefix(relativePath, "/")
+	return minioClient.RemoveObject(ctx, bucketName, objectKey, minio.RemoveObjectOptions{VersionID: versionID})
+}
+
+func (s *s3VersionStore) Prune(ctx context.Context, relativePath string, policy VersionPolicy) (int, error) {
+	if relativePath != "" {
+		versions, err := s.List(ctx, relativePath)
+		if err != nil {
+			return 0, err
+		}
+		return s.remove(ctx, relativePath, selectPrunable(versions, policy, time.Now()))
+	}
+
+	// Whole bucket: versions of a key are listed together, newest first
+	pruned := 0
+	var currentKey string
+	var versions []VersionInfo
+	flush := func() error {
+		if currentKey == "" {
+			return nil
+		}
+		n, err := s.remove(ctx, "/"+currentKey, selectPrunable(versions, policy, time.Now()))
+		pruned += n
+		return err
+	}
+
+	objectCh := minioClient.ListObjects(ctx, bucketName, minio.ListObjectsOptions{
+		Recursive:    true,
+		WithVersions: true,
+	})
+	for object := range objectCh {
+		if object.Err != nil {
+			return pruned, object.Err
+		}
+		if object.Key != currentKey {
+			if err := flush(); err != nil {
+				return pruned, err
+			}
+			currentKey = object.Key
+			versions = nil
+		}
+		versions = append(versions, VersionInfo{
+			VersionID:      object.VersionID,
+			Modified:       object.LastModified,
+			IsLatest:       object.IsLatest,
+			IsDeleteMarker: object.IsDeleteMarker,
+		})
+	}
+	return pruned, flush()
+}
+
+func (s *s3VersionStore) remove(ctx context.Context, relativePath string, versions []VersionInfo) (int, error) {
+	removed := 0
+	for _, version := range versions {
+		if err := s.Delete(ctx, relativePath, version.VersionID); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// mountVersionStore keeps prior versions as files under /storage/.versions/<path>/<version id>
+type mountVersionStore struct {
+	root string
+}
+
+// versionDir is the directory holding all versions of one file
+func (s *mountVersionStore) versionDir(relativePath string) string {
+	return filepath.Join(s.root, strings.TrimPrefix(relativePath, "/"))
+}
+
+// versionFile resolves a version id, rejecting ids that try to leave the version dir
+func (s *mountVersionStore) versionFile(relativePath, versionID string) (string, error) {
+	if versionID == "" || versionID != filepath.Base(versionID) || strings.HasPrefix(versionID, ".") {
+		return "", errVersionNotFound
+	}
+	return filepath.Join(s.versionDir(relativePath), versionID), nil
+}
+
+// newVersionID sorts chronologically and stays unique within the same instant
+func newVersionID(now time.Time) string {
+	return fmt.Sprintf("%s-%s", now.UTC().Format("20060102T150405.000000000Z"), uuid.New().String()[:8])
+}
+
+func (s *mountVersionStore) Archive(relativePath string) (func() error, error) {
+	versionPath, err := s.archive(relativePath)
+	if err != nil {
+		return nil, err
+	}
+	s.prune(relativePath)
+	return func() error { return s.unarchive(relativePath, versionPath) }, nil
+}
+
+// archive moves the current content into the version dir and returns where it went
+func (s *mountVersionStore) archive(relativePath string) (string, error) {
+	fullPath, err := resolveStoragePath(relativePath)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		// List and Prune only see files: anything else would sit in the
+		// version dir for good, never listed, restored or pruned
+		return "", fmt.Errorf("failed to archive %s: not a regular file", relativePath)
+	}
+	dir := s.versionDir(relativePath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create version dir: %w", err)
+	}
+
+	versionPath := filepath.Join(dir, newVersionID(time.Now()))
+	if err := os.Rename(fullPath, versionPath); err != nil {
+		return "", fmt.Errorf("failed to archive %s: %w", relativePath, err)
+	}
+	trackMove(fullPath, versionPath)
+	slog.Info("archived previous version", "file", relativePath, "version_id", filepath.Base(versionPath))
+	return versionPath, nil
+}
+
+// unarchive makes an archived version the current content again, after the
+// write that was to replace it failed
+func (s *mountVersionStore) unarchive(relativePath, versionPath string) error {
+	fullPath, err := resolveStoragePath(relativePath)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(versionPath, fullPath); err != nil {
+		return fmt.Errorf("failed to put back %s: %w", relativePath, err)
+	}
+	trackMove(versionPath, fullPath)
+	// Drop the per-file dir if that was its only version
+	os.Remove(s.versionDir(relativePath))
+	return nil
+}
+
+// prune applies the retention policy after a file got a new version
+func (s *mountVersionStore) prune(relativePath string) {
+	if _, err := s.Prune(context.Background(), relativePath, currentVersionPolicy()); err != nil {
+		slog.Error("failed to prune versions", "file", relativePath, "error", err)
+	}
+}
+
+func (s *mountVersionStore) List(ctx context.Context, relativePath string) ([]VersionInfo, error) {
+	var versions []VersionInfo
+
+	if fullPath, err := resolveStoragePath(relativePath); err == nil {
+		if info, err := os.Stat(fullPath); err == nil && !info.IsDir() {
+			versions = append(versions, VersionInfo{
+				VersionID: latestVersionID,
+				Size:      info.Size(),
+				Modified:  info.ModTime(),
+				IsLatest:  true,
+			})
+		}
+	}
+
+	entries, err := os.ReadDir(s.versionDir(relativePath))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// Version ids start with a timestamp, so reverse name order is newest first
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() > entries[j].Name() })
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		versions = append(versions, VersionInfo{
+			VersionID: entry.Name(),
+			Size:      info.Size(),
+			Modified:  versionTime(entry.Name(), info.ModTime()),
+		})
+	}
+	return versions, nil
+}
+
+// versionTime is when a version was archived, taken from its id
+func versionTime(versionID string, fallback time.Time) time.Time {
+	stamp, _, _ := strings.Cut(versionID, "-")
+	if t, err := time.Parse("20060102T150405.000000000Z", stamp); err == nil {
+		return t
+	}
+	return fallback
+}
+
+func (s *mountVersionStore) Open(ctx context.Context, relativePath, versionID string) (io.ReadCloser, VersionInfo, error) {
+	var filePath string
+	var err error
+	if versionID == latestVersionID {
+		filePath, err = resolveStoragePath(relativePath)
+	} else {
+		filePath, err = s.versionFile(relativePath, versionID)
+	}
+	if err != nil {
+		return nil, VersionInfo{}, err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, VersionInfo{}, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, VersionInfo{}, err
+	}
+	return file, VersionInfo{
+		VersionID: versionID,
+		Size:      info.Size(),
+		Modified:  info.ModTime(),
+		IsLatest:  versionID == latestVersionID,
+	}, nil
+}
+
+func (s *mountVersionStore) Restore(ctx context.Context, relativePath, versionID string) error {
+	versionPath, err := s.versionFile(relativePath, versionID)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(versionPath); err != nil {
+		return err
+	}
+	fullPath, err := resolveStoragePath(relativePath)
+	if err != nil {
+		return err
+	}
+
+	// Copy (not move) the version so it stays in history. The copy is made
+	// first, so the current content is only archived once the restore can't
+	// fail halfway, and pruning waits until the restored content is in place.
+	restored, err := copyToTemp(versionPath, s.versionDir(relativePath))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(restored) // gone after the rename below
+
+	archived := ""
+	if _, err := os.Stat(fullPath); err == nil {
+		if archived, err = s.archive(relativePath); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(restored, fullPath); err != nil {
+		if archived != "" {
+			// Put the content that was current back
+			if undoErr := s.unarchive(relativePath, archived); undoErr != nil {
+				slog.Error("failed to put back archived version", "file", relativePath, "error", undoErr)
+			}
+		}
+		return err
+	}
+	if archived != "" {
+		s.prune(relativePath)
+	}
+	return nil
+}
+
+// copyToTemp copies src into a hidden temp file in dir, which List skips
+func copyToTemp(src, dir string) (string, error) {
+	source, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer source.Close()
+
+	dest, err := os.CreateTemp(dir, ".restore-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(dest, source)
+	if closeErr := dest.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest.Name())
+		return "", err
+	}
+	return dest.Name(), nil
+}
+
+func (s *mountVersionStore) Delete(ctx context.Context, relativePath, versionID string) error {
+	versionPath, err := s.versionFile(relativePath, versionID)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(versionPath); err != nil {
+		return err
+	}
+	trackPath(versionPath, "")
+	// Drop the per-file dir once its last version is gone
+	os.Remove(s.versionDir(relativePath))
+	return nil
+}
+
+func (s *mountVersionStore) Prune(ctx context.Context, relativePath string, policy VersionPolicy) (int, error) {
+	if relativePath != "" {
+		return s.pruneFile(ctx, relativePath, policy)
+	}
+
+	// Every directory holding version files belongs to one source file
+	pruned := 0
+	err := filepath.WalkDir(s.root, func(walkPath string, entry os.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() || walkPath == s.root {
+			return err
+		}
+		children, err := os.ReadDir(walkPath)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if !child.IsDir() {
+				n, err := s.pruneFile(ctx, "/"+strings.TrimPrefix(walkPath, s.root+"/"), policy)
+				pruned += n
+				return err
+			}
+		}
+		return nil
+	})
+	return pruned, err
+}
+
+func (s *mountVersionStore) pruneFile(ctx context.Context, relativePath string, policy VersionPolicy) (int, error) {
+	versions, err := s.List(ctx, relativePath)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, version := range selectPrunable(versions, policy, time.Now()) {
+		if err := s.Delete(ctx, relativePath, version.VersionID); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupMountVersions points the server at a temp mount with versioning.mode=mount
+func setupMountVersions(t *testing.T) string {
+	t.Helper()
+	dir := setupUploadVolume(t)
+	previous := versionStore
+	t.Cleanup(func() { versionStore = previous })
+	versionStore = &mountVersionStore{root: filepath.Join(dir, versionsDirName)}
+	return dir
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertContent(t *testing.T, path, want string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != want {
+		t.Errorf("%s = %q, %v; want %q", path, data, err, want)
+	}
+}
+
+// noncurrentVersions lists the archived versions of relativePath, newest first
+func noncurrentVersions(t *testing.T, relativePath string) []VersionInfo {
+	t.Helper()
+	versions, err := versionStore.List(context.Background(), relativePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var noncurrent []VersionInfo
+	for _, version := range versions {
+		if !version.IsLatest {
+			noncurrent = append(noncurrent, version)
+		}
+	}
+	return noncurrent
+}
+
+func TestMountVersionArchiveAndRestore(t *testing.T) {
+	dir := setupMountVersions(t)
+	target := filepath.Join(dir, "docs", "report.txt")
+	writeFile(t, target, "v1")
+
+	if _, err := ArchiveCurrentVersion(target); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Fatalf("archived file still in place: %v", err)
+	}
+	writeFile(t, target, "v2")
+
+	versions := noncurrentVersions(t, "/docs/report.txt")
+	if len(versions) != 1 {
+		t.Fatalf("versions = %v, want the archived v1", versions)
+	}
+	reader, _, err := versionStore.Open(context.Background(), "/docs/report.txt", versions[0].VersionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(reader)
+	reader.Close()
+	if string(content) != "v1" {
+		t.Errorf("archived version = %q, want v1", content)
+	}
+
+	if err := versionStore.Restore(context.Background(), "/docs/report.txt", versions[0].VersionID); err != nil {
+		t.Fatal(err)
+	}
+	assertContent(t, target, "v1")
+	// Both the restored version and the content it replaced stay in history
+	if versions := noncurrentVersions(t, "/docs/report.txt"); len(versions) != 2 {
+		t.Errorf("versions after restore = %v, want v1 and v2", versions)
+	}
+}
+
+func TestMountVersionUnarchive(t *testing.T) {
+	dir := setupMountVersions(t)
+	target := filepath.Join(dir, "docs", "report.txt")
+	writeFile(t, target, "v1")
+
+	unarchive, err := ArchiveCurrentVersion(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The write replacing it failed
+	unarchive()
+
+	assertContent(t, target, "v1")
+	if versions := noncurrentVersions(t, "/docs/report.txt"); len(versions) != 0 {
+		t.Errorf("versions = %v, want none once the archive was undone", versions)
+	}
+	if _, err := os.Stat(filepath.Join(dir, versionsDirName, "docs", "report.txt")); !os.IsNotExist(err) {
+		t.Errorf("empty version dir left behind: %v", err)
+	}
+}
+
+func TestMountVersionFailedReplace(t *testing.T) {
+	dir := setupMountVersions(t)
+	target := filepath.Join(dir, "docs", "report.txt")
+	writeFile(t, target, "v1")
+
+	temp, err := os.CreateTemp(t.TempDir(), "chunks-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The assembled upload is gone, so neither renaming nor copying it works
+	os.Remove(temp.Name())
+	session := &ChunkUploadSessionRClone{
+		SessionID: "test",
+		FileName:  "report.txt",
+		FilePath:  target,
+		Volume:    defaultVolume(),
+		TempFile:  temp,
+	}
+	if err := finalizeRCloneUpload(context.Background(), session); err == nil {
+		t.Fatal("finalizing a missing upload succeeded")
+	}
+
+	assertContent(t, target, "v1")
+	if versions := noncurrentVersions(t, "/docs/report.txt"); len(versions) != 0 {
+		t.Errorf("versions = %v, want the archived content back in place", versions)
+	}
+}
+
+func TestMountVersionOnlyArchivesFiles(t *testing.T) {
+	dir := setupMountVersions(t)
+	target := filepath.Join(dir, "docs")
+	writeFile(t, filepath.Join(target, "report.txt"), "v1")
+
+	// Nothing to keep: directories have no versions
+	if _, err := ArchiveCurrentVersion(target); err != nil {
+		t.Fatal(err)
+	}
+	assertContent(t, filepath.Join(target, "report.txt"), "v1")
+
+	// The store itself refuses, rather than hiding the tree in .versions
+	if _, err := versionStore.Archive("/docs"); err == nil {
+		t.Error("archived a directory")
+	}
+	assertContent(t, filepath.Join(target, "report.txt"), "v1")
+	if entries, _ := os.ReadDir(filepath.Join(dir, versionsDirName)); len(entries) != 0 {
+		t.Errorf("version store holds %d entries, want none", len(entries))
+	}
+}
+
+func TestSelectPrunable(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	versions := []VersionInfo{
+		{VersionID: latestVersionID, IsLatest: true, Modified: now},
+		{VersionID: "c", Modified: now.Add(-time.Hour)},
+		{VersionID: "b", Modified: now.Add(-48 * time.Hour)},
+		{VersionID: "a", Modified: now.Add(-96 * time.Hour)},
+	}
+	tests := []struct {
+		name   string
+		policy VersionPolicy
+		want   []string
+	}{
+		{"unlimited", VersionPolicy{}, nil},
+		{"keep one", VersionPolicy{MaxVersions: 1}, []string{"b", "a"}},
+		{"max age", VersionPolicy{MaxAge: 72 * time.Hour}, []string{"a"}},
+		{"both", VersionPolicy{MaxVersions: 2, MaxAge: 24 * time.Hour}, []string{"b", "a"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, version := range selectPrunable(versions, tt.policy, now) {
+			got = append(got, version.VersionID)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: pruned %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateMaxVersions(t *testing.T) {
+	for _, tt := range []struct {
+		max  int
+		want bool
+	}{{0, true}, {10, true}, {-1, false}} {
+		cfg := defaultConfig()
+		cfg.Versioning.MaxVersions = tt.max
+		err := cfg.Validate()
+		if ok := err == nil || !strings.Contains(err.Error(), "max_versions"); ok != tt.want {
+			t.Errorf("max_versions %d: %v", tt.max, err)
+		}
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Volume is a named storage root served by the API. The default volume is
+// storage.mount; storage.volumes adds more, each either a directory that is
+// already mounted or a bucket that rclone mounts at startup.
+type Volume struct {
+	Name    string `json:"name"`
+	Bucket  string `json:"bucket,omitempty"` // bucket on minio.endpoint, if the volume is one
+	Mount   string `json:"-"`
+	Default bool   `json:"default"`
+}
+
+// defaultVolumeName is the volume used when a request doesn't name one
+const defaultVolumeName = "default"
+
+// rcloneRemote is the remote entrypoint.sh writes to rclone.conf
+const rcloneRemote = "storage"
+
+// The volumes are set up once at startup (storage.volumes is restart-only)
+var (
+	volumes       []*Volume
+	volumesByName = make(map[string]*Volume)
+)
+
+// parseVolume reads a storage.volumes entry: "name=/path" for a directory
+// that is already mounted, or "name=s3://bucket" for a bucket to mount under
+// storage.volumes_root
+func parseVolume(spec, root string) (*Volume, error) {
+	name, target, ok := strings.Cut(spec, "=")
+	name, target = strings.TrimSpace(name), strings.TrimSpace(target)
+	if !ok || target == "" {
+		return nil, fmt.Errorf("storage.volumes: %q must be name=/path or name=s3://bucket", spec)
+	}
+	if !validVolumeName(name) {
+		return nil, fmt.Errorf("storage.volumes: volume name %q may only use a-z, 0-9, - and _", name)
+	}
+	if name == defaultVolumeName {
+		return nil, fmt.Errorf("storage.volumes: %q is the name of storage.mount", name)
+	}
+	if bucket, ok := strings.CutPrefix(target, "s3://"); ok {
+		if bucket == "" || strings.Contains(bucket, "/") {
+			return nil, fmt.Errorf("storage.volumes: %s: %q is not a bucket", name, target)
+		}
+		return &Volume{Name: name, Bucket: bucket, Mount: filepath.Join(root, name)}, nil
+	}
+	if !filepath.IsAbs(target) || filepath.Clean(target) == "/" {
+		return nil, fmt.Errorf("storage.volumes: %s: mount must be an absolute path other than /", name)
+	}
+	return &Volume{Name: name, Mount: filepath.Clean(target)}, nil
+}
+
+func validVolumeName(name string) bool {
+	if name == "" || len(name) > 63 {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// initVolumes registers the default volume and those in storage.volumes,
+// mounting bucket volumes that aren't mounted yet
+func initVolumes() error {
+	settings := currentConfig().Storage
+	volumes = []*Volume{{Name: defaultVolumeName, Bucket: bucketName, Mount: STORAGE_MOUNT, Default: true}}
+	volumesByName = map[string]*Volume{defaultVolumeName: volumes[0]}
+
+	for _, spec := range settings.Volumes {
+		v, err := parseVolume(spec, settings.VolumesRoot)
+		if err != nil {
+			return err
+		}
+		if v.Bucket != "" {
+			if err := mountBucketVolume(v); err != nil {
+				return fmt.Errorf("failed to mount volume %s: %w", v.Name, err)
+			}
+		}
+		if _, err := os.ReadDir(v.Mount); err != nil {
+			return fmt.Errorf("volume %s is not readable: %w", v.Name, err)
+		}
+		volumes = append(volumes, v)
+		volumesByName[v.Name] = v
+		slog.Info("volume ready", "volume", v.Name, "mount", v.Mount, "bucket", v.Bucket)
+	}
+	return nil
+}
+
+// mountBucketVolume asks the rclone process that serves storage.mount to
+// mount the volume's bucket too, with the same remote and cache mode
+func mountBucketVolume(v *Volume) error {
+	if mounted, err := isMountPoint(v.Mount); err == nil && mounted {
+		return nil
+	}
+	if err := os.MkdirAll(v.Mount, 0755); err != nil {
+		return err
+	}
+
+	body, _ := json.Marshal(map[string]any{
+		"fs":         rcloneRemote + ":" + v.Bucket,
+		"mountPoint": v.Mount,
+		"mountOpt":   map[string]any{"AllowOther": true},
+		"vfsOpt":     map[string]any{"CacheMode": "writes"},
+	})
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Post("http://"+currentConfig().Storage.RcloneRCAddr+"/mount/mount", "application/json", bytes.NewReader(body))
+	if err != nil {
+		metrics.BackendError("rclone_rc")
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("rclone mount/mount: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// defaultVolume returns the volume at storage.mount
+func defaultVolume() *Volume {
+	return volumesByName[defaultVolumeName]
+}
+
+// lookupVolume answers 404 for an unknown volume name. An empty name means
+// the default volume.
+func lookupVolume(w http.ResponseWriter, name string) (*Volume, bool) {
+	if name == "" {
+		name = defaultVolumeName
+	}
+	v, ok := volumesByName[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown volume: %s", name), http.StatusNotFound)
+	}
+	return v, ok
+}
+
+// resolve maps an API path (e.g. "/docs/a.txt") to its location in the
+// volume, rejecting paths that escape it
+func (v *Volume) resolve(requestPath string) (string, error) {
+	fullPath := filepath.Join(v.Mount, strings.TrimPrefix(requestPath, "/"))
+	if fullPath != v.Mount && !strings.HasPrefix(fullPath, v.Mount+"/") {
+		return "", fmt.Errorf("path %s escapes volume %s", requestPath, v.Name)
+	}
+	return fullPath, nil
+}
+
+// relative converts a full path in the volume back to an API path
+func (v *Volume) relative(fullPath string) string {
+	relativePath := strings.TrimPrefix(fullPath, v.Mount)
+	if !strings.HasPrefix(relativePath, "/") {
+		relativePath = "/" + relativePath
+	}
+	return relativePath
+}
+
+// qualify names the volume in front of an API path ("archive:/a.txt") for
+// audit entries, logs and cache keys. Default volume paths are unchanged.
+func (v *Volume) qualify(relativePath string) string {
+	if v.Default {
+		return relativePath
+	}
+	return v.Name + ":" + relativePath
+}
+
+// internal reports whether fullPath is server bookkeeping (trash, versions,
+// shares), which only the default volume has
+func (v *Volume) internal(fullPath string) bool {
+	return v.Default && isInternalPath(fullPath)
+}
+
+// volumesHandler serves GET /api/volumes: the volumes a request can name
+func volumesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(volumes)
+}
+
+// TransferRequest is the body of POST /api/copy and /api/move. The volumes
+// default to the default volume; when the destination is an existing
+// directory the source is placed inside it.
+type TransferRequest struct {
+	SourceVolume      string `json:"source_volume,omitempty"`
+	Source            string `json:"source"`
+	DestinationVolume string `json:"destination_volume,omitempty"`
+	Destination       string `json:"destination"`
+	ConflictAction    string `json:"conflictAction,omitempty"` // "rename" (default) or "replace"
+}
+
+// TransferResponse reports where a copy or move put the source
+type TransferResponse struct {
+	Success        bool   `json:"success"`
+	Volume         string `json:"volume"`
+	Path           string `json:"path"`
+	Files          int    `json:"files"`
+	Bytes          int64  `json:"bytes"`
+	ConflictAction string `json:"conflictAction,omitempty"` // "renamed" or "replaced" when the destination existed
+	Message        string `json:"message"`
+}
+
+// copyHandler serves POST /api/copy
+func copyHandler(w http.ResponseWriter, r *http.Request) {
+	transferHandler(w, r, false)
+}
+
+// moveHandler serves POST /api/move
+func moveHandler(w http.ResponseWriter, r *http.Request) {
+	transferHandler(w, r, true)
+}
+
+// transferHandler copies or moves a file or directory, within a volume or
+// across volumes. Content is streamed from one mount to the other, so memory
+// use doesn't grow with the file size. A move within a volume is a rename.
+func transferHandler(w http.ResponseWriter, r *http.Request, move bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req TransferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "Invalid request body")
+		return
+	}
+	if req.Source == "" || req.Destination == "" {
+		http.Error(w, "source and destination are required", http.StatusBadRequest)
+		return
+	}
+	if req.ConflictAction == "" {
+		req.ConflictAction = "rename"
+	}
+	if req.ConflictAction != "rename" && req.ConflictAction != "replace" {
+		http.Error(w, "conflictAction must be rename or replace", http.StatusBadRequest)
+		return
+	}
+
+	srcVol, ok := lookupVolume(w, req.SourceVolume)
+	if !ok {
+		return
+	}
+	dstVol, ok := lookupVolume(w, req.DestinationVolume)
+	if !ok {
+		return
+	}
+
+	logger := logFor(r.Context())
+	srcPath, err := srcVol.resolve(req.Source)
+	if err == nil && (srcPath == srcVol.Mount || srcVol.internal(srcPath)) {
+		err = fmt.Errorf("path %s can't be transferred", req.Source)
+	}
+	if err != nil {
+		logger.Warn("rejected transfer source", "error", err)
+		http.Error(w, "Invalid source path", http.StatusBadRequest)
+		return
+	}
+	dstPath, err := dstVol.resolve(req.Destination)
+	if err == nil && dstVol.internal(dstPath) {
+		err = fmt.Errorf("path %s is internal", req.Destination)
+	}
+	if err != nil {
+		logger.Warn("rejected transfer destination", "error", err)
+		http.Error(w, "Invalid destination path", http.StatusBadRequest)
+		return
+	}
+
+	action := "copy"
+	if move {
+		action = "move"
+	}
+	event := audit(r, action, srcVol.qualify(srcVol.relative(srcPath)))
+
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, fmt.Sprintf("File not found: %s", req.Source), http.StatusNotFound)
+			return
+		}
+		logger.Error("failed to stat transfer source", "file", event.Path, "error", err)
+		http.Error(w, fmt.Sprintf("Error accessing file: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// An existing directory receives the source under its own name
+	if dstInfo, err := os.Stat(dstPath); err == nil && dstInfo.IsDir() {
+		dstPath = filepath.Join(dstPath, info.Name())
+	}
+	if dstPath == dstVol.Mount || dstVol.internal(dstPath) {
+		http.Error(w, "Invalid destination path", http.StatusBadRequest)
+		return
+	}
+	if srcVol == dstVol && (dstPath == srcPath || strings.HasPrefix(dstPath, srcPath+"/")) {
+		http.Error(w, "Destination is inside the source", http.StatusBadRequest)
+		return
+	}
+
+	response := &TransferResponse{Success: true, Volume: dstVol.Name}
+	if _, err := os.Stat(dstPath); err == nil {
+		if req.ConflictAction == "replace" {
+			response.ConflictAction = "replaced"
+		} else {
+			dstPath = generateUniqueFilename(dstPath)
+			response.ConflictAction = "renamed"
+		}
+	}
+	event.Target = dstVol.qualify(dstVol.relative(dstPath))
+
+	ctx, span := startSpan(r.Context(), "mount."+action,
+		"file.path", event.Path, "file.target", event.Target)
+	defer span.End()
+
+	if move && srcVol == dstVol && response.ConflictAction != "replaced" {
+		err = os.Rename(srcPath, dstPath)
+		if err == nil {
+			response.Files, response.Bytes = countTree(dstPath)
+		}
+	} else {
+		response.Files, response.Bytes, err = copyTree(ctx, srcPath, dstPath, dstVol)
+		if err == nil && move {
+			err = os.RemoveAll(srcPath)
+		}
+	}
+	span.RecordError(err)
+	event.Size = response.Bytes
+	if err != nil {
+		logger.Error("transfer failed", "action", action, "file", event.Path, "target", event.Target, "error", err)
+		metrics.BackendError("mount_" + action)
+		http.Error(w, fmt.Sprintf("Failed to %s: %v", action, err), http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("transfer complete", "action", action, "file", event.Path, "target", event.Target,
+		"files", response.Files, "size", response.Bytes)
+
+	// Moved files keep their owner; copies belong to whoever made them
+	if move {
+		trackMove(srcPath, dstPath)
+		InvalidateThumbnails(event.Path)
+	} else {
+		trackPath(dstPath, requestUser(r))
+	}
+	InvalidateThumbnails(event.Target)
+
+	transferred := WebhookEvent{Type: eventFileCreated, Path: event.Target, IsDir: info.IsDir(), Size: response.Bytes, User: requestUser(r)}
+	switch {
+	case move:
+		transferred.Type, transferred.From = eventFileMoved, event.Path
+	case response.ConflictAction == "replaced":
+		transferred.Type = eventFileReplaced
+	}
+	notify(transferred)
+
+	response.Path = dstVol.relative(dstPath)
+	response.Message = fmt.Sprintf("Copied to %s", event.Target)
+	if move {
+		response.Message = fmt.Sprintf("Moved to %s", event.Target)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// copyTree copies a file, or a directory and everything in it, to dst.
+// Files replaced on the default volume are kept as versions first. A file
+// being replaced stays untouched until its new content is complete.
+func copyTree(ctx context.Context, src, dst string, dstVol *Volume) (files int, size int64, err error) {
+	err = filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		target := filepath.Join(dst, strings.TrimPrefix(path, src))
+		if entry.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		partial, n, err := streamFile(ctx, path, target)
+		size += n
+		if err != nil {
+			return err
+		}
+		unarchive := func() {}
+		if dstVol.Default {
+			if unarchive, err = ArchiveCurrentVersion(target); err != nil {
+				os.Remove(partial)
+				return fmt.Errorf("failed to preserve previous version: %w", err)
+			}
+		}
+		if err := os.Rename(partial, target); err != nil {
+			os.Remove(partial)
+			unarchive()
+			return err
+		}
+		files++
+		return nil
+	})
+	return files, size, err
+}
+
+// streamFile copies one file's content into a hidden partial file next to
+// dst and returns its path, for the caller to rename over dst. dst itself
+// isn't touched, and a failed copy removes the partial file.
+func streamFile(ctx context.Context, src, dst string) (string, int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", 0, err
+	}
+	defer in.Close()
+
+	partial := filepath.Join(filepath.Dir(dst), fmt.Sprintf(".%s.%s.partial", filepath.Base(dst), uuid.New().String()[:8]))
+	out, err := os.Create(partial)
+	if err != nil {
+		return "", 0, err
+	}
+	written, err := io.Copy(out, &contextReader{ctx: ctx, r: in})
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(partial)
+		return "", written, err
+	}
+	return partial, written, nil
+}
+
+// contextReader stops a copy once ctx is done (client gone or shutdown)
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// countTree counts the files under path and their total size
+func countTree(path string) (files int, size int64) {
+	filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if entry.Type().IsRegular() {
+			if info, err := entry.Info(); err == nil {
+				files++
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return files, size
+}
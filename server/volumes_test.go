@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// cancelAfter is a context that reports itself canceled after n checks, to
+// stop a copy part way through
+type cancelAfter struct {
+	context.Context
+	n atomic.Int32
+}
+
+func (c *cancelAfter) Err() error {
+	if c.n.Add(-1) < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestCopyTreeReplace(t *testing.T) {
+	content := strings.Repeat("new content ", 100000) // many reads
+	tests := []struct {
+		name       string
+		versioning bool
+		checks     int32 // context checks before the copy is canceled, 0 = never
+		want       string
+		versions   int
+	}{
+		{"replaced", false, 0, content, 0},
+		{"replaced, old kept as version", true, 0, content, 1},
+		{"canceled", false, 3, "old", 0},
+		{"canceled with versioning", true, 3, "old", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup := setupUploadVolume
+			if tt.versioning {
+				setup = setupMountVersions
+			}
+			dir := setup(t)
+			src := filepath.Join(dir, "incoming", "report.txt")
+			dst := filepath.Join(dir, "docs", "report.txt")
+			writeFile(t, src, content)
+			writeFile(t, dst, "old")
+
+			var ctx context.Context = context.Background()
+			if tt.checks > 0 {
+				c := &cancelAfter{Context: ctx}
+				c.n.Store(tt.checks)
+				ctx = c
+			}
+			files, _, err := copyTree(ctx, src, dst, defaultVolume())
+			if canceled := tt.checks > 0; (err != nil) != canceled || (files == 1) == canceled {
+				t.Fatalf("copied %d files, %v", files, err)
+			}
+
+			assertContent(t, dst, tt.want)
+			entries, _ := os.ReadDir(filepath.Dir(dst))
+			if len(entries) != 1 {
+				t.Errorf("destination dir holds %d entries, want only the file", len(entries))
+			}
+			if tt.versioning {
+				versions := noncurrentVersions(t, "/docs/report.txt")
+				if len(versions) != tt.versions {
+					t.Fatalf("versions = %v, want %d", versions, tt.versions)
+				}
+				if tt.versions > 0 {
+					path, _ := versionStore.(*mountVersionStore).versionFile("/docs/report.txt", versions[0].VersionID)
+					assertContent(t, path, "old")
+				}
+			}
+		})
+	}
+}
+
+func TestCopyTreeDirectory(t *testing.T) {
+	dir := setupUploadVolume(t)
+	writeFile(t, filepath.Join(dir, "src", "a.txt"), "a")
+	writeFile(t, filepath.Join(dir, "src", "sub", "b.txt"), "bb")
+
+	files, size, err := copyTree(context.Background(), filepath.Join(dir, "src"), filepath.Join(dir, "dst"), defaultVolume())
+	if err != nil || files != 2 || size != 3 {
+		t.Fatalf("copied %d files, %d bytes, %v", files, size, err)
+	}
+	assertContent(t, filepath.Join(dir, "dst", "a.txt"), "a")
+	assertContent(t, filepath.Join(dir, "dst", "sub", "b.txt"), "bb")
+	assertContent(t, filepath.Join(dir, "src", "sub", "b.txt"), "bb")
+}
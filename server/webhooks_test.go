@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver answers 500 to the first failures requests and 200 after
+// that, recording the X-Webhook-Attempt of each and whether it was signed
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	failures int
+	attempts []int
+	unsigned int
+}
+
+func newWebhookReceiver(t *testing.T, failures int) *webhookReceiver {
+	t.Helper()
+	receiver := &webhookReceiver{failures: failures}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		attempt, _ := strconv.Atoi(r.Header.Get("X-Webhook-Attempt"))
+		signed := r.Header.Get("X-Webhook-Signature") == signWebhook("test secret", r.Header.Get("X-Webhook-Timestamp"), body)
+
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		receiver.attempts = append(receiver.attempts, attempt)
+		if !signed {
+			receiver.unsigned++
+		}
+		if len(receiver.attempts) <= receiver.failures {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver
+}
+
+func (receiver *webhookReceiver) received() int {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	return len(receiver.attempts)
+}
+
+// startWebhooks starts a dispatcher on the mount with url as the only webhook
+func startWebhooks(t *testing.T, url string, maxAttempts int) *webhookDispatcher {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.Webhooks.Endpoints = []string{url}
+	cfg.Webhooks.Secret = "test secret"
+	cfg.Webhooks.Timeout = 5 * time.Second
+	cfg.Webhooks.MaxAttempts = maxAttempts
+	setConfig(cfg, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &webhookDispatcher{queues: make(map[string]*webhookQueue)}
+	if err := d.start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		d.release()
+	})
+	return d
+}
+
+// queueDelivery saves a due delivery to the dispatcher's outbox and queues it
+// on a queue of its own, which no goroutine runs
+func queueDelivery(t *testing.T, d *webhookDispatcher, url string) (*webhookQueue, *webhookDelivery) {
+	t.Helper()
+	delivery := &webhookDelivery{
+		URL:   url,
+		Event: WebhookEvent{ID: "evt-1", Type: "file.uploaded", Time: time.Now(), Path: "/a.txt"},
+		file:  filepath.Join(d.dir, fmt.Sprintf("%d-test.json", time.Now().UnixNano())),
+	}
+	if err := delivery.save(); err != nil {
+		t.Fatal(err)
+	}
+	q := &webhookQueue{wake: make(chan struct{}, 1)}
+	q.push(delivery)
+	return q, delivery
+}
+
+// waitFor polls until done reports true, failing the test after a few seconds
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name          string
+		failures      int
+		maxAttempts   int
+		startAttempts int             // attempts already made
+		backoffs      []time.Duration // before each retry
+		delivered     bool
+	}{
+		{"delivered", 0, 3, 0, nil, true},
+		{"retried, then delivered", 2, 5, 0, []time.Duration{webhookRetryBase, 2 * webhookRetryBase}, true},
+		{"set aside", 100, 3, 0, []time.Duration{webhookRetryBase, 2 * webhookRetryBase}, false},
+		{"backoff capped", 1, 20, 11, []time.Duration{webhookMaxBackoff}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := newWebhookReceiver(t, tt.failures)
+			setupUploadVolume(t)
+			d := startWebhooks(t, receiver.URL, tt.maxAttempts)
+			q, delivery := queueDelivery(t, d, receiver.URL)
+			delivery.Attempts = tt.startAttempts
+
+			retries := 0
+			for q.head() != nil {
+				before := time.Now()
+				d.attempt(context.Background(), q, delivery)
+				if q.head() == nil {
+					break
+				}
+				if retries == len(tt.backoffs) {
+					t.Fatalf("retry %d not expected", retries+1)
+				}
+				if wait := delivery.NextAttempt.Sub(before); wait < tt.backoffs[retries] || wait > tt.backoffs[retries]+time.Second {
+					t.Errorf("retry %d scheduled in %v, want %v", retries+1, wait, tt.backoffs[retries])
+				}
+				saved, err := loadDelivery(delivery.file)
+				if err != nil || saved.Attempts != delivery.Attempts || saved.LastError == "" {
+					t.Errorf("saved delivery = %+v, %v", saved, err)
+				}
+				retries++
+			}
+			if retries != len(tt.backoffs) {
+				t.Errorf("%d retries, want %d", retries, len(tt.backoffs))
+			}
+
+			receiver.mu.Lock()
+			for i, attempt := range receiver.attempts {
+				if attempt != tt.startAttempts+i+1 {
+					t.Errorf("request %d sent as attempt %d", i+1, attempt)
+				}
+			}
+			if receiver.unsigned > 0 {
+				t.Errorf("%d requests without a valid signature", receiver.unsigned)
+			}
+			receiver.mu.Unlock()
+
+			if _, err := os.Stat(delivery.file); !os.IsNotExist(err) {
+				t.Errorf("delivery still in the outbox: %v", err)
+			}
+			setAside := filepath.Join(d.root, failedWebhooksDirName, filepath.Base(delivery.file))
+			failed, err := loadDelivery(setAside)
+			if tt.delivered {
+				if err == nil {
+					t.Errorf("delivered webhook set aside: %+v", failed)
+				}
+				return
+			}
+			if err != nil || failed.Attempts != tt.maxAttempts || failed.LastError == "" {
+				t.Errorf("set aside delivery = %+v, %v; want %d attempts and the error", failed, err, tt.maxAttempts)
+			}
+		})
+	}
+}
+
+func TestWebhookAdoptOrphans(t *testing.T) {
+	receiver := newWebhookReceiver(t, 0)
+	setupUploadVolume(t)
+	root := filepath.Join(STORAGE_MOUNT, webhooksDirName)
+	outboxes := []struct {
+		id        string
+		heartbeat time.Time // zero: none
+		adopted   bool
+	}{
+		{"gone", time.Time{}, true},
+		{"stale", time.Now().Add(-webhookOrphanAfter - time.Minute), true},
+		{"live", time.Now(), false},
+	}
+	for _, outbox := range outboxes {
+		if !outbox.heartbeat.IsZero() {
+			writeFile(t, filepath.Join(root, outbox.id+".alive"), outbox.heartbeat.UTC().Format(time.RFC3339))
+		}
+		delivery := &webhookDelivery{
+			URL:   receiver.URL,
+			Event: WebhookEvent{ID: outbox.id, Type: "file.uploaded"},
+			file:  filepath.Join(root, outbox.id, "1-"+outbox.id+".json"),
+		}
+		writeFile(t, delivery.file, "")
+		if err := delivery.save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := startWebhooks(t, receiver.URL, 3)
+	waitFor(t, "the adopted deliveries", func() bool { return receiver.received() == 2 && d.pending() == 0 })
+
+	for _, outbox := range outboxes {
+		_, err := os.Stat(filepath.Join(root, outbox.id))
+		if gone := os.IsNotExist(err); gone != outbox.adopted {
+			t.Errorf("outbox %s: removed = %v, want %v", outbox.id, gone, outbox.adopted)
+		}
+	}
+	if entries, _ := os.ReadDir(d.dir); len(entries) != 0 {
+		t.Errorf("own outbox holds %d deliveries after delivering them", len(entries))
+	}
+	assertContent(t, filepath.Join(root, "live.alive"), outboxes[2].heartbeat.UTC().Format(time.RFC3339))
+}
+
+func TestWebhookQueueStopsOnShutdown(t *testing.T) {
+	for _, midRequest := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mid-request=%v", midRequest), func(t *testing.T) {
+			requested, release := make(chan struct{}, 1), make(chan struct{})
+			receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body) // so a client giving up cancels r.Context()
+				requested <- struct{}{}
+				select {
+				case <-r.Context().Done():
+				case <-release:
+				}
+			}))
+			t.Cleanup(receiver.Close)
+			t.Cleanup(func() { close(release) })
+			setupUploadVolume(t)
+			d := startWebhooks(t, receiver.URL, 3)
+			q, delivery := queueDelivery(t, d, receiver.URL)
+
+			ctx, stop := context.WithCancel(context.Background())
+			defer stop()
+			if !midRequest {
+				stop()
+			}
+			done := make(chan struct{})
+			go func() {
+				d.run(ctx, q)
+				close(done)
+			}()
+			if midRequest {
+				<-requested
+				stop()
+			}
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("queue still running after shutdown")
+			}
+
+			// Left for the next process
+			if q.head() != delivery || delivery.Attempts != 0 {
+				t.Errorf("queue head = %+v, want the untouched delivery", q.head())
+			}
+			if _, err := loadDelivery(delivery.file); err != nil {
+				t.Errorf("delivery gone from the outbox: %v", err)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import FileUpload from '@/components/FileUpload';
 import StorageStats, { StorageStatsRef } from '@/components/StorageStats';
 import TreeView from '@/components/TreeView';
 import { useRuntimeConfig, useApiUrl } from '@/lib/runtime-config';
+import { traceHeaders } from '@/lib/tracing';
 import { ListBulletIcon, Squares2X2Icon } from '@heroicons/react/24/outline';
 import { useEffect, useRef, useState } from 'react';
 
@@ -39,7 +40,9 @@ export default function Home() {
     setError(null);
 
     try {
-      const response = await fetch(buildApiUrl(`/list?path=${encodeURIComponent(path)}`));
+      const response = await fetch(buildApiUrl(`/list?path=${encodeURIComponent(path)}`), {
+        headers: traceHeaders(),
+      });
       if (!response.ok) {
         throw new Error('Failed to load files');
       }
@@ -1,6 +1,7 @@
 'use client';
 
 import { useRuntimeConfig, useApiUrl } from '@/lib/runtime-config';
+import { traceHeaders } from '@/lib/tracing';
 import {
   ArrowDownTrayIcon,
   ArrowPathIcon,
@@ -80,6 +81,7 @@ export default function FileBrowser({
       const cleanPath = filePath.startsWith('/') ? filePath.substring(1) : filePath;
       const response = await fetch(buildApiUrl(`/delete/${encodeURIComponent(cleanPath)}`), {
         method: 'DELETE',
+        headers: traceHeaders(),
       });
 
       if (response.ok) {
@@ -2,6 +2,7 @@
 
 import { useApiUrl } from '@/lib/runtime-config';
 import { LargeFileUploader, getUploadStrategy } from '@/lib/largeFileUploader';
+import { traceHeaders } from '@/lib/tracing';
 import {
   CloudArrowUpIcon,
   DocumentIcon,
@@ -198,6 +199,9 @@ export default function FileUpload({ currentPath, onUploadComplete }: FileUpload
         });
 
         xhr.open('POST', buildApiUrl('/upload'));
+        for (const [name, value] of Object.entries(traceHeaders())) {
+          xhr.setRequestHeader(name, value);
+        }
         xhr.send(formData);
       });
     }
@@ -1,6 +1,7 @@
 'use client';
 
 import { useApiUrl } from '@/lib/runtime-config';
+import { traceHeaders } from '@/lib/tracing';
 import {
   ArrowPathIcon,
   ChartBarIcon,
@@ -56,6 +57,7 @@ const StorageStats = forwardRef<StorageStatsRef>(function StorageStats(_, ref) {
       const timeoutId = setTimeout(() => controller.abort(), 300000); // 5 minute timeout
 
       const response = await fetch(url, {
+        headers: traceHeaders(),
         signal: controller.signal,
       });
 
@@ -11,6 +11,7 @@ import {
   TrashIcon,
 } from '@heroicons/react/24/outline';
 import { useRuntimeConfig, useApiUrl } from '@/lib/runtime-config';
+import { traceHeaders } from '@/lib/tracing';
 
 interface TreeNode {
   name: string;
@@ -42,7 +43,7 @@ export default function TreeView({ onFileSelect, onRefresh }: TreeViewProps) {
     try {
       const url = buildApiUrl(`/list?path=${encodeURIComponent(path)}`);
       console.log('TreeView: Fetching from:', url);
-      const response = await fetch(url);
+      const response = await fetch(url, { headers: traceHeaders() });
       if (!response.ok) {
         throw new Error('Failed to load directory');
       }
@@ -146,6 +147,7 @@ export default function TreeView({ onFileSelect, onRefresh }: TreeViewProps) {
       const cleanPath = node.path.startsWith('/') ? node.path.substring(1) : node.path;
       const response = await fetch(buildApiUrl(`/delete/${encodeURIComponent(cleanPath)}`), {
         method: 'DELETE',
+        headers: traceHeaders(),
       });
 
       if (response.ok) {
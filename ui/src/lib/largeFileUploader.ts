@@ -1,5 +1,7 @@
 // Large file upload utilities with chunked upload support
 
+import { newTraceId, traceHeaders } from './tracing';
+
 // Type for API URL builder function
 export type ApiUrlBuilder = (path: string) => string;
 
@@ -19,6 +21,8 @@ export class LargeFileUploader {
   private static readonly LARGE_FILE_THRESHOLD = 100 * 1024 * 1024; // 100MB
 
   private abortController?: AbortController;
+  // One trace per upload, shared by all of its requests
+  private traceId = newTraceId();
   private buildApiUrl: ApiUrlBuilder;
 
   constructor(buildApiUrl: ApiUrlBuilder) {
@@ -43,6 +47,7 @@ export class LargeFileUploader {
     } = options;
 
     this.abortController = new AbortController();
+    this.traceId = newTraceId();
 
     try {
       // Calculate total chunks
@@ -53,6 +58,7 @@ export class LargeFileUploader {
         method: 'POST',
         headers: {
           'Content-Type': 'application/json',
+          ...traceHeaders(this.traceId),
         },
         body: JSON.stringify({
           filename: file.name,
@@ -116,17 +122,18 @@ export class LargeFileUploader {
 
       const response = await fetch(this.buildApiUrl('/multipart/upload-chunk'), {
         method: 'POST',
+        headers: traceHeaders(this.traceId),
         body: formData,
         signal: this.abortController?.signal
       });
 
       if (!response.ok) {
-        throw new Error(`Chunk upload failed: ${response.statusText}`);
+        throw new ChunkUploadError(`Chunk upload failed: ${response.statusText}`, retryAfterMs(response));
       }
     } catch (error) {
       if (retryCount < LargeFileUploader.MAX_RETRIES) {
-        // Retry with exponential backoff
-        const delay = Math.pow(2, retryCount) * 1000;
+        // Retry when the server says (429), otherwise with exponential backoff
+        const delay = (error instanceof ChunkUploadError && error.retryAfterMs) || Math.pow(2, retryCount) * 1000;
         await new Promise(resolve => setTimeout(resolve, delay));
         return this.uploadChunkWithRetry(
           chunk,
@@ -140,61 +147,131 @@ export class LargeFileUploader {
     }
   }
 
-  // Upload using presigned URL (for very large files)
+  // Upload directly to storage using presigned part URLs (for very large files).
+  // Parts bypass the server; it only signs the URLs and verifies the ETags at the end.
   async uploadWithPresignedUrl(
     file: File,
     path?: string,
     onProgress?: (progress: number) => void
   ): Promise<void> {
+    this.abortController = new AbortController();
+    this.traceId = newTraceId();
+
+    const initResponse = await fetch(this.buildApiUrl('/direct/initiate'), {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+        ...traceHeaders(this.traceId),
+      },
+      body: JSON.stringify({
+        filename: file.name,
+        path: path,
+        file_size: file.size,
+        content_type: file.type || 'application/octet-stream'
+      }),
+      signal: this.abortController.signal
+    });
+
+    if (!initResponse.ok) {
+      throw new Error(`Failed to initiate upload: ${initResponse.statusText}`);
+    }
+
+    const { session_id, part_size, parts } = await initResponse.json() as {
+      session_id: string;
+      part_size: number;
+      parts: { part_number: number; url: string }[];
+    };
+
     try {
-      // Get presigned URL from server
-      const response = await fetch(this.buildApiUrl('/presigned-url'), {
+      const loaded = new Array<number>(parts.length).fill(0);
+      const completed: { part_number: number; etag: string }[] = [];
+
+      for (const part of parts) {
+        const start = (part.part_number - 1) * part_size;
+        const chunk = file.slice(start, Math.min(start + part_size, file.size));
+
+        const etag = await this.putPartWithRetry(part.url, chunk, (bytes) => {
+          loaded[part.part_number - 1] = bytes;
+          const total = loaded.reduce((sum, n) => sum + n, 0);
+          onProgress?.((total / file.size) * 100);
+        }, 0);
+        completed.push({ part_number: part.part_number, etag });
+      }
+
+      const completeResponse = await fetch(this.buildApiUrl('/direct/complete'), {
         method: 'POST',
         headers: {
           'Content-Type': 'application/json',
+          ...traceHeaders(this.traceId),
         },
-        body: JSON.stringify({
-          filename: file.name,
-          path: path
-        })
+        body: JSON.stringify({ session_id, parts: completed }),
+        signal: this.abortController.signal
       });
 
-      if (!response.ok) {
-        throw new Error('Failed to get presigned URL');
+      if (!completeResponse.ok) {
+        throw new Error(`Failed to complete upload: ${await completeResponse.text()}`);
       }
+    } catch (error) {
+      // Release the parts already stored in MinIO
+      fetch(this.buildApiUrl(`/direct/abort?session_id=${encodeURIComponent(session_id)}`), {
+        method: 'POST',
+        headers: traceHeaders(this.traceId),
+      }).catch(() => {});
+      throw error;
+    }
+  }
 
-      const { upload_url } = await response.json();
-
-      // Upload directly to S3 using presigned URL
+  // PUT one part to its presigned URL and return the ETag MinIO assigned to it
+  private putPartWithRetry(
+    url: string,
+    chunk: Blob,
+    onPartProgress: (loaded: number) => void,
+    retryCount: number
+  ): Promise<string> {
+    return new Promise<string>((resolve, reject) => {
       const xhr = new XMLHttpRequest();
+      const signal = this.abortController?.signal;
+      const onAbort = () => xhr.abort();
+      signal?.addEventListener('abort', onAbort);
 
-      return new Promise((resolve, reject) => {
-        xhr.upload.addEventListener('progress', (event) => {
-          if (event.lengthComputable) {
-            const progress = (event.loaded / event.total) * 100;
-            onProgress?.(progress);
-          }
-        });
-
-        xhr.addEventListener('load', () => {
-          if (xhr.status >= 200 && xhr.status < 300) {
-            resolve();
-          } else {
-            reject(new Error(`Upload failed with status ${xhr.status}`));
-          }
-        });
-
-        xhr.addEventListener('error', () => {
-          reject(new Error('Network error during upload'));
-        });
-
-        xhr.open('PUT', upload_url);
-        xhr.setRequestHeader('Content-Type', file.type || 'application/octet-stream');
-        xhr.send(file);
+      xhr.upload.addEventListener('progress', (event) => {
+        if (event.lengthComputable) {
+          onPartProgress(event.loaded);
+        }
       });
-    } catch (error) {
-      throw error;
-    }
+
+      xhr.addEventListener('load', () => {
+        signal?.removeEventListener('abort', onAbort);
+        const etag = xhr.getResponseHeader('ETag');
+        if (xhr.status >= 200 && xhr.status < 300 && etag) {
+          resolve(etag);
+        } else {
+          reject(new Error(`Part upload failed with status ${xhr.status}`));
+        }
+      });
+
+      xhr.addEventListener('error', () => {
+        signal?.removeEventListener('abort', onAbort);
+        reject(new Error('Network error during upload'));
+      });
+
+      xhr.addEventListener('abort', () => {
+        signal?.removeEventListener('abort', onAbort);
+        reject(new Error('Upload aborted'));
+      });
+
+      xhr.open('PUT', url);
+      xhr.send(chunk);
+    }).catch(async (error) => {
+      if (this.abortController?.signal.aborted || retryCount >= LargeFileUploader.MAX_RETRIES) {
+        throw error;
+      }
+      // Retry with exponential backoff
+      const delay = Math.pow(2, retryCount) * 1000;
+      await new Promise(resolve => setTimeout(resolve, delay));
+      onPartProgress(0);
+      return this.putPartWithRetry(url, chunk, onPartProgress, retryCount + 1);
+    });
   }
 
   // Abort ongoing upload
@@ -212,6 +289,19 @@ export function formatFileSize(bytes: number): string {
   return Math.round(bytes / Math.pow(k, i) * 100) / 100 + ' ' + sizes[i];
 }
 
+class ChunkUploadError extends Error {
+  constructor(message: string, readonly retryAfterMs?: number) {
+    super(message);
+  }
+}
+
+// retryAfterMs reads the Retry-After header of a 429 (rate limited) response
+function retryAfterMs(response: Response): number | undefined {
+  if (response.status !== 429) return undefined;
+  const seconds = parseInt(response.headers.get('Retry-After') || '', 10);
+  return Number.isFinite(seconds) ? seconds * 1000 : undefined;
+}
+
 // Helper to determine upload strategy
 export function getUploadStrategy(fileSize: number): 'standard' | 'chunked' | 'presigned' {
   if (fileSize < 100 * 1024 * 1024) { // < 100MB
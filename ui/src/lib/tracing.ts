@@ -0,0 +1,18 @@
+// W3C Trace Context headers for API calls, so server traces start at the user action.
+// All requests of one operation (e.g. every chunk of an upload) share a trace ID;
+// each request gets its own parent span ID.
+
+function randomHex(bytes: number): string {
+  const buffer = new Uint8Array(bytes);
+  crypto.getRandomValues(buffer);
+  return Array.from(buffer, (b) => b.toString(16).padStart(2, '0')).join('');
+}
+
+export function newTraceId(): string {
+  return randomHex(16);
+}
+
+// Headers for one request; pass a trace ID to group it with related requests
+export function traceHeaders(traceId: string = newTraceId()): Record<string, string> {
+  return { traceparent: `00-${traceId}-${randomHex(8)}-01` };
+}